@@ -0,0 +1,144 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/NguyenTrongPhuc552003/elmos/internal/core"
+	"github.com/NguyenTrongPhuc552003/elmos/internal/image"
+)
+
+var imageIdleWatchCmd = &cobra.Command{
+	Use:    "idle-watch",
+	Short:  "Unmount an auto-mounted image once it is idle (started automatically)",
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runIdleWatch()
+	},
+}
+
+func init() {
+	imageCmd.AddCommand(imageIdleWatchCmd)
+	cobra.OnFinalize(startIdleWatcher)
+}
+
+// readAutoMountState loads the on-demand mount record, or nil if there is none
+func readAutoMountState() *core.AutoMountState {
+	content, err := os.ReadFile(ctx.Config.AutoMountFile())
+	if err != nil {
+		return nil
+	}
+	state := &core.AutoMountState{}
+	if json.Unmarshal(content, state) != nil {
+		return nil
+	}
+	return state
+}
+
+// writeAutoMountState saves the record without touching its meaning as
+// "last used": the modification time is restored afterwards
+func writeAutoMountState(state *core.AutoMountState) error {
+	path := ctx.Config.AutoMountFile()
+	info, statErr := os.Stat(path)
+
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return err
+	}
+	if statErr == nil {
+		os.Chtimes(path, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+// startIdleWatcher runs after every command. If the command auto-mounted the
+// image and image.idle_unmount is set, it starts a background watcher that
+// unmounts the image once it has been unused for that long.
+func startIdleWatcher() {
+	if ctx == nil || !ctx.AutoMounted || ctx.Config.Image.IdleUnmount == "" {
+		return
+	}
+	if _, err := time.ParseDuration(ctx.Config.Image.IdleUnmount); err != nil {
+		printWarn("Invalid image.idle_unmount %q: %v", ctx.Config.Image.IdleUnmount, err)
+		return
+	}
+
+	state := readAutoMountState()
+	if state == nil || processAlive(state.WatcherPID) {
+		return
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	watcher := exec.Command(exe, "image", "idle-watch")
+	// The watcher reads elmos.yaml from the project root and outlives the terminal
+	watcher.Dir = ctx.Config.Paths.ProjectRoot
+	watcher.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := watcher.Start(); err != nil {
+		printWarn("Failed to start idle unmount watcher: %v", err)
+		return
+	}
+
+	state.WatcherPID = watcher.Process.Pid
+	writeAutoMountState(state)
+	watcher.Process.Release()
+}
+
+// runIdleWatch polls the auto-mount record and unmounts the image once it has
+// been unused for image.idle_unmount and no process has files open on it
+func runIdleWatch() error {
+	cfg := ctx.Config
+
+	idle, err := time.ParseDuration(cfg.Image.IdleUnmount)
+	if err != nil || idle <= 0 {
+		return nil
+	}
+	interval := min(max(idle/4, 5*time.Second), time.Minute)
+
+	for {
+		time.Sleep(interval)
+
+		info, err := os.Stat(cfg.AutoMountFile())
+		if err != nil {
+			// Unmounted or taken over by hand
+			return nil
+		}
+		state := readAutoMountState()
+		if state == nil || state.WatcherPID != os.Getpid() {
+			return nil
+		}
+		if !ctx.IsMounted() {
+			os.Remove(cfg.AutoMountFile())
+			return nil
+		}
+
+		if time.Since(info.ModTime()) < idle || image.Busy(cfg.Image.MountPoint) {
+			continue
+		}
+
+		// Without a terminal, unmounts that need sudo fail; give up rather than retry forever
+		err = ctx.Image().Unmount()
+		os.Remove(cfg.AutoMountFile())
+		return err
+	}
+}
+
+// processAlive reports whether a process with the given PID exists
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,556 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var repoRestoreCmd = &cobra.Command{
+	Use:   "restore [backup]",
+	Short: "Restore local work from a backup (lists backups without an argument)",
+	Long: `Restore local work saved before a destructive repo operation.
+
+Commits come back as branches under restore/<backup>/, stashes are re-added
+to the stash list, uncommitted changes are re-applied and untracked files
+are copied back (existing files are never overwritten). Use "latest" for the
+most recent backup.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return runRepoBackupList()
+		}
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		return runRepoRestore(args[0])
+	},
+}
+
+func init() {
+	repoCmd.AddCommand(repoRestoreCmd)
+}
+
+// repoGuard controls the safety checks before destructive repo operations
+type repoGuard struct {
+	Force    bool
+	NoBackup bool
+}
+
+// addGuardFlags registers the --force and --no-backup flags on a command
+func addGuardFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolP("force", "f", false, "Do not ask for confirmation")
+	cmd.Flags().Bool("no-backup", false, "Do not back up local work before discarding it")
+}
+
+// guardFromFlags reads the --force and --no-backup flags
+func guardFromFlags(cmd *cobra.Command) repoGuard {
+	force, _ := cmd.Flags().GetBool("force")
+	noBackup, _ := cmd.Flags().GetBool("no-backup")
+	return repoGuard{Force: force, NoBackup: noBackup}
+}
+
+// localWork describes work in a kernel tree that a reset or re-clone would lose
+type localWork struct {
+	Head      string   `json:"head"`
+	Branch    string   `json:"branch"`
+	Unpushed  []string `json:"unpushed"`
+	Stashes   []string `json:"stashes"`
+	Modified  []string `json:"modified"`
+	Untracked []string `json:"untracked"`
+}
+
+// empty reports whether there is nothing to lose
+func (w *localWork) empty() bool {
+	return len(w.Unpushed) == 0 && len(w.Stashes) == 0 &&
+		len(w.Modified) == 0 && len(w.Untracked) == 0
+}
+
+// detectLocalWork finds unpushed commits, stashes, uncommitted changes and
+// untracked files that are not ignored build output
+func detectLocalWork(dir string) (*localWork, error) {
+	head, err := gitOutputIn(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HEAD in %s: %w", dir, err)
+	}
+
+	w := &localWork{Head: head}
+	w.Branch, _ = gitOutputIn(dir, "rev-parse", "--abbrev-ref", "HEAD")
+
+	// Commits on any local branch or HEAD that no remote-tracking branch contains
+	w.Unpushed = withoutSeriesPatches(dir, outputLines(gitOutputIn(dir, "log", "--oneline", "--branches", "HEAD", "--not", "--remotes")))
+	w.Stashes = outputLines(gitOutputIn(dir, "stash", "list"))
+	w.Modified = outputLines(gitOutputIn(dir, "diff", "--name-only", "HEAD"))
+	// --exclude-standard honours the kernel's .gitignore, so build output is skipped
+	w.Untracked = outputLines(gitOutputIn(dir, "ls-files", "--others", "--exclude-standard"))
+
+	return w, nil
+}
+
+// withoutSeriesPatches drops commits of the project patch series from
+// "git log --oneline" lines. They are never pushed (patches.auto_apply
+// commits them after every update) and the series recreates them, so they
+// are not local work.
+func withoutSeriesPatches(dir string, commits []string) []string {
+	if len(commits) == 0 {
+		return commits
+	}
+	seriesDir, err := patchSeriesDir()
+	if err != nil {
+		return commits
+	}
+	series, err := loadSeries(seriesDir)
+	if err != nil {
+		return commits
+	}
+
+	seriesIDs := map[string]bool{}
+	for _, name := range appliedPatches(seriesDir, series) {
+		f, err := os.Open(filepath.Join(seriesDir, name))
+		if err != nil {
+			continue
+		}
+		if id := gitPatchID(dir, f); id != "" {
+			seriesIDs[id] = true
+		}
+		f.Close()
+	}
+	if len(seriesIDs) == 0 {
+		return commits
+	}
+
+	var kept []string
+	for _, line := range commits {
+		sha, _, _ := strings.Cut(line, " ")
+		show := exec.Command("git", "show", "--format=", sha)
+		show.Dir = dir
+		diff, err := show.Output()
+		if err == nil && seriesIDs[gitPatchID(dir, bytes.NewReader(diff))] {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return kept
+}
+
+// gitPatchID returns the stable patch ID of a diff, which does not depend
+// on the commit it comes from, or "" if there is none
+func gitPatchID(dir string, diff io.Reader) string {
+	cmd := exec.Command("git", "patch-id", "--stable")
+	cmd.Dir = dir
+	cmd.Stdin = diff
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	id, _, _ := strings.Cut(strings.TrimSpace(string(out)), " ")
+	return id
+}
+
+// outputLines splits command output into non-empty lines, ignoring errors
+func outputLines(out string, err error) []string {
+	if err != nil || out == "" {
+		return nil
+	}
+	return strings.Split(out, "\n")
+}
+
+// printLocalWork summarizes local work, showing at most a few entries per kind
+func printLocalWork(w *localWork) {
+	show := func(title string, items []string) {
+		if len(items) == 0 {
+			return
+		}
+		printWarn("%d %s", len(items), title)
+		for i, item := range items {
+			if i == 5 {
+				fmt.Printf("    ... and %d more\n", len(items)-i)
+				break
+			}
+			fmt.Printf("    %s\n", item)
+		}
+	}
+	show("unpushed commit(s):", w.Unpushed)
+	show("stash(es):", w.Stashes)
+	show("modified file(s):", w.Modified)
+	show("untracked file(s):", w.Untracked)
+}
+
+// guardLocalWork checks dir for local work before a destructive operation,
+// backs it up unless disabled and asks for confirmation unless forced.
+// alwaysConfirm requests confirmation even when no local work is found.
+func guardLocalWork(dir, operation string, guard repoGuard, alwaysConfirm bool) error {
+	w, err := detectLocalWork(dir)
+	if err != nil {
+		return err
+	}
+
+	if w.empty() {
+		if !alwaysConfirm || guard.Force {
+			return nil
+		}
+	} else {
+		printWarn("Local work in %s would be lost by %s:", dir, operation)
+		printLocalWork(w)
+
+		if !guard.NoBackup {
+			backup, err := createRepoBackup(dir, w)
+			if err != nil {
+				return fmt.Errorf("backup failed (use --no-backup to skip): %w", err)
+			}
+			printSuccess("Backed up local work to %s", backup)
+			printInfo("Restore with: elmos repo restore %s", filepath.Base(backup))
+		}
+	}
+
+	if guard.Force {
+		return nil
+	}
+	if !confirm(fmt.Sprintf("Continue with %s?", operation)) {
+		return fmt.Errorf("%s cancelled (use --force to skip this prompt)", operation)
+	}
+	return nil
+}
+
+// backupsDir returns the directory holding repo backups
+func backupsDir() string {
+	return filepath.Join(ctx.Config.StateDir(), "backups")
+}
+
+// createRepoBackup saves local work from dir into a new timestamped backup
+// directory: a git bundle of local commits and stashes, the unpushed commits
+// as patches, a diff of uncommitted changes and copies of untracked files
+func createRepoBackup(dir string, w *localWork) (string, error) {
+	backup, err := newBackupDir()
+	if err != nil {
+		return "", err
+	}
+
+	// Stashes only live in the reflog, so pin each one to a ref the bundle can carry
+	var stashRefs []string
+	for i := range w.Stashes {
+		sha, err := gitOutputIn(dir, "rev-parse", fmt.Sprintf("stash@{%d}", i))
+		if err != nil {
+			continue
+		}
+		ref := fmt.Sprintf("refs/elmos-backup/stash-%d", i)
+		if err := runGitQuiet(dir, "update-ref", ref, sha); err == nil {
+			stashRefs = append(stashRefs, ref)
+		}
+	}
+	defer func() {
+		for _, ref := range stashRefs {
+			runGitQuiet(dir, "update-ref", "-d", ref)
+		}
+	}()
+
+	if len(w.Unpushed) > 0 || len(stashRefs) > 0 {
+		args := []string{"bundle", "create", filepath.Join(backup, "local.bundle"), "--branches", "HEAD"}
+		args = append(args, stashRefs...)
+		args = append(args, "--not", "--remotes")
+		if err := runGitQuiet(dir, args...); err != nil {
+			return backup, fmt.Errorf("git bundle failed: %w", err)
+		}
+	}
+
+	if len(w.Unpushed) > 0 {
+		patchesDir := filepath.Join(backup, "patches")
+		if err := os.MkdirAll(patchesDir, 0755); err != nil {
+			return backup, err
+		}
+		cmd := exec.Command("git", "format-patch", "--quiet", "-o", patchesDir, "--stdin", "HEAD")
+		cmd.Dir = dir
+		// --stdin reads the negative revisions to exclude commits already on a remote
+		if remotes, err := gitOutputIn(dir, "for-each-ref", "--format=^%(refname)", "refs/remotes"); err == nil {
+			cmd.Stdin = strings.NewReader(remotes + "\n")
+		}
+		if err := cmd.Run(); err != nil {
+			printWarn("Failed to export patches: %v", err)
+		}
+	}
+
+	if len(w.Modified) > 0 {
+		diff, err := gitOutputIn(dir, "diff", "--binary", "HEAD")
+		if err != nil {
+			return backup, fmt.Errorf("git diff failed: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(backup, "worktree.diff"), []byte(diff+"\n"), 0644); err != nil {
+			return backup, err
+		}
+	}
+
+	for _, rel := range w.Untracked {
+		if err := copyFile(filepath.Join(dir, rel), filepath.Join(backup, "untracked", rel)); err != nil {
+			printWarn("Failed to back up %s: %v", rel, err)
+		}
+	}
+
+	manifest, err := json.MarshalIndent(w, "", "  ")
+	if err != nil {
+		return backup, err
+	}
+	if err := os.WriteFile(filepath.Join(backup, "manifest.json"), manifest, 0644); err != nil {
+		return backup, err
+	}
+
+	return backup, nil
+}
+
+func runRepoBackupList() error {
+	names, err := listBackups()
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		printInfo("No backups in %s", backupsDir())
+		return nil
+	}
+
+	fmt.Println("Available backups:")
+	for _, name := range names {
+		w, err := readBackupManifest(name)
+		if err != nil {
+			fmt.Printf("  %s (unreadable manifest)\n", name)
+			continue
+		}
+		fmt.Printf("  %s  %s@%s: %d commit(s), %d stash(es), %d modified, %d untracked\n",
+			name, w.Branch, w.Head[:min(12, len(w.Head))],
+			len(w.Unpushed), len(w.Stashes), len(w.Modified), len(w.Untracked))
+	}
+	return nil
+}
+
+func runRepoRestore(name string) error {
+	if name == "latest" {
+		names, err := listBackups()
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("no backups in %s", backupsDir())
+		}
+		name = names[len(names)-1]
+	}
+
+	backup := filepath.Join(backupsDir(), name)
+	w, err := readBackupManifest(name)
+	if err != nil {
+		return fmt.Errorf("backup not found: %s", name)
+	}
+
+	dir := ctx.KernelDir
+	printStep("Restoring backup %s into %s...", name, dir)
+
+	bundle := filepath.Join(backup, "local.bundle")
+	if _, err := os.Stat(bundle); err == nil {
+		heads := outputLines(gitOutputIn(dir, "bundle", "list-heads", bundle))
+
+		// Fetch only what the bundle carries: a backup of stashes alone has
+		// no branches or HEAD. Stashes land on temporary refs until they are
+		// stored again.
+		stashPrefix := fmt.Sprintf("refs/elmos-backup/restore-%s/", name)
+		var refspecs, stashRefs []string
+		branches := false
+		for _, line := range heads {
+			_, refname, _ := strings.Cut(line, " ")
+			switch {
+			case refname == "HEAD":
+				refspecs = append(refspecs, fmt.Sprintf("+HEAD:refs/heads/restore/%s/HEAD", name))
+				branches = true
+			case strings.HasPrefix(refname, "refs/heads/"):
+				refspecs = append(refspecs, fmt.Sprintf("+%s:refs/heads/restore/%s/%s", refname, name, strings.TrimPrefix(refname, "refs/heads/")))
+				branches = true
+			case strings.HasPrefix(refname, "refs/elmos-backup/"):
+				ref := stashPrefix + path.Base(refname)
+				refspecs = append(refspecs, fmt.Sprintf("+%s:%s", refname, ref))
+				stashRefs = append(stashRefs, ref)
+			}
+		}
+		defer func() {
+			for _, ref := range stashRefs {
+				runGitQuiet(dir, "update-ref", "-d", ref)
+			}
+		}()
+
+		if len(refspecs) > 0 {
+			if err := runGitQuiet(dir, append([]string{"fetch", bundle}, refspecs...)...); err != nil {
+				return fmt.Errorf("failed to fetch from bundle: %w", err)
+			}
+		}
+		if branches {
+			printSuccess("Commits restored to branches restore/%s/*", name)
+		}
+
+		// Re-add stashes oldest first so the original order is kept
+		count := 0
+		for i := len(w.Stashes) - 1; i >= 0; i-- {
+			ref := fmt.Sprintf("%sstash-%d", stashPrefix, i)
+			sha, err := gitOutputIn(dir, "rev-parse", "--verify", "--quiet", ref)
+			if err != nil {
+				continue
+			}
+			msg := fmt.Sprintf("elmos backup %s: %s", name, w.Stashes[i])
+			if err := runGitQuiet(dir, "stash", "store", "-m", msg, sha); err != nil {
+				printWarn("Failed to restore stash %d: %v", i, err)
+				continue
+			}
+			count++
+		}
+		if count > 0 {
+			printSuccess("Restored %d stash(es)", count)
+		}
+	}
+
+	diff := filepath.Join(backup, "worktree.diff")
+	if _, err := os.Stat(diff); err == nil {
+		if err := runGitIn(dir, "apply", "--3way", diff); err != nil {
+			printWarn("Uncommitted changes did not apply cleanly; the diff is at %s", diff)
+		} else {
+			printSuccess("Re-applied uncommitted changes")
+		}
+	}
+
+	restored, skipped := 0, 0
+	for _, rel := range w.Untracked {
+		dst := filepath.Join(dir, rel)
+		if _, err := os.Stat(dst); err == nil {
+			skipped++
+			continue
+		}
+		if err := copyFile(filepath.Join(backup, "untracked", rel), dst); err != nil {
+			printWarn("Failed to restore %s: %v", rel, err)
+			continue
+		}
+		restored++
+	}
+	if restored > 0 || skipped > 0 {
+		printSuccess("Restored %d untracked file(s), skipped %d existing", restored, skipped)
+	}
+
+	return nil
+}
+
+// newBackupDir creates an empty directory for a backup named after the
+// current time, with a suffix when a backup was made in the same second
+func newBackupDir() (string, error) {
+	if err := os.MkdirAll(backupsDir(), 0755); err != nil {
+		return "", err
+	}
+	name := time.Now().Format("20060102-150405")
+	for i := 1; ; i++ {
+		backup := filepath.Join(backupsDir(), name)
+		if i > 1 {
+			backup += fmt.Sprintf("-%02d", i)
+		}
+		err := os.Mkdir(backup, 0755)
+		if err == nil {
+			return backup, nil
+		}
+		if !os.IsExist(err) || i == 99 {
+			return "", err
+		}
+	}
+}
+
+// listBackups returns backup names, oldest first
+func listBackups() ([]string, error) {
+	entries, err := os.ReadDir(backupsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// readBackupManifest loads the manifest of a named backup
+func readBackupManifest(name string) (*localWork, error) {
+	content, err := os.ReadFile(filepath.Join(backupsDir(), name, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	w := &localWork{}
+	if err := json.Unmarshal(content, w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// runGitQuiet runs a git command in dir, showing stderr only on failure
+func runGitQuiet(dir string, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil && ctx.Verbose {
+		os.Stderr.Write(out)
+	}
+	return err
+}
+
+// copyFile copies a regular file or symlink, creating parent directories
+func copyFile(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// confirm asks a yes/no question on the terminal; without a terminal it answers no
+func confirm(question string) bool {
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	fmt.Print(warnStyle.Render("? "+question) + " [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,485 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// bisectCmd - automated build-and-boot bisection
+var bisectCmd = &cobra.Command{
+	Use:   "bisect",
+	Short: "Find the commit that broke booting",
+	Long: `Bisect the active kernel tree between a good and a bad revision.
+
+Every step applies the project patch series, runs olddefconfig on the
+.config saved at start, builds the Image and boots it headless in QEMU with
+the rootfs disk image (guest writes are discarded). A boot that prints the
+success marker is good, a panic or timeout is bad, and a commit that does
+not build is skipped.
+
+Examples:
+  elmos bisect start v6.17 v6.18
+  elmos bisect start v6.17 HEAD --marker "login:" --timeout 3m
+  elmos bisect report              # Show the last report
+  elmos bisect reset               # Abort and restore the tree`,
+}
+
+var bisectStartCmd = &cobra.Command{
+	Use:   "start [good] [bad]",
+	Short: "Bisect between a good and a bad revision",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+
+		session := bisectSession{Good: args[0], Bad: args[1]}
+		session.Marker, _ = cmd.Flags().GetString("marker")
+		session.Timeout, _ = cmd.Flags().GetDuration("timeout")
+		session.Jobs, _ = cmd.Flags().GetInt("jobs")
+		if session.Jobs == 0 {
+			session.Jobs = ctx.Config.Build.Jobs
+		}
+		return runBisectStart(&session)
+	},
+}
+
+var bisectStepCmd = &cobra.Command{
+	Use:    "step",
+	Short:  "Test the current commit (run by git bisect run)",
+	Hidden: true,
+	Args:   cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		// git bisect run only understands exit codes
+		os.Exit(runBisectStep())
+	},
+}
+
+var bisectReportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Show the report of the last bisection",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		content, err := os.ReadFile(filepath.Join(bisectDir(), "report.txt"))
+		if err != nil {
+			return fmt.Errorf("no bisect report found (run 'elmos bisect start')")
+		}
+		fmt.Print(string(content))
+		return nil
+	},
+}
+
+var bisectResetCmd = &cobra.Command{
+	Use:   "reset",
+	Short: "Abort a bisection and restore the tree and .config",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		return runBisectReset()
+	},
+}
+
+func init() {
+	bisectCmd.AddCommand(bisectStartCmd)
+	bisectCmd.AddCommand(bisectStepCmd)
+	bisectCmd.AddCommand(bisectReportCmd)
+	bisectCmd.AddCommand(bisectResetCmd)
+
+	bisectStartCmd.Flags().String("marker", "System ready.", "Serial console line that marks a successful boot")
+	bisectStartCmd.Flags().Duration("timeout", 5*time.Minute, "Boot timeout; a boot without the marker is bad")
+	bisectStartCmd.Flags().IntP("jobs", "j", 0, "Number of parallel build jobs (default: auto)")
+}
+
+// git bisect run exit codes
+const (
+	bisectGood  = 0
+	bisectBad   = 1
+	bisectSkip  = 125
+	bisectAbort = 128
+)
+
+// bisectSession is saved at start so each step, run as a separate process
+// by git bisect run, knows how to build and boot
+type bisectSession struct {
+	Tree     string        `json:"tree"`
+	Good     string        `json:"good"`
+	Bad      string        `json:"bad"`
+	Marker   string        `json:"marker"`
+	Timeout  time.Duration `json:"timeout"`
+	Jobs     int           `json:"jobs"`
+	OrigHead string        `json:"origHead"`
+	Started  time.Time     `json:"started"`
+}
+
+// bisectStepResult records the outcome of one tested commit
+type bisectStepResult struct {
+	Commit   string `json:"commit"`
+	Subject  string `json:"subject"`
+	Result   string `json:"result"`
+	Reason   string `json:"reason"`
+	BuildLog string `json:"buildLog"`
+	BootLog  string `json:"bootLog,omitempty"`
+}
+
+// bisectDir returns the directory holding the bisect session, logs and report
+func bisectDir() string {
+	return filepath.Join(ctx.Config.StateDir(), "bisect")
+}
+
+func runBisectStart(session *bisectSession) error {
+	cfg := ctx.Config
+	dir := bisectDir()
+
+	if !ctx.KernelExists() {
+		return fmt.Errorf("kernel repository not found at %s (run 'elmos repo clone')", ctx.KernelDir)
+	}
+	if _, err := gitOutput("bisect", "log"); err == nil {
+		return fmt.Errorf("a bisection is already in progress (run 'elmos bisect reset')")
+	}
+	if changes, _ := gitOutput("status", "--porcelain", "--untracked-files=no"); changes != "" {
+		return fmt.Errorf("kernel tree has uncommitted changes; commit or stash them first")
+	}
+	if !ctx.HasConfig() {
+		return fmt.Errorf("kernel not configured - run 'elmos kernel config' first")
+	}
+	if _, err := os.Stat(cfg.DiskImage()); err != nil {
+		return fmt.Errorf("disk image not found: %s (run 'elmos rootfs create')", cfg.DiskImage())
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// Start from an empty session directory
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "logs"), 0755); err != nil {
+		return err
+	}
+	if err := copyFile(filepath.Join(ctx.KernelDir, ".config"), filepath.Join(dir, "config")); err != nil {
+		return fmt.Errorf("failed to save .config: %w", err)
+	}
+
+	session.Tree = ctx.KernelDir
+	session.Started = time.Now()
+	if session.OrigHead, err = gitOutput("symbolic-ref", "--short", "-q", "HEAD"); err != nil {
+		session.OrigHead, _ = gitOutput("rev-parse", "HEAD")
+	}
+	if err := writeJSONFile(filepath.Join(dir, "session.json"), session); err != nil {
+		return err
+	}
+
+	printStep("Bisecting %s..%s in %s", session.Good, session.Bad, ctx.KernelDir)
+	printInfo("Success marker: %q, boot timeout: %s", session.Marker, session.Timeout)
+
+	if err := runGitCommand("bisect", "start", session.Bad, session.Good); err != nil {
+		return fmt.Errorf("git bisect start failed: %w", err)
+	}
+
+	// Steps load elmos.yaml from the project root, while git runs them in the tree
+	step := fmt.Sprintf("cd %s && exec %s", shellQuote(cfg.Paths.ProjectRoot), shellQuote(exe))
+	if profileName != "" {
+		step += " --profile " + shellQuote(profileName)
+	}
+	step += " bisect step"
+
+	runLog, err := os.Create(filepath.Join(dir, "run.log"))
+	if err != nil {
+		return err
+	}
+	defer runLog.Close()
+
+	cmd := exec.Command("git", "bisect", "run", "sh", "-c", step)
+	cmd.Dir = ctx.KernelDir
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("git bisect run failed: %w", err)
+	}
+	firstBad := ""
+	scanner := bufio.NewScanner(io.TeeReader(out, runLog))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Println(line)
+		if sha, ok := strings.CutSuffix(line, " is the first bad commit"); ok {
+			firstBad = sha
+		}
+	}
+	runErr := cmd.Wait()
+
+	report, err := writeBisectReport(session, firstBad)
+	if err != nil {
+		printWarn("Failed to write report: %v", err)
+	}
+
+	if err := runBisectReset(); err != nil {
+		printWarn("Failed to restore the tree: %v", err)
+	}
+
+	fmt.Println()
+	fmt.Print(report)
+
+	if firstBad == "" {
+		if runErr != nil {
+			return fmt.Errorf("bisection did not finish: %w", runErr)
+		}
+		return fmt.Errorf("bisection did not find a first bad commit (see %s)", filepath.Join(dir, "run.log"))
+	}
+	return nil
+}
+
+// runBisectStep tests the checked out commit and returns the git bisect run exit code
+func runBisectStep() int {
+	dir := bisectDir()
+
+	session := &bisectSession{}
+	if err := readJSONFile(filepath.Join(dir, "session.json"), session); err != nil {
+		printError("No bisect session: %v", err)
+		return bisectAbort
+	}
+	// Steps must test the tree the session was started in, whatever is active now
+	ctx.KernelDir = session.Tree
+
+	head, err := gitOutput("rev-parse", "HEAD")
+	if err != nil {
+		printError("Failed to read HEAD: %v", err)
+		return bisectAbort
+	}
+	short := head[:min(12, len(head))]
+	subject, _ := gitOutput("log", "-1", "--format=%s")
+
+	result := &bisectStepResult{
+		Commit:   head,
+		Subject:  subject,
+		BuildLog: filepath.Join(dir, "logs", short+".build.log"),
+		BootLog:  filepath.Join(dir, "logs", short+".boot.log"),
+	}
+	code := testBisectCommit(session, result)
+	switch code {
+	case bisectGood:
+		result.Result = "good"
+	case bisectBad:
+		result.Result = "bad"
+	default:
+		result.Result = "skip"
+	}
+	if err := appendJSONLine(filepath.Join(dir, "steps.jsonl"), result); err != nil {
+		printWarn("Failed to record step: %v", err)
+	}
+
+	printInfo("%s %s: %s (%s)", short, subject, result.Result, result.Reason)
+	return code
+}
+
+// testBisectCommit builds and boots the checked out commit. Patches are
+// applied to the index only and reverted afterwards, so git bisect sees
+// the commit it checked out.
+func testBisectCommit(session *bisectSession, result *bisectStepResult) int {
+	dir := bisectDir()
+
+	buildLog, err := os.Create(result.BuildLog)
+	if err != nil {
+		result.Reason = err.Error()
+		return bisectAbort
+	}
+	defer buildLog.Close()
+
+	// Send make output and elmos messages to the build log
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = buildLog, buildLog
+	defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+
+	defer func() {
+		if err := runGitIn(ctx.KernelDir, "reset", "--quiet", "--hard", result.Commit); err != nil {
+			fmt.Fprintf(stderr, "failed to revert patches: %v\n", err)
+		}
+	}()
+	applyBisectPatches()
+
+	if err := copyFile(filepath.Join(dir, "config"), filepath.Join(ctx.KernelDir, ".config")); err != nil {
+		result.Reason = "failed to restore .config"
+		return bisectAbort
+	}
+	if err := runKernelConfig("olddefconfig"); err != nil {
+		result.Reason = "olddefconfig failed"
+		return bisectSkip
+	}
+	if err := runBuild(session.Jobs, []string{"Image"}); err != nil {
+		result.Reason = "build failed"
+		return bisectSkip
+	}
+
+	boot, err := runHeadlessBoot(headlessBoot{
+		Disk:     ctx.Config.DiskImage(),
+		Snapshot: true,
+		Success:  []string{session.Marker},
+		Failure:  bootPanicMarkers,
+		Timeout:  session.Timeout,
+		LogPath:  result.BootLog,
+	})
+	if err != nil {
+		result.Reason = err.Error()
+		return bisectSkip
+	}
+
+	switch boot.Outcome {
+	case bootSucceeded:
+		result.Reason = "booted"
+		return bisectGood
+	case bootTimedOut:
+		result.Reason = fmt.Sprintf("no %q within %s", session.Marker, session.Timeout)
+	default:
+		result.Reason = valueOr(boot.Line, "QEMU exited before the marker")
+	}
+	return bisectBad
+}
+
+// applyBisectPatches applies the version-matched patch series to the index
+// without committing; patches that are present or do not apply are skipped
+func applyBisectPatches() {
+	dir, err := patchSeriesDir()
+	if err != nil {
+		return
+	}
+	series, err := loadSeries(dir)
+	if err != nil {
+		return
+	}
+
+	applied := appliedPatches(dir, series)
+	for _, name := range series {
+		if slices.Contains(applied, name) {
+			continue
+		}
+		if err := runGitIn(ctx.KernelDir, "apply", "--index", filepath.Join(dir, name)); err != nil {
+			printWarn("Patch %s does not apply here", name)
+			continue
+		}
+		printInfo("Applied %s", name)
+	}
+}
+
+// writeBisectReport writes report.txt from the recorded steps and returns it
+func writeBisectReport(session *bisectSession, firstBad string) (string, error) {
+	dir := bisectDir()
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Bisect %s..%s (%s)\n", session.Good, session.Bad, session.Tree)
+	fmt.Fprintf(&b, "Started %s, marker %q, timeout %s\n\n", session.Started.Format(time.RFC3339), session.Marker, session.Timeout)
+
+	var steps []bisectStepResult
+	if f, err := os.Open(filepath.Join(dir, "steps.jsonl")); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var step bisectStepResult
+			if json.Unmarshal(scanner.Bytes(), &step) == nil {
+				steps = append(steps, step)
+			}
+		}
+		f.Close()
+	}
+
+	if firstBad != "" {
+		summary, _ := gitOutput("show", "-s", "--format=%H%n  Author: %an <%ae>%n  Date:   %ad%n%n      %s", firstBad)
+		fmt.Fprintf(&b, "First bad commit: %s\n\n", summary)
+		for _, step := range steps {
+			if step.Commit == firstBad {
+				fmt.Fprintf(&b, "  Reason:    %s\n", step.Reason)
+				fmt.Fprintf(&b, "  Build log: %s\n", step.BuildLog)
+				fmt.Fprintf(&b, "  Boot log:  %s\n", step.BootLog)
+			}
+		}
+		fmt.Fprintln(&b)
+	} else {
+		fmt.Fprintf(&b, "No first bad commit found\n\n")
+	}
+
+	fmt.Fprintf(&b, "Steps (%d):\n", len(steps))
+	for _, step := range steps {
+		fmt.Fprintf(&b, "  %-4s %s %s (%s)\n", step.Result, step.Commit[:min(12, len(step.Commit))], step.Subject, step.Reason)
+	}
+	fmt.Fprintf(&b, "\nLogs: %s\n", filepath.Join(dir, "logs"))
+
+	report := b.String()
+	return report, os.WriteFile(filepath.Join(dir, "report.txt"), []byte(report), 0644)
+}
+
+func runBisectReset() error {
+	dir := bisectDir()
+
+	session := &bisectSession{}
+	if err := readJSONFile(filepath.Join(dir, "session.json"), session); err == nil {
+		ctx.KernelDir = session.Tree
+	}
+
+	if _, err := gitOutput("bisect", "log"); err == nil {
+		if err := runGitCommand("bisect", "reset"); err != nil {
+			return fmt.Errorf("git bisect reset failed: %w", err)
+		}
+	}
+
+	saved := filepath.Join(dir, "config")
+	if _, err := os.Stat(saved); err == nil {
+		if err := copyFile(saved, filepath.Join(ctx.KernelDir, ".config")); err != nil {
+			return fmt.Errorf("failed to restore .config: %w", err)
+		}
+	}
+
+	printSuccess("Tree restored to %s", valueOr(session.OrigHead, "the original HEAD"))
+	return nil
+}
+
+// writeJSONFile writes v as indented JSON
+func writeJSONFile(path string, v any) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(content, '\n'), 0644)
+}
+
+// readJSONFile reads JSON from path into v
+func readJSONFile(path string, v any) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// appendJSONLine appends v as a single JSON line
+func appendJSONLine(path string, v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// shellQuote quotes s for use in a POSIX shell command
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
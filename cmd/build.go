@@ -2,12 +2,14 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"time"
 
-	"github.com/NguyenTrongPhuc552003/elmos/internal/core"
 	"github.com/spf13/cobra"
 )
 
@@ -68,7 +70,7 @@ func runKernelConfig(configType string) error {
 		fmt.Sprintf("CROSS_COMPILE=%s", cfg.Build.CrossCompile),
 		configType,
 	)
-	cmd.Dir = cfg.Paths.KernelDir
+	cmd.Dir = ctx.KernelDir
 	cmd.Env = ctx.GetMakeEnv()
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -89,8 +91,7 @@ func runKernelConfig(configType string) error {
 }
 
 func enableKVMConfig() error {
-	cfg := ctx.Config
-	configScript := fmt.Sprintf("%s/scripts/config", cfg.Paths.KernelDir)
+	configScript := fmt.Sprintf("%s/scripts/config", ctx.KernelDir)
 
 	cmd := exec.Command(configScript, "--file", ".config",
 		"--enable", "CONFIG_DRM",
@@ -98,7 +99,7 @@ func enableKVMConfig() error {
 		"--enable", "CONFIG_FB",
 		"--enable", "CONFIG_FRAMEBUFFER_CONSOLE",
 	)
-	cmd.Dir = cfg.Paths.KernelDir
+	cmd.Dir = ctx.KernelDir
 
 	return cmd.Run()
 }
@@ -112,7 +113,7 @@ func runKernelClean() error {
 		fmt.Sprintf("ARCH=%s", cfg.Build.Arch),
 		"distclean",
 	)
-	cmd.Dir = cfg.Paths.KernelDir
+	cmd.Dir = ctx.KernelDir
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -176,6 +177,8 @@ func runBuild(jobs int, targets []string) error {
 		return fmt.Errorf("kernel not configured - run 'elmos kernel config' first")
 	}
 
+	warnLowSpace()
+
 	printStep("Building kernel for ARCH=%s with %d jobs...", cfg.Build.Arch, jobs)
 	printInfo("Targets: %v", targets)
 
@@ -189,7 +192,7 @@ func runBuild(jobs int, targets []string) error {
 	makeArgs = append(makeArgs, targets...)
 
 	cmd := exec.Command("make", makeArgs...)
-	cmd.Dir = cfg.Paths.KernelDir
+	cmd.Dir = ctx.KernelDir
 	cmd.Env = ctx.GetMakeEnv()
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -200,6 +203,12 @@ func runBuild(jobs int, targets []string) error {
 
 	printSuccess("Build complete!")
 
+	if slices.Contains(targets, "Image") {
+		if err := writeBuildStamp(); err != nil {
+			printWarn("Failed to record build state: %v", err)
+		}
+	}
+
 	// Show output paths
 	if ctx.HasKernelImage() {
 		printInfo("Kernel image: %s", ctx.GetKernelImage())
@@ -208,295 +217,50 @@ func runBuild(jobs int, targets []string) error {
 	return nil
 }
 
-// patchCmd - patch management
-var patchCmd = &cobra.Command{
-	Use:   "patch",
-	Short: "Manage kernel patches",
-	Long:  `Apply and manage kernel patches.`,
-}
+// buildStampFile records the tree state the kernel image was built from. The
+// kernel's .gitignore covers dotfiles, so it never shows up as untracked.
+const buildStampFile = ".elmos-build.json"
 
-var patchApplyCmd = &cobra.Command{
-	Use:   "apply [patch-file]",
-	Short: "Apply a patch file",
-	Args:  cobra.ExactArgs(1),
-	RunE: func(cmd *cobra.Command, args []string) error {
-		if err := ctx.EnsureMounted(); err != nil {
-			return err
-		}
-		return runPatchApply(args[0])
-	},
+// buildStamp describes the commit and arch of the last kernel image build
+type buildStamp struct {
+	Head  string    `json:"head"`
+	Dirty bool      `json:"dirty"`
+	Arch  string    `json:"arch"`
+	Built time.Time `json:"built"`
 }
 
-var patchListCmd = &cobra.Command{
-	Use:   "list",
-	Short: "List available patches",
-	RunE: func(cmd *cobra.Command, args []string) error {
-		return runPatchList()
-	},
-}
-
-func init() {
-	patchCmd.AddCommand(patchApplyCmd)
-	patchCmd.AddCommand(patchListCmd)
-}
-
-func runPatchApply(patchFile string) error {
-	cfg := ctx.Config
-
-	// Resolve patch path
-	fullPath := patchFile
-	if patchFile[0] != '/' {
-		fullPath = fmt.Sprintf("%s/%s", cfg.Paths.ProjectRoot, patchFile)
-	}
-
-	// Check file exists
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		return fmt.Errorf("patch file not found: %s", fullPath)
+// writeBuildStamp records HEAD and the working tree state after an image build
+func writeBuildStamp() error {
+	head, err := gitOutput("rev-parse", "HEAD")
+	if err != nil {
+		return err
 	}
+	changes, _ := gitOutput("status", "--porcelain", "--untracked-files=no")
 
-	printStep("Checking patch applicability...")
-
-	// Clean any aborted am session
-	exec.Command("git", "am", "--abort").Run()
-
-	// Test with dry-run
-	testCmd := exec.Command("git", "am", "--3way", "--dry-run", fullPath)
-	testCmd.Dir = cfg.Paths.KernelDir
-	if err := testCmd.Run(); err != nil {
-		printWarn("git am dry-run failed, trying git apply...")
-		testCmd2 := exec.Command("git", "apply", "--3way", "--check", fullPath)
-		testCmd2.Dir = cfg.Paths.KernelDir
-		if err := testCmd2.Run(); err != nil {
-			return fmt.Errorf("patch cannot be applied cleanly")
-		}
+	stamp := buildStamp{
+		Head:  head,
+		Dirty: changes != "",
+		Arch:  ctx.Config.Build.Arch,
+		Built: time.Now(),
 	}
-
-	printStep("Applying patch...")
-
-	applyCmd := exec.Command("git", "am", "--3way", "--signoff", fullPath)
-	applyCmd.Dir = cfg.Paths.KernelDir
-	applyCmd.Stdout = os.Stdout
-	applyCmd.Stderr = os.Stderr
-
-	if err := applyCmd.Run(); err != nil {
-		printError("Patch application failed")
-		printInfo("Run 'git am --abort' to cancel, or 'git am --continue' after resolving")
+	content, err := json.MarshalIndent(stamp, "", "  ")
+	if err != nil {
 		return err
 	}
-
-	printSuccess("Patch applied successfully")
-	return nil
+	return os.WriteFile(filepath.Join(ctx.KernelDir, buildStampFile), content, 0644)
 }
 
-func runPatchList() error {
-	cfg := ctx.Config
-
-	entries, err := os.ReadDir(cfg.Paths.PatchesDir)
+// readBuildStamp loads the stamp written by the last image build
+func readBuildStamp() (*buildStamp, error) {
+	content, err := os.ReadFile(filepath.Join(ctx.KernelDir, buildStampFile))
 	if err != nil {
-		return fmt.Errorf("failed to read patches directory: %w", err)
-	}
-
-	if len(entries) == 0 {
-		printInfo("No patches found in %s", cfg.Paths.PatchesDir)
-		return nil
-	}
-
-	fmt.Println("Available patches:")
-	for i, entry := range entries {
-		if entry.IsDir() {
-			fmt.Printf("  %d. %s/\n", i+1, entry.Name())
-			// List patches in subdirectory
-			subPath := fmt.Sprintf("%s/%s", cfg.Paths.PatchesDir, entry.Name())
-			subEntries, _ := os.ReadDir(subPath)
-			for _, sub := range subEntries {
-				if !sub.IsDir() {
-					fmt.Printf("       - %s\n", sub.Name())
-				}
-			}
-		} else {
-			fmt.Printf("  %d. %s\n", i+1, entry.Name())
-		}
-	}
-
-	return nil
-}
-
-// rootfsCmd - rootfs management
-var rootfsCmd = &cobra.Command{
-	Use:   "rootfs",
-	Short: "Manage root filesystem",
-	Long:  `Create and manage the Debian root filesystem for QEMU.`,
-}
-
-var rootfsCreateCmd = &cobra.Command{
-	Use:   "create",
-	Short: "Create ext4 disk image with Debian rootfs",
-	RunE: func(cmd *cobra.Command, args []string) error {
-		if err := ctx.EnsureMounted(); err != nil {
-			return err
-		}
-		size, _ := cmd.Flags().GetString("size")
-		return runRootfsCreate(size)
-	},
-}
-
-func init() {
-	rootfsCmd.AddCommand(rootfsCreateCmd)
-	rootfsCreateCmd.Flags().StringP("size", "s", "5G", "Disk image size")
-}
-
-func runRootfsCreate(size string) error {
-	cfg := ctx.Config
-
-	// Map architecture for debootstrap
-	archMap := map[string]string{
-		"arm64": "arm64",
-		"riscv": "riscv64",
-		"arm":   "armhf",
-	}
-
-	debArch, ok := archMap[cfg.Build.Arch]
-	if !ok {
-		return fmt.Errorf("unsupported architecture for debootstrap: %s", cfg.Build.Arch)
-	}
-
-	printStep("Creating Debian rootfs for %s...", debArch)
-
-	// Create rootfs directory
-	os.RemoveAll(cfg.Paths.RootfsDir)
-	os.MkdirAll(cfg.Paths.RootfsDir, 0755)
-
-	// Run debootstrap
-	debootstrapDir := fmt.Sprintf("%s/tools/debootstrap", cfg.Paths.ProjectRoot)
-	debootstrapPath := filepath.Join(debootstrapDir, "debootstrap")
-
-	// Check if debootstrap exists, clone if not
-	if _, err := os.Stat(debootstrapPath); os.IsNotExist(err) {
-		printStep("Debootstrap not found. Cloning from upstream...")
-		if err := os.MkdirAll(filepath.Dir(debootstrapDir), 0755); err != nil {
-			return fmt.Errorf("failed to create tools directory: %w", err)
-		}
-
-		cloneCmd := exec.Command("git", "clone", "--depth=1", "https://salsa.debian.org/installer-team/debootstrap.git", debootstrapDir)
-		cloneCmd.Stdout = os.Stdout
-		cloneCmd.Stderr = os.Stderr
-		if err := cloneCmd.Run(); err != nil {
-			return fmt.Errorf("failed to clone debootstrap: %w", err)
-		}
-		printSuccess("Debootstrap cloned")
+		return nil, err
 	}
-
-	printStep("Running debootstrap stage 1...")
-
-	// Build environment with proper PATH (matching common.env)
-	env := ctx.GetMakeEnv() // This includes gnu-sed, llvm, e2fsprogs, coreutils in PATH
-	env = append(env, fmt.Sprintf("DEBOOTSTRAP_DIR=%s", debootstrapDir))
-
-	// Run debootstrap exactly like original: sudo env ... fakeroot debootstrap ...
-	cmd := exec.Command("sudo", "-E",
-		"fakeroot", debootstrapPath,
-		"--foreign",
-		"--arch="+debArch,
-		"--no-check-gpg",
-		"stable",
-		cfg.Paths.RootfsDir,
-		cfg.Paths.DebianMirror,
-	)
-	cmd.Env = env
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("debootstrap failed: %w", err)
-	}
-
-	// Create init script
-	if err := createInitScript(cfg.Paths.RootfsDir); err != nil {
-		return err
-	}
-
-	// Create disk image
-	printStep("Creating ext4 disk image (%s)...", size)
-
-	// Get mke2fs path from Homebrew e2fsprogs
-	e2fsSbin := core.GetBrewSbin("e2fsprogs")
-	mke2fsPath := "mke2fs"
-	if e2fsSbin != "" {
-		mke2fsPath = filepath.Join(e2fsSbin, "mke2fs")
+	stamp := &buildStamp{}
+	if err := json.Unmarshal(content, stamp); err != nil {
+		return nil, err
 	}
-
-	mke2fsCmd := exec.Command(mke2fsPath,
-		"-t", "ext4",
-		"-E", "lazy_itable_init=0,lazy_journal_init=0",
-		"-d", cfg.Paths.RootfsDir,
-		cfg.Paths.DiskImage,
-		size,
-	)
-	mke2fsCmd.Stdout = os.Stdout
-	mke2fsCmd.Stderr = os.Stderr
-
-	if err := mke2fsCmd.Run(); err != nil {
-		return fmt.Errorf("mke2fs failed: %w", err)
-	}
-
-	printSuccess("Disk image created: %s", cfg.Paths.DiskImage)
-	return nil
-}
-
-func createInitScript(rootfsDir string) error {
-	initContent := `#!/bin/sh
-
-MARKER="/.rootfs-setup-complete"
-
-echo "Booting Debian root filesystem..."
-
-if [ ! -f "$MARKER" ]; then
-    echo "First boot detected – running debootstrap second stage..."
-    /debootstrap/debootstrap --second-stage
-    if [ $? -eq 0 ]; then
-        touch "$MARKER"
-        echo "Second stage completed successfully."
-    else
-        echo "Second stage failed – dropping to emergency shell."
-        exec /bin/sh
-    fi
-else
-    echo "Root filesystem already set up."
-fi
-
-# Mount essential virtual filesystems
-mount -t proc  proc  /proc
-mount -t sysfs sys   /sys
-mount -t devtmpfs dev /dev 2>/dev/null || mount -t tmpfs dev /dev
-[ -d /dev/pts ] || mkdir /dev/pts
-mount -t devpts devpts /dev/pts
-
-# Network configuration
-ip link set lo up
-ip link set eth0 up
-ip addr add 10.0.2.15/24 dev eth0
-ip route add default via 10.0.2.2
-echo "nameserver 8.8.8.8" > /etc/resolv.conf
-
-# Mount 9p share for modules
-mkdir -p /mnt/modules
-mount -t 9p -o trans=virtio,version=9p2000.L modules_mount /mnt/modules 2>/dev/null
-
-# Execute module sync script if present
-if [ -f /mnt/modules/guesync.sh ]; then
-    /mnt/modules/guesync.sh
-fi
-
-echo "System ready."
-exec /bin/sh
-`
-
-	initPath := fmt.Sprintf("%s/init", rootfsDir)
-	if err := os.WriteFile(initPath, []byte(initContent), 0755); err != nil {
-		return fmt.Errorf("failed to create init script: %w", err)
-	}
-
-	return nil
+	return stamp, nil
 }
 
 // Validate targets
@@ -0,0 +1,405 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var rootfsChrootCmd = &cobra.Command{
+	Use:   "chroot [command...]",
+	Short: "Run a command inside the rootfs directory (Linux)",
+	Long: `Run a command, or a shell, inside the rootfs directory without booting
+QEMU. Foreign architectures run through qemu-user:
+
+  - as root (or with sudo for a rootfs owned by root): chroot, with
+    qemu-<arch>-static registered in binfmt_misc (qemu-user-static)
+  - otherwise: proot -0 with qemu-<arch>-static; files created are owned
+    by you
+
+Changes go to the rootfs directory; 'elmos rootfs apply' rebuilds the disk
+image from it.
+
+Examples:
+  elmos rootfs chroot
+  elmos rootfs chroot -- apt-get install -y strace`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		return runRootfsChroot(args)
+	},
+}
+
+var rootfsFinalizeCmd = &cobra.Command{
+	Use:   "finalize",
+	Short: "Run the debootstrap second stage now instead of on first boot",
+	Long: `Complete a debootstrap rootfs by running 'debootstrap --second-stage' in a
+chroot (Linux), then regenerate /init without the first-boot step, re-apply
+the rootfs customization and rebuild the disk image.
+
+With --qemu, the second stage runs in the disk image instead, booted headless
+with the built kernel (any host, no chroot tools needed). The guest powers off
+when it is done; the serial console is saved in the state directory. The
+rootfs directory keeps the first stage, so rebuilding the image from it
+(rootfs apply, install without --in-place) undoes the finalization.
+
+Examples:
+  elmos rootfs finalize
+  elmos rootfs finalize --qemu --timeout 1h`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		if useQEMU, _ := cmd.Flags().GetBool("qemu"); useQEMU {
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			return runRootfsFinalizeQEMU(timeout)
+		}
+		size, _ := cmd.Flags().GetString("size")
+		return runRootfsFinalize(size)
+	},
+}
+
+func init() {
+	rootfsCmd.AddCommand(rootfsChrootCmd)
+	rootfsCmd.AddCommand(rootfsFinalizeCmd)
+	rootfsFinalizeCmd.Flags().StringP("size", "s", "", "Disk image size (default: size of the current image)")
+	rootfsFinalizeCmd.Flags().Bool("qemu", false, "Run the second stage in the disk image under QEMU")
+	rootfsFinalizeCmd.Flags().Duration("timeout", 30*time.Minute, "Time limit for the QEMU boot")
+}
+
+// qemuUserArchs maps build architectures to qemu-user binary suffixes
+var qemuUserArchs = map[string]string{
+	"arm64": "aarch64",
+	"riscv": "riscv64",
+	"arm":   "arm",
+}
+
+// hostArchs maps build architectures to the GOARCH of hosts that run
+// their binaries natively
+var hostArchs = map[string]string{
+	"arm64": "arm64",
+	"riscv": "riscv64",
+	"arm":   "arm",
+}
+
+// chrootScript enters the rootfs with the virtual filesystems mounted and
+// cleans up after the command, whatever its result. Arguments: rootfs,
+// interpreter to copy in (or ""), command.
+const chrootScript = `root=$1; interp=$2; shift 2
+cleanup() {
+    status=$?
+    for fs in dev/pts dev sys proc; do
+        umount -l "$root/$fs" 2>/dev/null
+    done
+    [ -n "$interp" ] && rm -f "$root$interp"
+    exit $status
+}
+trap cleanup EXIT
+set -e
+mkdir -p "$root/proc" "$root/sys" "$root/dev"
+mount -t proc proc "$root/proc"
+mount -t sysfs sys "$root/sys"
+mount --bind /dev "$root/dev"
+[ -d "$root/dev/pts" ] && mount --bind /dev/pts "$root/dev/pts"
+if [ -n "$interp" ]; then
+    mkdir -p "$root$(dirname "$interp")"
+    cp "$interp" "$root$interp"
+fi
+if [ -d "$root/etc" ] && [ -f /etc/resolv.conf ]; then
+    rm -f "$root/etc/resolv.conf"
+    cp /etc/resolv.conf "$root/etc/resolv.conf"
+fi
+set +e
+chroot "$root" "$@"
+`
+
+func runRootfsChroot(args []string) error {
+	dir := ctx.Config.RootfsDir()
+	if _, err := os.Stat(filepath.Join(dir, "etc")); err != nil {
+		return fmt.Errorf("rootfs not found: %s (run 'elmos rootfs create')", dir)
+	}
+
+	if len(args) == 0 {
+		shell := "/bin/sh"
+		if _, err := os.Lstat(filepath.Join(dir, "bin", "bash")); err == nil {
+			shell = "/bin/bash"
+		}
+		args = []string{shell, "-l"}
+	}
+
+	cmd, err := chrootCommand(dir, args...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("command exited with status %d", exitErr.ExitCode())
+		}
+		return err
+	}
+	return nil
+}
+
+// chrootCommand returns a command that runs args inside the rootfs
+// directory, emulating a foreign architecture with qemu-user
+func chrootCommand(dir string, args ...string) (*exec.Cmd, error) {
+	cfg := ctx.Config
+
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("entering the rootfs needs a Linux host (on macOS, use 'elmos rootfs finalize --qemu' or let the second stage run on first boot)")
+	}
+	qarch, ok := qemuUserArchs[cfg.Build.Arch]
+	if !ok {
+		return nil, fmt.Errorf("unsupported architecture for chroot: %s", cfg.Build.Arch)
+	}
+	native := hostArchs[cfg.Build.Arch] == runtime.GOARCH
+	env := []string{
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"HOME=/root",
+		"TERM=" + valueOr(os.Getenv("TERM"), "linux"),
+		"LC_ALL=C",
+	}
+
+	// chroot needs root: ours, or sudo's for a tree owned by root
+	privileged := os.Getuid() == 0
+	if !privileged {
+		if info, err := os.Stat(filepath.Join(dir, "etc")); err == nil {
+			if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Uid == 0 {
+				privileged = true
+			}
+		}
+	}
+
+	if privileged {
+		interp := ""
+		if !native {
+			var err error
+			if interp, err = binfmtInterpreter(qarch); err != nil {
+				return nil, err
+			}
+		}
+		shArgs := append([]string{"sh", "-c", chrootScript, "sh", dir, interp}, args...)
+		if os.Getuid() == 0 {
+			cmd := exec.Command(shArgs[0], shArgs[1:]...)
+			cmd.Env = env
+			return cmd, nil
+		}
+		// sudo resets the environment; env -i sets the guest's
+		sudoArgs := append(append([]string{"env", "-i"}, env...), shArgs...)
+		return exec.Command("sudo", sudoArgs...), nil
+	}
+
+	prootPath, err := exec.LookPath("proot")
+	if err != nil {
+		return nil, fmt.Errorf("proot not found (install proot, or run as root for chroot)")
+	}
+	prootArgs := []string{"-0", "-r", dir, "-b", "/dev", "-b", "/proc", "-b", "/sys", "-b", "/etc/resolv.conf", "-w", "/root"}
+	if !native {
+		qemuUser, err := findQemuUser(qarch)
+		if err != nil {
+			return nil, err
+		}
+		prootArgs = append(prootArgs, "-q", qemuUser)
+	}
+	cmd := exec.Command(prootPath, append(prootArgs, args...)...)
+	cmd.Env = env
+	return cmd, nil
+}
+
+// findQemuUser returns the qemu-user emulator for a qemu architecture
+func findQemuUser(qarch string) (string, error) {
+	for _, name := range []string{"qemu-" + qarch + "-static", "qemu-" + qarch} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("qemu-%s-static not found (install qemu-user-static)", qarch)
+}
+
+// binfmtInterpreter returns the emulator binfmt_misc runs for qarch
+// binaries. The chroot needs a copy of it unless the kernel opened it at
+// registration (flag F); "" means no copy is needed.
+func binfmtInterpreter(qarch string) (string, error) {
+	entry := "/proc/sys/fs/binfmt_misc/qemu-" + qarch
+	data, err := os.ReadFile(entry)
+	if err != nil {
+		return "", fmt.Errorf("no binfmt_misc handler for %s binaries (install qemu-user-static, or use proot as a regular user)", qarch)
+	}
+
+	interp, flags := "", ""
+	for i, line := range strings.Split(string(data), "\n") {
+		if i == 0 && line != "enabled" {
+			return "", fmt.Errorf("binfmt_misc handler %s is disabled", entry)
+		}
+		if value, ok := strings.CutPrefix(line, "interpreter "); ok {
+			interp = value
+		}
+		if value, ok := strings.CutPrefix(line, "flags: "); ok {
+			flags = value
+		}
+	}
+	if strings.Contains(flags, "F") {
+		return "", nil
+	}
+	if _, err := os.Stat(interp); err != nil {
+		return "", fmt.Errorf("binfmt_misc interpreter not found: %s", interp)
+	}
+	return interp, nil
+}
+
+func runRootfsFinalize(size string) error {
+	cfg := ctx.Config
+	dir := cfg.RootfsDir()
+
+	if !needsSecondStage(dir) {
+		return fmt.Errorf("%s has no pending debootstrap second stage", dir)
+	}
+
+	printStep("Running debootstrap second stage in %s...", dir)
+	cmd, err := chrootCommand(dir, "/debootstrap/debootstrap", "--second-stage")
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("second stage failed: %w (see %s)", err, filepath.Join(dir, "debootstrap", "debootstrap.log"))
+	}
+	printSuccess("Second stage completed")
+
+	return finishRootfs(size)
+}
+
+// finishRootfs rebuilds a rootfs whose second stage has completed: /init
+// without the first-boot step, the customization (the second stage may have
+// replaced configuration files) and the disk image
+func finishRootfs(size string) error {
+	cfg := ctx.Config
+	dir := cfg.RootfsDir()
+
+	if err := createInitScript(dir, false); err != nil {
+		return err
+	}
+	if err := applyRootfsCustomization(dir); err != nil {
+		return err
+	}
+
+	if size == "" {
+		size = "5G"
+		if info, err := os.Stat(cfg.DiskImage()); err == nil {
+			size = fmt.Sprintf("%dk", info.Size()/1024)
+		}
+	}
+	if err := buildDiskImage(size); err != nil {
+		return err
+	}
+	printSuccess("Rootfs finalized: %s", cfg.DiskImage())
+	return nil
+}
+
+// finalizeTailLines is how much of the console log a failed finalize prints
+const finalizeTailLines = 20
+
+// runRootfsFinalizeQEMU runs the second stage in the disk image: /init is
+// swapped for one that powers off after it, and restored afterwards
+func runRootfsFinalizeQEMU(timeout time.Duration) error {
+	cfg := ctx.Config
+
+	diskImage, err := diskImageForEdit()
+	if err != nil {
+		return err
+	}
+	if err := checkImageIdle(diskImage); err != nil {
+		return err
+	}
+	if pending, err := imageNeedsSecondStage(diskImage); err != nil {
+		return err
+	} else if !pending {
+		return fmt.Errorf("%s has no pending debootstrap second stage", diskImage)
+	}
+	if _, err := os.Stat(ctx.GetKernelImage()); err != nil {
+		return fmt.Errorf("kernel image not found: %s (run 'elmos build')", ctx.GetKernelImage())
+	}
+
+	finalizeInit, err := initScript(initOptions{SecondStage: true, Finalize: true})
+	if err != nil {
+		return err
+	}
+	if err := writeImageFile(diskImage, "/init", []byte(finalizeInit), 0755); err != nil {
+		return err
+	}
+
+	logPath := filepath.Join(cfg.StateDir(), "finalize-"+cfg.RootfsKey()+".log")
+	printStep("Running debootstrap second stage in %s under QEMU (console: %s)...", diskImage, logPath)
+	boot, err := runHeadlessBoot(headlessBoot{
+		Disk:     diskImage,
+		Success:  []string{"Second stage completed successfully"},
+		Failure:  append([]string{"Second stage failed"}, bootPanicMarkers...),
+		Timeout:  timeout,
+		LogPath:  logPath,
+		Shutdown: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The finished image boots straight into the system; otherwise the
+	// second stage runs again on the next boot
+	finished := boot.Outcome == bootSucceeded
+	script, err := initScript(initOptions{SecondStage: !finished})
+	if err != nil {
+		return err
+	}
+	if err := writeImageFile(diskImage, "/init", []byte(script), 0755); err != nil {
+		printWarn("Failed to restore /init in %s: %v", diskImage, err)
+	}
+
+	switch boot.Outcome {
+	case bootSucceeded:
+		printSuccess("Rootfs finalized: %s (console: %s)", diskImage, logPath)
+		if needsSecondStage(cfg.RootfsDir()) {
+			printInfo("%s still holds the first stage; use 'rootfs install --in-place' and 'rootfs cp' to keep the finalized image", cfg.RootfsDir())
+		}
+		return nil
+	case bootTimedOut:
+		printError("Second stage did not finish within %s: %s", timeout, valueOr(boot.Line, "no result on the console"))
+	default:
+		printError("Second stage failed: %s", valueOr(boot.Line, "QEMU exited before the second stage completed"))
+	}
+	printLogTail(logPath, finalizeTailLines)
+	return fmt.Errorf("finalize failed (console: %s); 'elmos rootfs apply' rebuilds the image from %s", logPath, cfg.RootfsDir())
+}
+
+// imageNeedsSecondStage reports whether the disk image holds an unfinished
+// debootstrap --foreign installation
+func imageNeedsSecondStage(diskImage string) (bool, error) {
+	entry, err := statImage(diskImage, "/debootstrap/debootstrap")
+	return entry != nil, err
+}
+
+// printLogTail prints the last lines of a log file
+func printLogTail(path string, n int) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	for _, line := range lines {
+		fmt.Println("  " + line)
+	}
+}
@@ -3,14 +3,19 @@ package cmd
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"github.com/NguyenTrongPhuc552003/elmos/internal/core"
+	"github.com/NguyenTrongPhuc552003/elmos/internal/image"
 )
 
 // configCmd - configuration management
@@ -34,10 +39,13 @@ func RunConfigShow() error {
 	fmt.Println("Current Configuration:")
 	fmt.Println()
 	fmt.Println("Image:")
-	fmt.Printf("  Path:        %s\n", cfg.Image.Path)
-	fmt.Printf("  Volume Name: %s\n", cfg.Image.VolumeName)
-	fmt.Printf("  Size:        %s\n", cfg.Image.Size)
-	fmt.Printf("  Mount Point: %s\n", cfg.Image.MountPoint)
+	fmt.Printf("  Path:         %s\n", cfg.Image.Path)
+	fmt.Printf("  Volume Name:  %s\n", cfg.Image.VolumeName)
+	fmt.Printf("  Size:         %s\n", cfg.Image.Size)
+	fmt.Printf("  Mount Point:  %s\n", cfg.Image.MountPoint)
+	fmt.Printf("  Min Free:     %s\n", cfg.Image.MinFree)
+	fmt.Printf("  Auto Mount:   %t\n", cfg.Image.AutoMount)
+	fmt.Printf("  Idle Unmount: %s\n", valueOr(cfg.Image.IdleUnmount, "never"))
 	fmt.Println()
 	fmt.Println("Build:")
 	fmt.Printf("  Architecture:  %s\n", cfg.Build.Arch)
@@ -57,6 +65,63 @@ func RunConfigShow() error {
 	fmt.Printf("  Apps Dir:      %s\n", cfg.Paths.AppsDir)
 	fmt.Printf("  Libraries Dir: %s\n", cfg.Paths.LibrariesDir)
 	fmt.Printf("  Patches Dir:   %s\n", cfg.Paths.PatchesDir)
+	fmt.Printf("  Rootfs Dir:    %s\n", cfg.RootfsDir())
+	fmt.Printf("  Disk Image:    %s\n", cfg.DiskImage())
+	fmt.Println()
+	fmt.Println("Repo:")
+	fmt.Printf("  URL:    %s\n", cfg.Repo.URL)
+	fmt.Printf("  Branch: %s\n", cfg.Repo.Branch)
+	for name, url := range cfg.Repo.Remotes {
+		fmt.Printf("  Remote: %s = %s\n", name, url)
+	}
+	fmt.Println()
+	fmt.Println("Tree:")
+	active := cfg.Tree.Active
+	if active == "" {
+		active = core.MainTreeName
+	}
+	fmt.Printf("  Active:    %s (%s)\n", active, ctx.KernelDir)
+	fmt.Printf("  Trees Dir: %s\n", cfg.Tree.Dir)
+	fmt.Println()
+	fmt.Println("Patches:")
+	fmt.Printf("  Auto Apply: %t\n", cfg.Patches.AutoApply)
+	fmt.Println()
+	fmt.Println("Rootfs:")
+	fmt.Printf("  Provider: %s\n", cfg.Rootfs.Provider)
+	fmt.Printf("  BusyBox:  %s\n", valueOr(cfg.Rootfs.BusyBox, "-"))
+	fmt.Printf("  Tarball:  %s\n", valueOr(cfg.Rootfs.Tarball, "-"))
+	fmt.Printf("  Overlay:  %s\n", valueOr(cfg.Rootfs.Overlay, "-"))
+	fmt.Printf("  Packages: %s\n", valueOr(strings.Join(cfg.Rootfs.Packages, ", "), "-"))
+	fmt.Printf("  Hostname: %s\n", valueOr(cfg.Rootfs.Hostname, "-"))
+	fmt.Printf("  Password: %t\n", cfg.Rootfs.RootPassword != "")
+	fmt.Printf("  SSH Keys: %s\n", valueOr(cfg.Rootfs.AuthorizedKeys, "-"))
+	fmt.Printf("  Suite:    %s (variant %s; %s)\n", cfg.Rootfs.Suite, valueOr(cfg.Rootfs.Variant, "default"),
+		valueOr(strings.Join(cfg.Rootfs.Components, ", "), "main"))
+	fmt.Printf("  Keyring:  %s\n", valueOr(cfg.Rootfs.Keyring, "- (signatures not checked)"))
+	fmt.Printf("  Cache:    %s\n", cfg.Rootfs.CacheDir)
+	for _, entry := range cfg.Rootfs.Fstab {
+		fmt.Printf("  Fstab:    %s\n", entry)
+	}
+	fmt.Println()
+	fmt.Println("Initramfs:")
+	fmt.Printf("  Output:      %s\n", initramfsPath(cfg))
+	fmt.Printf("  Tree:        %s\n", valueOr(cfg.Initramfs.Tree, "-"))
+	fmt.Printf("  Compression: %s\n", cfg.Initramfs.Compression)
+	fmt.Println()
+	fmt.Println("Guest:")
+	fmt.Printf("  Hostname: %s\n", valueOr(cfg.Guest.Hostname, "-"))
+	fmt.Printf("  Network:  %s\n", cfg.Guest.Network)
+	if cfg.Guest.Network == "static" {
+		fmt.Printf("  Address:  %s via %s\n", cfg.Guest.Address, cfg.Guest.Gateway)
+	}
+	fmt.Printf("  DNS:      %s\n", valueOr(strings.Join(cfg.Guest.DNS, ", "), "-"))
+	for _, m := range cfg.Guest.Mounts {
+		fmt.Printf("  Mount:    %s on %s (%s)\n", m.Tag, m.Path, valueOr(m.Type, "9p"))
+	}
+	for _, hook := range cfg.Guest.Hooks {
+		fmt.Printf("  Hook:     %s\n", hook)
+	}
+	fmt.Printf("  Poweroff: %t\n", cfg.Guest.Poweroff)
 	return nil
 }
 
@@ -68,7 +133,39 @@ var configSetCmd = &cobra.Command{
   jobs          - Number of parallel build jobs
   memory        - QEMU memory size (e.g., 2G, 4G)
   volume_name   - Disk image volume name
-  image_size    - Disk image size (e.g., 20G)`,
+  image_size    - Disk image size (e.g., 20G)
+  min_free      - Warn when the volume has less free space (e.g., 5G)
+  auto_mount    - Mount the image when a command needs it (true, false)
+  idle_unmount  - Unmount an auto-mounted image after this idle time (e.g., 30m, "" to disable)
+  repo_url      - Kernel repository URL (https://, git://, file:// or a path)
+  repo_branch   - Upstream branch for update/reset/checkout (e.g., master)
+  auto_apply    - Apply the patch series after clone/update/reset (true, false)
+  rootfs_provider - Rootfs provider for rootfs create (debootstrap, busybox, tarball)
+  rootfs_busybox  - Static busybox binary for the busybox provider
+  rootfs_tarball  - Rootfs archive for the tarball provider
+  rootfs_overlay  - Directory copied on top of the rootfs
+  rootfs_packages - Comma-separated extra Debian packages
+  rootfs_hostname - Hostname written to /etc/hostname
+  rootfs_password - Root password (plain or a "$6$..." hash)
+  rootfs_authorized_keys - Public key file installed for root
+  rootfs_suite      - Debian suite for debootstrap (e.g., stable, bookworm)
+  rootfs_variant    - Debootstrap variant (minbase, buildd, "" for the default)
+  rootfs_components - Comma-separated archive components (e.g., main,contrib)
+  rootfs_keyring    - GPG keyring verifying the archive ("" disables the check)
+  rootfs_cache_dir  - Directory of debootstrap package tarballs
+  rootfs_per_profile - Separate rootfs and disk image per profile (true, false)
+  initramfs_tree        - Directory copied into the initramfs
+  initramfs_compression - Initramfs compression (gzip, zstd, none)
+  guest_hostname - Guest hostname set by /init
+  guest_network  - Guest networking (static, dhcp, none)
+  guest_address  - Static guest address in CIDR form (e.g., 10.0.2.15/24)
+  guest_gateway  - Static guest default gateway
+  guest_dns      - Comma-separated guest name servers
+  guest_poweroff - Power off after the startup hooks (true, false)
+
+Guest mounts, startup hooks and fstab entries are set in elmos.yaml (guest.mounts,
+guest.hooks, rootfs.fstab). Run 'elmos rootfs init regen' after changing guest
+settings and 'elmos rootfs apply' after changing rootfs settings.`,
 	Args: cobra.ExactArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		key := args[0]
@@ -112,7 +209,8 @@ func init() {
 }
 
 func runConfigSet(key, value string) error {
-	cfg := ctx.Config
+	// Change the file's values, not those of an applied --profile
+	cfg := ctx.Config.Unprofiled()
 
 	switch key {
 	case "arch":
@@ -132,6 +230,112 @@ func runConfigSet(key, value string) error {
 		cfg.Image.VolumeName = value
 	case "image_size":
 		cfg.Image.Size = value
+	case "min_free":
+		if _, err := image.ParseSize(value); err != nil {
+			return err
+		}
+		cfg.Image.MinFree = value
+	case "auto_mount":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid auto_mount value: %s", value)
+		}
+		cfg.Image.AutoMount = enabled
+	case "idle_unmount":
+		if value != "" {
+			if _, err := time.ParseDuration(value); err != nil {
+				return fmt.Errorf("invalid idle_unmount value: %s", value)
+			}
+		}
+		cfg.Image.IdleUnmount = value
+	case "repo_url":
+		cfg.Repo.URL = value
+	case "repo_branch":
+		cfg.Repo.Branch = value
+	case "auto_apply":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid auto_apply value: %s", value)
+		}
+		cfg.Patches.AutoApply = enabled
+	case "rootfs_provider":
+		if _, ok := rootfsProviders[value]; !ok {
+			return fmt.Errorf("invalid rootfs provider: %s (valid: %s)", value, strings.Join(rootfsProviderNames(), ", "))
+		}
+		cfg.Rootfs.Provider = value
+	case "rootfs_busybox":
+		cfg.Rootfs.BusyBox = value
+	case "rootfs_tarball":
+		cfg.Rootfs.Tarball = value
+	case "rootfs_overlay":
+		cfg.Rootfs.Overlay = value
+	case "rootfs_packages":
+		cfg.Rootfs.Packages = splitList(value)
+	case "rootfs_hostname":
+		cfg.Rootfs.Hostname = value
+	case "rootfs_password":
+		cfg.Rootfs.RootPassword = value
+	case "rootfs_authorized_keys":
+		cfg.Rootfs.AuthorizedKeys = value
+	case "rootfs_suite":
+		cfg.Rootfs.Suite = value
+	case "rootfs_variant":
+		switch value {
+		case "", "minbase", "buildd", "fakechroot":
+		default:
+			return fmt.Errorf("invalid rootfs variant: %s (valid: minbase, buildd, fakechroot or empty)", value)
+		}
+		cfg.Rootfs.Variant = value
+	case "rootfs_components":
+		cfg.Rootfs.Components = splitList(value)
+	case "rootfs_keyring":
+		cfg.Rootfs.Keyring = value
+	case "rootfs_cache_dir":
+		cfg.Rootfs.CacheDir = value
+	case "rootfs_per_profile":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid rootfs_per_profile value: %s", value)
+		}
+		cfg.Rootfs.PerProfile = enabled
+	case "initramfs_tree":
+		cfg.Initramfs.Tree = value
+	case "initramfs_compression":
+		if _, ok := initramfsExtensions[value]; !ok {
+			return fmt.Errorf("invalid initramfs compression: %s (valid: gzip, zstd, none)", value)
+		}
+		cfg.Initramfs.Compression = value
+	case "guest_hostname":
+		cfg.Guest.Hostname = value
+	case "guest_network":
+		if value != "static" && value != "dhcp" && value != "none" {
+			return fmt.Errorf("invalid guest network: %s (valid: static, dhcp, none)", value)
+		}
+		cfg.Guest.Network = value
+	case "guest_address":
+		if _, _, err := net.ParseCIDR(value); err != nil {
+			return fmt.Errorf("invalid guest address: %s (use CIDR form, e.g. 10.0.2.15/24)", value)
+		}
+		cfg.Guest.Address = value
+	case "guest_gateway":
+		if net.ParseIP(value) == nil {
+			return fmt.Errorf("invalid guest gateway: %s", value)
+		}
+		cfg.Guest.Gateway = value
+	case "guest_dns":
+		servers := splitList(value)
+		for _, server := range servers {
+			if net.ParseIP(server) == nil {
+				return fmt.Errorf("invalid guest DNS server: %s", server)
+			}
+		}
+		cfg.Guest.DNS = servers
+	case "guest_poweroff":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid guest_poweroff value: %s", value)
+		}
+		cfg.Guest.Poweroff = enabled
 	default:
 		return fmt.Errorf("unknown configuration key: %s", key)
 	}
@@ -161,6 +365,60 @@ func runConfigGet(key string) error {
 		value = cfg.Image.VolumeName
 	case "image_size":
 		value = cfg.Image.Size
+	case "min_free":
+		value = cfg.Image.MinFree
+	case "auto_mount":
+		value = cfg.Image.AutoMount
+	case "idle_unmount":
+		value = cfg.Image.IdleUnmount
+	case "repo_url":
+		value = cfg.Repo.URL
+	case "repo_branch":
+		value = cfg.Repo.Branch
+	case "auto_apply":
+		value = cfg.Patches.AutoApply
+	case "rootfs_provider":
+		value = cfg.Rootfs.Provider
+	case "rootfs_busybox":
+		value = cfg.Rootfs.BusyBox
+	case "rootfs_tarball":
+		value = cfg.Rootfs.Tarball
+	case "rootfs_overlay":
+		value = cfg.Rootfs.Overlay
+	case "rootfs_packages":
+		value = strings.Join(cfg.Rootfs.Packages, ",")
+	case "rootfs_hostname":
+		value = cfg.Rootfs.Hostname
+	case "rootfs_authorized_keys":
+		value = cfg.Rootfs.AuthorizedKeys
+	case "rootfs_suite":
+		value = cfg.Rootfs.Suite
+	case "rootfs_variant":
+		value = cfg.Rootfs.Variant
+	case "rootfs_components":
+		value = strings.Join(cfg.Rootfs.Components, ",")
+	case "rootfs_keyring":
+		value = cfg.Rootfs.Keyring
+	case "rootfs_cache_dir":
+		value = cfg.Rootfs.CacheDir
+	case "rootfs_per_profile":
+		value = cfg.Rootfs.PerProfile
+	case "initramfs_tree":
+		value = cfg.Initramfs.Tree
+	case "initramfs_compression":
+		value = cfg.Initramfs.Compression
+	case "guest_hostname":
+		value = cfg.Guest.Hostname
+	case "guest_network":
+		value = cfg.Guest.Network
+	case "guest_address":
+		value = cfg.Guest.Address
+	case "guest_gateway":
+		value = cfg.Guest.Gateway
+	case "guest_dns":
+		value = strings.Join(cfg.Guest.DNS, ",")
+	case "guest_poweroff":
+		value = cfg.Guest.Poweroff
 	case "kernel_dir":
 		value = cfg.Paths.KernelDir
 	case "modules_dir":
@@ -192,6 +450,8 @@ func runConfigInit() error {
 	// Set values from current config
 	v.Set("image.volume_name", cfg.Image.VolumeName)
 	v.Set("image.size", cfg.Image.Size)
+	v.Set("image.min_free", cfg.Image.MinFree)
+	v.Set("image.auto_mount", cfg.Image.AutoMount)
 	v.Set("build.arch", cfg.Build.Arch)
 	v.Set("build.jobs", cfg.Build.Jobs)
 	v.Set("build.llvm", cfg.Build.LLVM)
@@ -199,6 +459,14 @@ func runConfigInit() error {
 	v.Set("qemu.memory", cfg.QEMU.Memory)
 	v.Set("qemu.gdb_port", cfg.QEMU.GDBPort)
 	v.Set("paths.debian_mirror", cfg.Paths.DebianMirror)
+	v.Set("repo.url", cfg.Repo.URL)
+	v.Set("repo.branch", cfg.Repo.Branch)
+	v.Set("patches.auto_apply", cfg.Patches.AutoApply)
+	v.Set("rootfs.provider", cfg.Rootfs.Provider)
+	v.Set("initramfs.compression", cfg.Initramfs.Compression)
+	v.Set("guest.network", cfg.Guest.Network)
+	v.Set("guest.address", cfg.Guest.Address)
+	v.Set("guest.gateway", cfg.Guest.Gateway)
 
 	// Add example profiles
 	v.Set("profiles.riscv-dev.arch", "riscv")
@@ -221,9 +489,23 @@ func runConfigProfile(name string) error {
 
 	printSuccess("Applied profile: %s", name)
 	printInfo("Architecture: %s", ctx.Config.Build.Arch)
+	if ctx.Config.Tree.Active != "" {
+		printInfo("Kernel tree: %s", ctx.Config.Tree.Active)
+	}
 	return nil
 }
 
+// splitList splits a comma-separated value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func isValidArch(arch string) bool {
 	valid := []string{"arm64", "riscv", "arm", "x86_64", "x86"}
 	return slices.Contains(valid, arch)
@@ -0,0 +1,286 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/NguyenTrongPhuc552003/elmos/internal/image"
+)
+
+// imagePrefix marks a path inside the disk image in rootfs cp
+const imagePrefix = "image:"
+
+var rootfsCpCmd = &cobra.Command{
+	Use:   "cp <src> <dst>",
+	Short: "Copy files into or out of the disk image",
+	Long: `Copy files and directories between the host and the disk image without
+booting the guest. Prefix the path inside the image with "image:".
+
+Like cp, copying to an existing directory puts the source inside it.
+Directories are copied recursively. Files written into the image belong to
+root. The image must not be in use by QEMU while writing; changes are lost
+when the image is rebuilt from the rootfs directory (rootfs apply, install).
+
+Examples:
+  elmos rootfs cp image:/var/log/syslog .
+  elmos rootfs cp ./sshd_config image:/etc/ssh/
+  elmos rootfs cp ./scripts image:/root/scripts`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		return runRootfsCp(args[0], args[1])
+	},
+}
+
+var rootfsLsCmd = &cobra.Command{
+	Use:   "ls [path]",
+	Short: "List a directory in the disk image",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		guestPath := "/"
+		if len(args) > 0 {
+			guestPath = strings.TrimPrefix(args[0], imagePrefix)
+		}
+		return runRootfsLs(guestPath)
+	},
+}
+
+func init() {
+	rootfsCmd.AddCommand(rootfsCpCmd)
+	rootfsCmd.AddCommand(rootfsLsCmd)
+}
+
+// diskImageForEdit returns the disk image, checking that it exists
+func diskImageForEdit() (string, error) {
+	diskImage := ctx.Config.DiskImage()
+	if _, err := os.Stat(diskImage); err != nil {
+		return "", fmt.Errorf("disk image not found: %s (run 'elmos rootfs create')", diskImage)
+	}
+	return diskImage, nil
+}
+
+func runRootfsCp(src, dst string) error {
+	srcInImage := strings.HasPrefix(src, imagePrefix)
+	dstInImage := strings.HasPrefix(dst, imagePrefix)
+	if srcInImage == dstInImage {
+		return fmt.Errorf("exactly one of source and destination must be in the image (prefix it with %q)", imagePrefix)
+	}
+
+	diskImage, err := diskImageForEdit()
+	if err != nil {
+		return err
+	}
+
+	if dstInImage {
+		return copyIntoImage(diskImage, src, strings.TrimPrefix(dst, imagePrefix))
+	}
+	return copyFromImage(diskImage, strings.TrimPrefix(src, imagePrefix), dst)
+}
+
+// copyIntoImage copies a host file or directory into the disk image
+func copyIntoImage(diskImage, src, dst string) error {
+	if err := checkImageIdle(diskImage); err != nil {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if dst == "" {
+		dst = "/"
+	}
+	resolved, entry, err := resolveImagePath(diskImage, dst)
+	if err != nil {
+		return err
+	}
+	if entry != nil && entry.Type == "directory" {
+		resolved = path.Join(resolved, filepath.Base(src))
+	} else if entry != nil && info.IsDir() {
+		return fmt.Errorf("cannot overwrite %s with directory %s", dst, src)
+	}
+
+	printStep("Copying %s to %s:%s...", src, filepath.Base(diskImage), resolved)
+	if err := writeImageTree(diskImage, src, resolved); err != nil {
+		return err
+	}
+	printSuccess("Copied %s", src)
+	return nil
+}
+
+// copyFromImage copies a file or directory out of the disk image
+func copyFromImage(diskImage, src, dst string) error {
+	if image.Busy(diskImage) {
+		printWarn("%s is in use; a running guest may not have written everything yet", diskImage)
+	}
+
+	resolved, entry, err := resolveImagePath(diskImage, src)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("%s not found in %s", src, diskImage)
+	}
+
+	target := dst
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		target = filepath.Join(dst, path.Base(resolved))
+	}
+	quoted, err := debugfsQuote(resolved)
+	if err != nil {
+		return err
+	}
+
+	switch entry.Type {
+	case "directory":
+		if _, err := os.Lstat(target); err == nil {
+			return fmt.Errorf("%s already exists", target)
+		}
+		// rdump names the copy after the source; dump next to the target
+		// and rename
+		tmp, err := os.MkdirTemp(filepath.Dir(target), ".elmos-cp-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		tmpQuoted, err := debugfsQuote(tmp)
+		if err != nil {
+			return err
+		}
+		out, err := runDebugfs(diskImage, false, "rdump "+quoted+" "+tmpQuoted)
+		if err != nil {
+			return err
+		}
+		if err := checkDumpOutput(out); err != nil {
+			return err
+		}
+		dumped := filepath.Join(tmp, path.Base(resolved))
+		if resolved == "/" {
+			// The root directory is dumped as its contents
+			dumped = tmp
+		}
+		if err := os.Rename(dumped, target); err != nil {
+			return err
+		}
+	case "regular":
+		targetQuoted, err := debugfsQuote(target)
+		if err != nil {
+			return err
+		}
+		out, err := runDebugfs(diskImage, false, "dump "+quoted+" "+targetQuoted)
+		if err != nil {
+			return err
+		}
+		if err := checkDumpOutput(out); err != nil {
+			return err
+		}
+		if err := os.Chmod(target, entry.Mode); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot copy %s: %s", src, entry.Type)
+	}
+
+	printSuccess("Copied %s:%s to %s", filepath.Base(diskImage), resolved, target)
+	return nil
+}
+
+// checkDumpOutput checks debugfs dump and rdump output. Restoring the
+// owner fails without root, which is expected: the copy belongs to the user.
+func checkDumpOutput(out string) error {
+	var kept []string
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.Contains(line, "while changing ownership") {
+			kept = append(kept, line)
+		}
+	}
+	return checkDebugfsOutput(strings.Join(kept, "\n"))
+}
+
+func runRootfsLs(guestPath string) error {
+	diskImage, err := diskImageForEdit()
+	if err != nil {
+		return err
+	}
+
+	resolved, entry, err := resolveImagePath(diskImage, guestPath)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("%s not found in %s", guestPath, diskImage)
+	}
+
+	// A file is listed as its line in the parent directory
+	dir, name := resolved, ""
+	if entry.Type != "directory" {
+		dir, name = path.Dir(resolved), path.Base(resolved)
+	}
+	quoted, err := debugfsQuote(dir)
+	if err != nil {
+		return err
+	}
+	out, err := runDebugfs(diskImage, false, "ls -l "+quoted)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		// inode mode (links) uid gid size date time name
+		fields := strings.Fields(line)
+		if len(fields) < 9 || fields[0] == "debugfs:" {
+			continue
+		}
+		mode, err := strconv.ParseUint(fields[1], 8, 32)
+		if err != nil {
+			continue
+		}
+		entryName := strings.Join(fields[8:], " ")
+		if name != "" && entryName != name {
+			continue
+		}
+		fmt.Printf("%s %5s %5s %10s %s %s %s\n", ext4Mode(uint32(mode)), fields[3], fields[4], fields[5], fields[6], fields[7], entryName)
+	}
+	return nil
+}
+
+// ext4Mode converts an ext4 inode mode to its ls form
+func ext4Mode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	switch mode & 0170000 {
+	case 0040000:
+		m |= os.ModeDir
+	case 0120000:
+		m |= os.ModeSymlink
+	case 0020000:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case 0060000:
+		m |= os.ModeDevice
+	case 0010000:
+		m |= os.ModeNamedPipe
+	case 0140000:
+		m |= os.ModeSocket
+	}
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
@@ -0,0 +1,186 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/NguyenTrongPhuc552003/elmos/internal/crypt"
+)
+
+var rootfsApplyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Re-apply rootfs customization and rebuild the disk image",
+	Long: `Apply the rootfs: customization (hostname, fstab, root password,
+authorized_keys, overlay directory) to the existing rootfs directory and
+rebuild the disk image from it.
+
+Extra packages (rootfs.packages) are installed by debootstrap and only take
+effect with 'elmos rootfs create'. Rebuilding the image discards changes made
+inside the guest.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		size, _ := cmd.Flags().GetString("size")
+		force, _ := cmd.Flags().GetBool("force")
+		return runRootfsApply(size, force)
+	},
+}
+
+func init() {
+	rootfsCmd.AddCommand(rootfsApplyCmd)
+	rootfsApplyCmd.Flags().StringP("size", "s", "", "Disk image size (default: size of the current image)")
+	rootfsApplyCmd.Flags().BoolP("force", "f", false, "Do not ask for confirmation")
+}
+
+func runRootfsApply(size string, force bool) error {
+	cfg := ctx.Config
+
+	if _, err := os.Stat(filepath.Join(cfg.RootfsDir(), "etc")); err != nil {
+		return fmt.Errorf("rootfs not found: %s (run 'elmos rootfs create')", cfg.RootfsDir())
+	}
+
+	if info, err := os.Stat(cfg.DiskImage()); err == nil {
+		if size == "" {
+			size = fmt.Sprintf("%dk", info.Size()/1024)
+		}
+		printWarn("This rebuilds %s from %s; changes made inside the guest are lost", cfg.DiskImage(), cfg.RootfsDir())
+		if needsSecondStage(cfg.RootfsDir()) {
+			printInfo("The debootstrap second stage will run again on the next boot")
+		}
+		if !force && !confirm("Rebuild disk image?") {
+			return fmt.Errorf("apply cancelled (use --force to skip this prompt)")
+		}
+	}
+	if size == "" {
+		size = "5G"
+	}
+
+	if len(cfg.Rootfs.Packages) > 0 {
+		printInfo("rootfs.packages are installed by 'elmos rootfs create' only")
+	}
+
+	if err := applyRootfsCustomization(cfg.RootfsDir()); err != nil {
+		return err
+	}
+
+	if err := buildDiskImage(size); err != nil {
+		return err
+	}
+
+	printSuccess("Disk image rebuilt: %s", cfg.DiskImage())
+	return nil
+}
+
+// applyRootfsCustomization applies the rootfs: settings to a populated
+// rootfs directory. The changes run as one shell script with the privileges
+// the tree needs; the overlay is copied last so its files win.
+func applyRootfsCustomization(dir string) error {
+	rc := ctx.Config.Rootfs
+
+	var steps, args []string
+	// arg passes a value to the script as a positional parameter
+	arg := func(value string) string {
+		args = append(args, value)
+		return fmt.Sprintf(`"${%d}"`, len(args))
+	}
+	root := arg(dir)
+
+	if rc.Hostname != "" {
+		printStep("Setting hostname %s...", rc.Hostname)
+		name := arg(rc.Hostname)
+		steps = append(steps,
+			fmt.Sprintf(`echo %s > %s/etc/hostname`, name, root),
+			fmt.Sprintf(`grep -qw %s %s/etc/hosts 2>/dev/null || echo "127.0.1.1 "%s >> %s/etc/hosts`, name, root, name, root),
+		)
+	}
+
+	if len(rc.Fstab) > 0 {
+		printStep("Writing /etc/fstab (%d entries)...", len(rc.Fstab))
+		content := "# Generated by elmos from rootfs.fstab\n" + strings.Join(rc.Fstab, "\n") + "\n"
+		steps = append(steps, fmt.Sprintf(`printf '%%s' %s > %s/etc/fstab`, arg(content), root))
+	}
+
+	if rc.RootPassword != "" {
+		printStep("Setting root password...")
+		hash := rc.RootPassword
+		if !strings.HasPrefix(hash, "$") {
+			var err error
+			if hash, err = crypt.SHA512(rc.RootPassword); err != nil {
+				return err
+			}
+		}
+		shadow := root + "/etc/shadow"
+		steps = append(steps,
+			fmt.Sprintf(`[ -f %s ] || { echo 'root:*:0:0:99999:7:::' > %s; chmod 640 %s; }`, shadow, shadow, shadow),
+			fmt.Sprintf(`awk -F: -v OFS=: -v hash=%s '$1 == "root" { $2 = hash } 1' %s > %s.elmos`, arg(hash), shadow, shadow),
+			// Rewrite in place to keep the file's owner and mode
+			fmt.Sprintf(`cat %s.elmos > %s && rm %s.elmos`, shadow, shadow, shadow),
+		)
+	}
+
+	if rc.AuthorizedKeys != "" {
+		keys := expandHome(rc.AuthorizedKeys)
+		if _, err := os.Stat(keys); err != nil {
+			return fmt.Errorf("authorized_keys file not found: %s", keys)
+		}
+		printStep("Installing %s as root's authorized_keys...", keys)
+		steps = append(steps,
+			fmt.Sprintf(`mkdir -p %s/root/.ssh && chmod 700 %s/root/.ssh`, root, root),
+			fmt.Sprintf(`cat %s > %s/root/.ssh/authorized_keys && chmod 600 %s/root/.ssh/authorized_keys`, arg(keys), root, root),
+		)
+	}
+
+	if rc.Overlay != "" {
+		overlay := expandHome(rc.Overlay)
+		if info, err := os.Stat(overlay); err != nil || !info.IsDir() {
+			return fmt.Errorf("rootfs overlay not found: %s", overlay)
+		}
+		printStep("Copying overlay %s...", overlay)
+		// Overlay files belong to root in the guest, whoever owns them on the host
+		steps = append(steps, fmt.Sprintf(`tar -C %s -cf - . | tar -C %s -xpf - --no-same-owner`, arg(overlay), root))
+	}
+
+	if len(steps) == 0 {
+		return nil
+	}
+
+	script := "set -e\n" + strings.Join(steps, "\n") + "\n"
+	cmd := rootfsCommand(dir, "sh", append([]string{"-c", script, "sh"}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to customize rootfs: %w", err)
+	}
+	printSuccess("Rootfs customized")
+	return nil
+}
+
+// rootfsCommand runs a command that modifies the rootfs directory with the
+// privileges its files need: sudo for a tree really owned by root (debootstrap
+// runs under sudo), fakeroot with the recorded ownership otherwise
+func rootfsCommand(dir, name string, args ...string) *exec.Cmd {
+	if os.Getuid() != 0 {
+		if info, err := os.Stat(filepath.Join(dir, "etc")); err == nil {
+			if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Uid == 0 {
+				return exec.Command("sudo", append([]string{name}, args...)...)
+			}
+		}
+	}
+	return fakerootCommand(name, args...)
+}
+
+// expandHome expands a leading ~/ to the user's home directory
+func expandHome(path string) string {
+	if home, err := os.UserHomeDir(); err == nil && strings.HasPrefix(path, "~/") {
+		return filepath.Join(home, path[2:])
+	}
+	return path
+}
@@ -0,0 +1,325 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/NguyenTrongPhuc552003/elmos/internal/core"
+	"github.com/NguyenTrongPhuc552003/elmos/internal/image"
+)
+
+var rootfsCacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage debootstrap package tarballs for offline rootfs creation",
+	Long: `Download the packages of a Debian rootfs once into a tarball under the
+project (rootfs.cache_dir, default rootfs-cache/) and create rootfs
+directories from it without the network.
+
+A tarball matches a suite, architecture, variant, components and package
+list; 'rootfs create' uses the matching one automatically.
+
+Examples:
+  elmos rootfs cache create
+  elmos rootfs cache list
+  elmos rootfs create              # Offline when a matching tarball exists`,
+}
+
+var rootfsCacheCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Download the packages for the configured rootfs into a tarball",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runRootfsCacheCreate()
+	},
+}
+
+var rootfsCacheListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List package tarballs",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runRootfsCacheList()
+	},
+}
+
+// skipRootfsCache makes rootfs create download packages even when a
+// matching tarball exists
+var skipRootfsCache bool
+
+func init() {
+	rootfsCmd.AddCommand(rootfsCacheCmd)
+	rootfsCacheCmd.AddCommand(rootfsCacheCreateCmd)
+	rootfsCacheCmd.AddCommand(rootfsCacheListCmd)
+
+	rootfsCreateCmd.Flags().BoolVar(&skipRootfsCache, "no-cache", false, "Download packages even if a cached tarball matches")
+}
+
+// debianArchs maps build architectures to Debian architectures
+var debianArchs = map[string]string{
+	"arm64": "arm64",
+	"riscv": "riscv64",
+	"arm":   "armhf",
+}
+
+// debianArch returns the Debian architecture for a build architecture
+func debianArch(arch string) (string, error) {
+	debArch, ok := debianArchs[arch]
+	if !ok {
+		return "", fmt.Errorf("unsupported architecture for debootstrap: %s", arch)
+	}
+	return debArch, nil
+}
+
+// debootstrapProvider installs Debian with debootstrap --foreign; the second
+// stage runs in the guest on first boot
+type debootstrapProvider struct {
+	cfg *core.Config
+}
+
+func (p *debootstrapProvider) Name() string { return "debootstrap" }
+
+func (p *debootstrapProvider) Description() string {
+	return "Debian " + valueOr(p.cfg.Rootfs.Suite, core.DefaultDebianSuite)
+}
+
+func (p *debootstrapProvider) Populate(dir string) error {
+	cfg := p.cfg
+
+	debArch, err := debianArch(cfg.Build.Arch)
+	if err != nil {
+		return err
+	}
+	debootstrapPath, err := ensureDebootstrap()
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"--foreign"}, debootstrapOptions(debArch)...)
+	tarball, err := debootstrapCachePath(debArch)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(tarball); err == nil && !skipRootfsCache {
+		printInfo("Using cached packages from %s", tarball)
+		args = append(args, "--unpack-tarball="+tarball)
+	}
+	args = append(args, valueOr(cfg.Rootfs.Suite, core.DefaultDebianSuite), dir, cfg.Paths.DebianMirror)
+
+	printStep("Running debootstrap stage 1 (%s)...", debArch)
+
+	// Run debootstrap exactly like original: sudo env ... fakeroot debootstrap ...
+	cmd := exec.Command("sudo", append([]string{"-E", "fakeroot", debootstrapPath}, args...)...)
+	cmd.Env = debootstrapEnv()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("debootstrap failed: %w", err)
+	}
+
+	return createInitScript(dir, true)
+}
+
+// debootstrapDir returns the debootstrap checkout used on every host
+func debootstrapDir() string {
+	return filepath.Join(ctx.Config.Paths.ProjectRoot, "tools", "debootstrap")
+}
+
+// ensureDebootstrap clones debootstrap if needed and returns its script
+func ensureDebootstrap() (string, error) {
+	dir := debootstrapDir()
+	debootstrapPath := filepath.Join(dir, "debootstrap")
+
+	// Check if debootstrap exists, clone if not
+	if _, err := os.Stat(debootstrapPath); os.IsNotExist(err) {
+		printStep("Debootstrap not found. Cloning from upstream...")
+		if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+			return "", fmt.Errorf("failed to create tools directory: %w", err)
+		}
+
+		cloneCmd := exec.Command("git", "clone", "--depth=1", "https://salsa.debian.org/installer-team/debootstrap.git", dir)
+		cloneCmd.Stdout = os.Stdout
+		cloneCmd.Stderr = os.Stderr
+		if err := cloneCmd.Run(); err != nil {
+			return "", fmt.Errorf("failed to clone debootstrap: %w", err)
+		}
+		printSuccess("Debootstrap cloned")
+	}
+	return debootstrapPath, nil
+}
+
+// debootstrapEnv returns the environment debootstrap runs with
+func debootstrapEnv() []string {
+	// Build environment with proper PATH (matching common.env)
+	env := ctx.GetMakeEnv() // This includes gnu-sed, llvm, e2fsprogs, coreutils in PATH
+	return append(env, fmt.Sprintf("DEBOOTSTRAP_DIR=%s", debootstrapDir()))
+}
+
+// debootstrapOptions returns the options selecting what debootstrap
+// installs and how it verifies the archive
+func debootstrapOptions(debArch string) []string {
+	rc := ctx.Config.Rootfs
+
+	args := []string{"--arch=" + debArch}
+	if rc.Variant != "" {
+		args = append(args, "--variant="+rc.Variant)
+	}
+	if len(rc.Components) > 0 {
+		args = append(args, "--components="+strings.Join(rc.Components, ","))
+	}
+	if len(rc.Packages) > 0 {
+		args = append(args, "--include="+strings.Join(rc.Packages, ","))
+	}
+	if rc.Keyring != "" {
+		args = append(args, "--keyring="+expandHome(rc.Keyring))
+	} else {
+		args = append(args, "--no-check-gpg")
+	}
+	return args
+}
+
+// debootstrapCache describes a package tarball; it is stored next to it
+type debootstrapCache struct {
+	Suite      string    `json:"suite"`
+	Arch       string    `json:"arch"`
+	Variant    string    `json:"variant,omitempty"`
+	Components []string  `json:"components,omitempty"`
+	Packages   []string  `json:"packages,omitempty"`
+	Mirror     string    `json:"mirror"`
+	Created    time.Time `json:"created"`
+}
+
+// debootstrapCachePath returns the absolute tarball path for the
+// configuration; debootstrap changes directory before using it
+func debootstrapCachePath(debArch string) (string, error) {
+	return filepath.Abs(filepath.Join(ctx.Config.Rootfs.CacheDir, debootstrapCacheName(debArch)))
+}
+
+// debootstrapCacheName returns the tarball name for the configured suite,
+// variant, components and packages. The package set is hashed, as a tarball
+// made for other packages cannot install these offline.
+func debootstrapCacheName(debArch string) string {
+	rc := ctx.Config.Rootfs
+
+	components := append([]string(nil), rc.Components...)
+	packages := append([]string(nil), rc.Packages...)
+	sort.Strings(components)
+	sort.Strings(packages)
+	sum := sha256.Sum256([]byte(strings.Join(components, ",") + ";" + strings.Join(packages, ",")))
+
+	return fmt.Sprintf("debian-%s-%s-%s-%s.tgz", valueOr(rc.Suite, core.DefaultDebianSuite), debArch,
+		valueOr(rc.Variant, "default"), hex.EncodeToString(sum[:])[:8])
+}
+
+func runRootfsCacheCreate() error {
+	cfg := ctx.Config
+
+	debArch, err := debianArch(cfg.Build.Arch)
+	if err != nil {
+		return err
+	}
+	debootstrapPath, err := ensureDebootstrap()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(cfg.Rootfs.CacheDir, 0755); err != nil {
+		return err
+	}
+	tarball, err := debootstrapCachePath(debArch)
+	if err != nil {
+		return err
+	}
+	suite := valueOr(cfg.Rootfs.Suite, core.DefaultDebianSuite)
+
+	// debootstrap downloads into a scratch target before packing the tarball
+	if err := os.MkdirAll(cfg.StateDir(), 0755); err != nil {
+		return err
+	}
+	work, err := os.MkdirTemp(cfg.StateDir(), "debootstrap-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+
+	printStep("Downloading Debian %s packages for %s...", suite, debArch)
+	args := append([]string{debootstrapPath, "--make-tarball=" + tarball}, debootstrapOptions(debArch)...)
+	args = append(args, suite, work, cfg.Paths.DebianMirror)
+
+	// Only downloads happen here, so fakeroot's uid 0 is enough for debootstrap
+	cmd := exec.Command("fakeroot", args...)
+	cmd.Env = debootstrapEnv()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(tarball)
+		return fmt.Errorf("debootstrap failed: %w", err)
+	}
+
+	meta := &debootstrapCache{
+		Suite:      suite,
+		Arch:       debArch,
+		Variant:    cfg.Rootfs.Variant,
+		Components: cfg.Rootfs.Components,
+		Packages:   cfg.Rootfs.Packages,
+		Mirror:     cfg.Paths.DebianMirror,
+		Created:    time.Now(),
+	}
+	if err := writeJSONFile(strings.TrimSuffix(tarball, ".tgz")+".json", meta); err != nil {
+		return err
+	}
+
+	printSuccess("Package tarball created: %s", tarball)
+	printInfo("'elmos rootfs create' now works offline for this configuration")
+	return nil
+}
+
+func runRootfsCacheList() error {
+	cfg := ctx.Config
+
+	matches, _ := filepath.Glob(filepath.Join(cfg.Rootfs.CacheDir, "*.tgz"))
+	if len(matches) == 0 {
+		printInfo("No package tarballs in %s", cfg.Rootfs.CacheDir)
+		return nil
+	}
+
+	current := ""
+	if debArch, err := debianArch(cfg.Build.Arch); err == nil {
+		current = debootstrapCacheName(debArch)
+	}
+
+	fmt.Println()
+	fmt.Printf("  %-2s%-44s %-17s %-9s %s\n", "", "TARBALL", "CREATED", "SIZE", "PACKAGES")
+	fmt.Println("  " + strings.Repeat("-", 90))
+	for _, tarball := range matches {
+		name := filepath.Base(tarball)
+		meta := &debootstrapCache{}
+		created, packages := "-", "-"
+		if readJSONFile(strings.TrimSuffix(tarball, ".tgz")+".json", meta) == nil {
+			created = meta.Created.Format("2006-01-02 15:04")
+			packages = valueOr(strings.Join(meta.Packages, ","), "-")
+		}
+		size := "-"
+		if info, err := os.Stat(tarball); err == nil {
+			size = image.FormatBytes(info.Size())
+		}
+		marker := ""
+		if name == current {
+			marker = "*"
+		}
+		fmt.Printf("  %-2s%-44s %-17s %-9s %s\n", marker, name, created, size, packages)
+	}
+	fmt.Println()
+	if current != "" {
+		printInfo("* matches the current configuration")
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/NguyenTrongPhuc552003/elmos/internal/core"
+	"github.com/NguyenTrongPhuc552003/elmos/internal/image"
+)
+
+// e2fsTool returns the path of an e2fsprogs tool: the Homebrew build on
+// macOS, else the one in PATH or the sbin directories
+func e2fsTool(name string) string {
+	if sbin := core.GetBrewSbin("e2fsprogs"); sbin != "" {
+		return filepath.Join(sbin, name)
+	}
+	if path, err := exec.LookPath(name); err == nil {
+		return path
+	}
+	for _, dir := range []string{"/usr/sbin", "/sbin"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return filepath.Join(dir, name)
+		}
+	}
+	return name
+}
+
+// runDebugfs runs debugfs requests against an ext4 image and returns the
+// output. debugfs exits 0 even when a request fails, so callers check the
+// result themselves.
+func runDebugfs(imagePath string, writable bool, requests ...string) (string, error) {
+	args := []string{"-f", "-"}
+	if writable {
+		args = append([]string{"-w"}, args...)
+	}
+	cmd := exec.Command(e2fsTool("debugfs"), append(args, imagePath)...)
+	cmd.Stdin = strings.NewReader(strings.Join(requests, "\n") + "\n")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("debugfs failed: %w\n%s", err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// writeImageFile replaces a file in an ext4 image with content, owned by root
+func writeImageFile(imagePath, guestPath string, content []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp("", "elmos-debugfs-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	if _, err := runDebugfs(imagePath, true,
+		"rm "+guestPath,
+		fmt.Sprintf("write %s %s", tmp.Name(), guestPath),
+		fmt.Sprintf("set_inode_field %s mode 0%o", guestPath, 0100000|perm.Perm()),
+		fmt.Sprintf("set_inode_field %s uid 0", guestPath),
+		fmt.Sprintf("set_inode_field %s gid 0", guestPath),
+	); err != nil {
+		return err
+	}
+
+	// Read the file back, as debugfs does not report failed requests
+	out, err := exec.Command(e2fsTool("debugfs"), "-R", "cat "+guestPath, imagePath).Output()
+	if err != nil || string(out) != string(content) {
+		return fmt.Errorf("failed to write %s in %s", guestPath, imagePath)
+	}
+	return nil
+}
+
+// debugfsQuote quotes a path for a debugfs request
+func debugfsQuote(p string) (string, error) {
+	if strings.ContainsAny(p, "\"\n") {
+		return "", fmt.Errorf("unsupported character in path: %q", p)
+	}
+	return `"` + p + `"`, nil
+}
+
+// checkDebugfsOutput returns the first error debugfs reported for a batch
+// of requests. Removing a file that does not exist is not an error.
+func checkDebugfsOutput(out string) error {
+	request := ""
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", strings.HasPrefix(line, "debugfs "), strings.HasPrefix(line, "Allocated inode"):
+		case strings.HasPrefix(line, "debugfs: "):
+			request = strings.TrimPrefix(line, "debugfs: ")
+		case strings.HasPrefix(request, "rm ") && strings.Contains(line, "File not found"):
+		default:
+			return fmt.Errorf("debugfs: %s: %s", request, line)
+		}
+	}
+	return nil
+}
+
+// imageEntry is a file in an ext4 image as reported by debugfs stat
+type imageEntry struct {
+	// Type is "regular", "directory", "symlink", ...
+	Type string
+	Mode os.FileMode
+	// Target is the destination of a symlink
+	Target string
+}
+
+// statImage looks up a path in an ext4 image; it returns nil if the path
+// does not exist
+func statImage(imagePath, guestPath string) (*imageEntry, error) {
+	quoted, err := debugfsQuote(guestPath)
+	if err != nil {
+		return nil, err
+	}
+	out, err := exec.Command(e2fsTool("debugfs"), "-R", "stat "+quoted, imagePath).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("debugfs failed: %w\n%s", err, strings.TrimSpace(string(out)))
+	}
+
+	entry := &imageEntry{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.Contains(line, "File not found") {
+			return nil, nil
+		}
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "Type:":
+				entry.Type = fields[i+1]
+			case "Mode:":
+				var mode uint32
+				fmt.Sscanf(fields[i+1], "%o", &mode)
+				entry.Mode = os.FileMode(mode).Perm()
+			}
+		}
+		if dest, ok := strings.CutPrefix(line, "Fast link dest: "); ok {
+			entry.Target = strings.Trim(dest, `"`)
+		}
+	}
+	if entry.Type == "" {
+		return nil, fmt.Errorf("failed to stat %s in %s: %s", guestPath, imagePath, strings.TrimSpace(string(out)))
+	}
+
+	// Long symlink targets are stored in a data block, which cat prints
+	if entry.Type == "symlink" && entry.Target == "" {
+		target, err := exec.Command(e2fsTool("debugfs"), "-R", "cat "+quoted, imagePath).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read symlink %s: %w", guestPath, err)
+		}
+		entry.Target = string(target)
+	}
+	return entry, nil
+}
+
+// maxImageSymlinks bounds symlink resolution in an image, like ELOOP
+const maxImageSymlinks = 40
+
+// resolveImagePath follows symlinks in every component of a path in an
+// ext4 image, as debugfs does not (e.g. /lib/modules on a merged-/usr
+// system). The entry is nil if the last component does not exist.
+func resolveImagePath(imagePath, guestPath string) (string, *imageEntry, error) {
+	return resolveImagePathDepth(imagePath, guestPath, 0)
+}
+
+func resolveImagePathDepth(imagePath, guestPath string, links int) (string, *imageEntry, error) {
+	parts := strings.Split(strings.Trim(path.Clean("/"+guestPath), "/"), "/")
+	resolved := "/"
+	var entry *imageEntry
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		if entry != nil && entry.Type != "directory" {
+			return "", nil, fmt.Errorf("%s is not a directory in %s", resolved, imagePath)
+		}
+		next := path.Join(resolved, part)
+		var err error
+		if entry, err = statImage(imagePath, next); err != nil {
+			return "", nil, err
+		}
+		if entry == nil {
+			if i < len(parts)-1 {
+				return "", nil, fmt.Errorf("%s not found in %s", next, imagePath)
+			}
+			return next, nil, nil
+		}
+		if entry.Type == "symlink" {
+			if links++; links > maxImageSymlinks {
+				return "", nil, fmt.Errorf("too many levels of symlinks: %s", guestPath)
+			}
+			target := entry.Target
+			if !path.IsAbs(target) {
+				target = path.Join(resolved, target)
+			}
+			if next, entry, err = resolveImagePathDepth(imagePath, target, links); err != nil {
+				return "", nil, err
+			}
+			if entry == nil && i < len(parts)-1 {
+				return "", nil, fmt.Errorf("%s not found in %s", next, imagePath)
+			}
+		}
+		resolved = next
+	}
+	if entry == nil && resolved == "/" {
+		entry = &imageEntry{Type: "directory", Mode: 0755}
+	}
+	return resolved, entry, nil
+}
+
+// resolveImageDir resolves a directory whose parent is already resolved;
+// exists is false if nothing is there yet
+func resolveImageDir(imagePath, guestPath string) (resolved string, exists bool, err error) {
+	entry, err := statImage(imagePath, guestPath)
+	if err != nil || entry == nil {
+		return guestPath, false, err
+	}
+	if entry.Type == "symlink" {
+		if guestPath, entry, err = resolveImagePath(imagePath, guestPath); err != nil || entry == nil {
+			return guestPath, false, err
+		}
+	}
+	if entry.Type != "directory" {
+		return "", false, fmt.Errorf("%s is not a directory in %s", guestPath, imagePath)
+	}
+	return guestPath, true, nil
+}
+
+// writeImageTree copies a host file or directory tree into an ext4 image as
+// dst, owned by root. The parent of dst must exist.
+func writeImageTree(imagePath, src, dst string) error {
+	// guestDirs maps directories of the tree to their resolved path in the
+	// image; inImage tells whether they already existed there
+	guestDirs := map[string]string{}
+	inImage := map[string]bool{}
+
+	var requests []string
+	add := func(format string, paths ...string) error {
+		quoted := make([]any, len(paths))
+		for i, p := range paths {
+			q, err := debugfsQuote(p)
+			if err != nil {
+				return err
+			}
+			quoted[i] = q
+		}
+		requests = append(requests, fmt.Sprintf(format, quoted...))
+		return nil
+	}
+
+	err := filepath.WalkDir(src, func(hostPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, hostPath)
+		rel = filepath.ToSlash(rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		var guest string
+		parentExists := true
+		if rel == "." {
+			guest = path.Clean("/" + dst)
+			if guest != "/" {
+				parent, entry, err := resolveImagePath(imagePath, path.Dir(guest))
+				if err != nil {
+					return err
+				}
+				if entry == nil || entry.Type != "directory" {
+					return fmt.Errorf("directory %s not found in %s", path.Dir(guest), imagePath)
+				}
+				guest = path.Join(parent, path.Base(guest))
+			}
+		} else {
+			parent := path.Dir(rel)
+			guest = path.Join(guestDirs[parent], path.Base(rel))
+			parentExists = inImage[parent]
+		}
+
+		switch {
+		case d.IsDir():
+			exists := false
+			if parentExists {
+				if guest, exists, err = resolveImageDir(imagePath, guest); err != nil {
+					return err
+				}
+			}
+			guestDirs[rel], inImage[rel] = guest, exists
+			if !exists {
+				if err := add("mkdir %s", guest); err != nil {
+					return err
+				}
+				return add(fmt.Sprintf("set_inode_field %%s mode 0%o", 040000|info.Mode().Perm()), guest)
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(hostPath)
+			if err != nil {
+				return err
+			}
+			if err := add("rm %s", guest); err != nil {
+				return err
+			}
+			return add("symlink %s %s", guest, target)
+		case info.Mode().IsRegular():
+			if err := add("rm %s", guest); err != nil {
+				return err
+			}
+			if err := add("write %s %s", hostPath, guest); err != nil {
+				return err
+			}
+			return add(fmt.Sprintf("set_inode_field %%s mode 0%o\nset_inode_field %%s uid 0\nset_inode_field %%s gid 0",
+				0100000|info.Mode().Perm()), guest, guest, guest)
+		default:
+			printWarn("Skipping special file %s", hostPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(requests) == 0 {
+		return nil
+	}
+	out, err := runDebugfs(imagePath, true, requests...)
+	if err != nil {
+		return err
+	}
+	return checkDebugfsOutput(out)
+}
+
+// checkImageIdle refuses to modify a disk image that a running QEMU has open
+func checkImageIdle(imagePath string) error {
+	if image.Busy(imagePath) {
+		return fmt.Errorf("%s is in use, probably by QEMU (stop the VM before changing the image)", imagePath)
+	}
+	return nil
+}
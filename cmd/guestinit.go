@@ -0,0 +1,269 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/NguyenTrongPhuc552003/elmos/internal/core"
+)
+
+// initTemplate is the guest /init script, shared by the disk image and the
+// initramfs. It is rendered with initData.
+var initTemplate = template.Must(template.New("init").Funcs(template.FuncMap{
+	"quote": shellQuote,
+}).Parse(`#!/bin/sh
+# Generated by elmos; rewrite with 'elmos rootfs init regen'
+
+# A BusyBox system only ships /bin/sh; install the other applets
+[ -x /bin/busybox ] && /bin/busybox --install -s 2>/dev/null
+
+echo "Booting root filesystem..."
+{{- if .SecondStage}}
+
+MARKER="/.rootfs-setup-complete"
+
+if [ ! -f "$MARKER" ]; then
+    echo "First boot detected – running debootstrap second stage..."
+    /debootstrap/debootstrap --second-stage
+    if [ $? -eq 0 ]; then
+        touch "$MARKER"
+        echo "Second stage completed successfully."
+{{- if .Finalize}}
+        sync
+        mount -o remount,ro /
+        poweroff -f 2>/dev/null || { mount -t proc proc /proc; echo o > /proc/sysrq-trigger; }
+        sleep 10
+{{- end}}
+    else
+        echo "Second stage failed – dropping to emergency shell."
+        exec /bin/sh
+    fi
+else
+    echo "Root filesystem already set up."
+fi
+{{- end}}
+
+# Mount essential virtual filesystems
+mount -t proc  proc  /proc
+mount -t sysfs sys   /sys
+mount -t devtmpfs dev /dev 2>/dev/null || mount -t tmpfs dev /dev
+[ -d /dev/pts ] || mkdir /dev/pts
+mount -t devpts devpts /dev/pts
+
+# Mount the filesystems listed in /etc/fstab, if any
+grep -qvE '^[[:space:]]*(#|$)' /etc/fstab 2>/dev/null && mount -a
+{{- with .Guest.Hostname}}
+
+hostname {{quote .}}
+{{- end}}
+
+# Network configuration
+ip link set lo up
+{{- if eq .Network "static"}}
+ip link set eth0 up
+ip addr add {{quote .Guest.Address}} dev eth0
+ip route add default via {{quote .Guest.Gateway}}
+{{- else if eq .Network "dhcp"}}
+ip link set eth0 up
+if command -v dhclient >/dev/null 2>&1; then
+    dhclient -1 eth0
+else
+    cat > /run/udhcpc.sh <<'EOF'
+#!/bin/sh
+case "$1" in
+bound|renew)
+    ip addr flush dev "$interface"
+    ip addr add "$ip/${mask:-24}" dev "$interface"
+    [ -n "$router" ] && ip route replace default via ${router%% *}
+    [ -n "$dns" ] && for s in $dns; do echo "nameserver $s"; done > /etc/resolv.conf
+    ;;
+esac
+EOF
+    chmod +x /run/udhcpc.sh
+    udhcpc -i eth0 -n -q -s /run/udhcpc.sh
+fi
+{{- end}}
+{{- if .DNS}}
+: > /etc/resolv.conf
+{{- range .DNS}}
+echo nameserver {{quote .}} >> /etc/resolv.conf
+{{- end}}
+{{- end}}
+{{- if .ModulesDir}}
+
+# Load modules packed into the image
+for ko in {{.ModulesDir}}/*.ko; do
+    [ -f "$ko" ] && insmod "$ko"
+done
+{{- end}}
+
+# Mount 9p share for modules
+mkdir -p /mnt/modules
+mount -t 9p -o trans=virtio,version=9p2000.L modules_mount /mnt/modules 2>/dev/null
+{{- range .Guest.Mounts}}
+mkdir -p {{quote .Path}}
+{{- if eq .Type "virtiofs"}}
+mount -t virtiofs{{with .Options}} -o {{quote .}}{{end}} {{quote .Tag}} {{quote .Path}}
+{{- else}}
+mount -t 9p -o trans=virtio,version=9p2000.L{{with .Options}},{{quote .}}{{end}} {{quote .Tag}} {{quote .Path}}
+{{- end}}
+{{- end}}
+
+# Execute module sync script if present
+if [ -f /mnt/modules/guesync.sh ]; then
+    /mnt/modules/guesync.sh
+fi
+
+echo "System ready."
+{{- if .Guest.Hooks}}
+
+# Startup hooks
+{{- range .Guest.Hooks}}
+echo "[hook] "{{quote .}}
+{{.}}
+{{- end}}
+{{- end}}
+{{- if .Guest.Poweroff}}
+
+echo "Powering off."
+sync
+poweroff -f 2>/dev/null || echo o > /proc/sysrq-trigger
+sleep 10
+{{- else}}
+exec /bin/sh
+{{- end}}
+`))
+
+// initOptions selects the optional parts of the generated /init
+type initOptions struct {
+	// SecondStage completes a debootstrap --foreign installation on first boot
+	SecondStage bool
+	// Finalize powers off right after the second stage (rootfs finalize
+	// --qemu)
+	Finalize bool
+	// ModulesDir holds kernel modules packed into the image, loaded at boot
+	ModulesDir string
+}
+
+// validMountTag matches the mount tags QEMU and the guest accept
+var validMountTag = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// initData is what initTemplate is rendered with
+type initData struct {
+	initOptions
+	Guest core.GuestConfig
+	// Network is the validated networking mode
+	Network string
+	// DNS are the name servers written to /etc/resolv.conf, if any
+	DNS []string
+}
+
+// initScript renders /init from the guest: configuration
+func initScript(opts initOptions) (string, error) {
+	guest := ctx.Config.Guest
+
+	data := initData{initOptions: opts, Guest: guest, Network: valueOr(guest.Network, "static"), DNS: guest.DNS}
+	switch data.Network {
+	case "static":
+		data.Guest.Address = valueOr(guest.Address, core.DefaultGuestAddress)
+		data.Guest.Gateway = valueOr(guest.Gateway, core.DefaultGuestGateway)
+		if len(data.DNS) == 0 {
+			data.DNS = []string{"8.8.8.8"}
+		}
+	case "dhcp", "none":
+	default:
+		return "", fmt.Errorf("invalid guest.network: %s (valid: static, dhcp, none)", guest.Network)
+	}
+
+	if data.Network == "static" {
+		if _, _, err := net.ParseCIDR(data.Guest.Address); err != nil {
+			return "", fmt.Errorf("invalid guest.address: %s (use CIDR form, e.g. 10.0.2.15/24)", data.Guest.Address)
+		}
+		if net.ParseIP(data.Guest.Gateway) == nil {
+			return "", fmt.Errorf("invalid guest.gateway: %s", data.Guest.Gateway)
+		}
+	}
+	for _, dns := range data.DNS {
+		if net.ParseIP(dns) == nil {
+			return "", fmt.Errorf("invalid guest.dns entry: %s", dns)
+		}
+	}
+
+	for _, m := range guest.Mounts {
+		if !validMountTag.MatchString(m.Tag) || !strings.HasPrefix(m.Path, "/") {
+			return "", fmt.Errorf("guest mount needs a tag of letters, digits, '_', '.' and '-', and an absolute path: %+v", m)
+		}
+		if m.Type != "" && m.Type != "9p" && m.Type != "virtiofs" {
+			return "", fmt.Errorf("invalid guest mount type for %s: %s (valid: 9p, virtiofs)", m.Tag, m.Type)
+		}
+	}
+
+	var b strings.Builder
+	if err := initTemplate.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render init script: %w", err)
+	}
+	return b.String(), nil
+}
+
+// createInitScript writes /init. With secondStage, the first boot completes
+// a debootstrap --foreign installation before starting the system.
+func createInitScript(rootfsDir string, secondStage bool) error {
+	script, err := initScript(initOptions{SecondStage: secondStage})
+	if err != nil {
+		return err
+	}
+
+	initPath := filepath.Join(rootfsDir, "init")
+	os.Remove(initPath)
+	if err := os.WriteFile(initPath, []byte(script), 0755); err != nil {
+		return fmt.Errorf("failed to create init script: %w", err)
+	}
+
+	return nil
+}
+
+// guestShareArgs returns the QEMU arguments that export the modules
+// directory and the guest.mounts shares
+func guestShareArgs() []string {
+	cfg := ctx.Config
+
+	// 9p share for modules
+	args := []string{
+		"-fsdev", fmt.Sprintf("local,id=moddev,path=%s,security_model=none", cfg.Paths.ModulesDir),
+		"-device", "virtio-9p-pci,fsdev=moddev,mount_tag=modules_mount",
+	}
+
+	virtiofs := false
+	for i, m := range cfg.Guest.Mounts {
+		switch {
+		case m.Type == "virtiofs" && m.Socket != "":
+			id := fmt.Sprintf("vfs%d", i)
+			args = append(args,
+				"-chardev", fmt.Sprintf("socket,id=%s,path=%s", id, m.Socket),
+				"-device", fmt.Sprintf("vhost-user-fs-pci,chardev=%s,tag=%s", id, m.Tag),
+			)
+			virtiofs = true
+		case m.Type != "virtiofs" && m.Source != "":
+			id := fmt.Sprintf("fsdev%d", i)
+			args = append(args,
+				"-fsdev", fmt.Sprintf("local,id=%s,path=%s,security_model=none", id, m.Source),
+				"-device", fmt.Sprintf("virtio-9p-pci,fsdev=%s,mount_tag=%s", id, m.Tag),
+			)
+		}
+	}
+
+	// vhost-user devices need guest memory that virtiofsd can map
+	if virtiofs {
+		args = append(args,
+			"-object", fmt.Sprintf("memory-backend-memfd,id=mem,size=%s,share=on", cfg.QEMU.Memory),
+			"-numa", "node,memdev=mem",
+		)
+	}
+	return args
+}
@@ -4,9 +4,13 @@ package cmd
 import (
 	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"time"
 
 	"github.com/spf13/cobra"
+
+	"github.com/NguyenTrongPhuc552003/elmos/internal/core"
+	"github.com/NguyenTrongPhuc552003/elmos/internal/image"
 )
 
 // initCmd - initialize workspace (mount + clone)
@@ -36,7 +40,11 @@ var initCmd = &cobra.Command{
 var imageCmd = &cobra.Command{
 	Use:   "image",
 	Short: "Manage sparse disk image",
-	Long:  `Commands to create, mount, and unmount the case-sensitive APFS sparse image.`,
+	Long: `Commands to create, mount, and unmount the workspace disk image: a
+case-sensitive APFS sparse image on macOS, a sparse ext4 image on Linux.
+
+On Linux, root mounts the image through a loop device. Other users get
+fuse2fs or udisksctl when installed, and sudo otherwise.`,
 }
 
 var imageMountCmd = &cobra.Command{
@@ -66,14 +74,26 @@ var imageCreateCmd = &cobra.Command{
 
 var imageStatusCmd = &cobra.Command{
 	Use:   "status",
-	Short: "Show image mount status",
+	Short: "Show image mount status and space usage",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if ctx.IsMounted() {
-			printSuccess("Image is mounted at %s", ctx.Config.Image.MountPoint)
-		} else {
-			printWarn("Image is not mounted")
-		}
-		return nil
+		return runImageStatus()
+	},
+}
+
+var imageResizeCmd = &cobra.Command{
+	Use:   "resize [size]",
+	Short: "Grow or shrink the image (e.g. 40G); the image must be unmounted",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runImageResize(args[0])
+	},
+}
+
+var imageCompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Reclaim unused space in the sparse image; the image must be unmounted",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runImageCompact()
 	},
 }
 
@@ -82,6 +102,8 @@ func init() {
 	imageCmd.AddCommand(imageUnmountCmd)
 	imageCmd.AddCommand(imageCreateCmd)
 	imageCmd.AddCommand(imageStatusCmd)
+	imageCmd.AddCommand(imageResizeCmd)
+	imageCmd.AddCommand(imageCompactCmd)
 }
 
 func runImageMount() error {
@@ -103,11 +125,7 @@ func runImageMount() error {
 
 	// Mount the image
 	printStep("Mounting %s...", cfg.Image.VolumeName)
-	cmd := exec.Command("hdiutil", "attach", cfg.Image.Path, "-quiet")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Image().Mount(); err != nil {
 		return fmt.Errorf("failed to mount image: %w", err)
 	}
 
@@ -124,13 +142,11 @@ func runImageUnmount() error {
 	}
 
 	printStep("Unmounting %s...", cfg.Image.MountPoint)
-	cmd := exec.Command("hdiutil", "detach", cfg.Image.MountPoint, "-force")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Image().Unmount(); err != nil {
 		return fmt.Errorf("failed to unmount image: %w", err)
 	}
+	// Stops the idle watcher of an on-demand mount
+	os.Remove(cfg.AutoMountFile())
 
 	printSuccess("Unmounted successfully")
 	return nil
@@ -145,22 +161,138 @@ func runImageCreate() error {
 		return nil
 	}
 
-	printStep("Creating %s case-sensitive APFS sparse image...", cfg.Image.Size)
-
-	cmd := exec.Command("hdiutil", "create",
-		"-size", cfg.Image.Size,
-		"-fs", "Case-sensitive APFS",
-		"-type", "SPARSE",
-		"-volname", cfg.Image.VolumeName,
-		cfg.Image.Path,
-	)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	backend := ctx.Image()
+	if backend.Name() == "hdiutil" {
+		printStep("Creating %s case-sensitive APFS sparse image...", cfg.Image.Size)
+	} else {
+		printStep("Creating %s sparse ext4 image...", cfg.Image.Size)
+	}
 
-	if err := cmd.Run(); err != nil {
+	if err := backend.Create(); err != nil {
 		return fmt.Errorf("failed to create image: %w", err)
 	}
 
 	printSuccess("Created image at %s", cfg.Image.Path)
 	return nil
 }
+
+func runImageStatus() error {
+	cfg := ctx.Config
+	backend := ctx.Image()
+
+	if apparent, allocated, err := image.FileUsage(cfg.Image.Path); err == nil {
+		printInfo("Image file: %s (%s apparent, %s allocated)", cfg.Image.Path,
+			image.FormatBytes(apparent), image.FormatBytes(allocated))
+	} else {
+		printWarn("Image file not found: %s", cfg.Image.Path)
+	}
+
+	m := backend.Mounted()
+	if m == nil {
+		printWarn("Image is not mounted")
+		return nil
+	}
+	printSuccess("Image is mounted at %s", cfg.Image.MountPoint)
+	printInfo("Source: %s (%s, %s backend)", m.Source, m.FSType, backend.Name())
+	if info, err := os.Stat(cfg.AutoMountFile()); err == nil {
+		line := fmt.Sprintf("Auto-mounted, last used %s ago", time.Since(info.ModTime()).Round(time.Second))
+		if cfg.Image.IdleUnmount != "" {
+			line += fmt.Sprintf(" (unmounts after %s idle)", cfg.Image.IdleUnmount)
+		}
+		printInfo("%s", line)
+	}
+
+	if free, total, err := image.FreeSpace(cfg.Image.MountPoint); err == nil {
+		used := int64(total - free)
+		line := fmt.Sprintf("Volume: %s free of %s (%d%% used)",
+			image.FormatBytes(int64(free)), image.FormatBytes(int64(total)), used*100/max(int64(total), 1))
+		if lowOnSpace(free) {
+			printWarn("%s, below min_free %s", line, cfg.Image.MinFree)
+		} else {
+			printInfo("%s", line)
+		}
+	}
+
+	dirs, err := image.LargestDirs(cfg.Image.MountPoint, 5)
+	if err != nil || len(dirs) == 0 {
+		return nil
+	}
+	fmt.Println()
+	fmt.Println("Largest directories:")
+	for _, d := range dirs {
+		fmt.Printf("  %8s  %s\n", image.FormatBytes(d.Size), d.Path)
+	}
+	return nil
+}
+
+func runImageResize(size string) error {
+	cfg := ctx.Config
+
+	if _, err := image.ParseSize(size); err != nil {
+		return err
+	}
+	if _, err := os.Stat(cfg.Image.Path); err != nil {
+		return fmt.Errorf("image not found: %s", cfg.Image.Path)
+	}
+	if ctx.IsMounted() {
+		return fmt.Errorf("image is mounted; run 'elmos image unmount' first")
+	}
+
+	printStep("Resizing %s to %s...", cfg.Image.Path, size)
+	if err := ctx.Image().Resize(size); err != nil {
+		return fmt.Errorf("failed to resize image: %w", err)
+	}
+
+	// Keep the configured size in step so a re-created image matches
+	if cfg.Image.Size != size {
+		cfg.Image.Size = size
+		cfg.Unprofiled().Image.Size = size
+		if err := core.SaveConfig(cfg.Unprofiled(), filepath.Join(cfg.Paths.ProjectRoot, "elmos.yaml")); err != nil {
+			printWarn("Failed to save image size: %v", err)
+		}
+	}
+
+	printSuccess("Image resized to %s", size)
+	return nil
+}
+
+func runImageCompact() error {
+	cfg := ctx.Config
+
+	apparent, before, err := image.FileUsage(cfg.Image.Path)
+	if err != nil {
+		return fmt.Errorf("image not found: %s", cfg.Image.Path)
+	}
+	if ctx.IsMounted() {
+		return fmt.Errorf("image is mounted; run 'elmos image unmount' first")
+	}
+
+	printStep("Compacting %s (%s allocated)...", cfg.Image.Path, image.FormatBytes(before))
+	if err := ctx.Image().Compact(); err != nil {
+		return fmt.Errorf("failed to compact image: %w", err)
+	}
+
+	_, after, err := image.FileUsage(cfg.Image.Path)
+	if err != nil {
+		return err
+	}
+	printSuccess("Reclaimed %s (%s of %s allocated)", image.FormatBytes(max(before-after, 0)),
+		image.FormatBytes(after), image.FormatBytes(apparent))
+	return nil
+}
+
+// lowOnSpace reports whether free bytes are below the configured min_free
+func lowOnSpace(free uint64) bool {
+	threshold, err := image.ParseSize(ctx.Config.Image.MinFree)
+	return err == nil && free < uint64(threshold)
+}
+
+// warnLowSpace warns when the mounted volume has less free space than min_free
+func warnLowSpace() {
+	free, _, err := image.FreeSpace(ctx.Config.Image.MountPoint)
+	if err != nil || !lowOnSpace(free) {
+		return
+	}
+	printWarn("Only %s free on %s (min_free %s); try 'elmos image compact' or 'elmos image resize'",
+		image.FormatBytes(int64(free)), ctx.Config.Image.MountPoint, ctx.Config.Image.MinFree)
+}
@@ -0,0 +1,309 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/NguyenTrongPhuc552003/elmos/internal/core"
+	"github.com/NguyenTrongPhuc552003/elmos/internal/cpio"
+	"github.com/NguyenTrongPhuc552003/elmos/internal/image"
+)
+
+// initramfsCmd - initramfs management
+var initramfsCmd = &cobra.Command{
+	Use:   "initramfs",
+	Short: "Build an initramfs for quick boots",
+	Long: `Build a compressed cpio initramfs that boots in about a second, without
+the ext4 disk image or mke2fs.
+
+The archive holds, in this order (later entries win):
+  - a skeleton with /dev/console and /dev/null
+  - busybox (rootfs.busybox or --busybox), linked by /init on boot
+  - built modules (*.ko) from the modules directory, loaded by /init
+  - built apps from the apps directory, in /usr/bin
+  - the generated /init
+  - a directory tree (initramfs.tree or --tree), copied as is
+
+Examples:
+  elmos initramfs build --busybox ~/busybox-arm64
+  elmos initramfs build --compress zstd
+  elmos qemu run --initrd`,
+}
+
+var initramfsBuildCmd = &cobra.Command{
+	Use:   "build",
+	Short: "Build the initramfs archive",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg := ctx.Config
+		if cmd.Flags().Changed("output") {
+			cfg.Initramfs.Output, _ = cmd.Flags().GetString("output")
+		}
+		if cmd.Flags().Changed("tree") {
+			cfg.Initramfs.Tree, _ = cmd.Flags().GetString("tree")
+		}
+		if cmd.Flags().Changed("compress") {
+			cfg.Initramfs.Compression, _ = cmd.Flags().GetString("compress")
+		}
+		if cmd.Flags().Changed("busybox") {
+			cfg.Rootfs.BusyBox, _ = cmd.Flags().GetString("busybox")
+		}
+		// The default output lives on the image volume, where 'qemu run
+		// --initrd' looks for it once mounted
+		if cfg.Initramfs.Output == "" {
+			if err := ctx.EnsureMounted(); err != nil {
+				return err
+			}
+		}
+		return runInitramfsBuild()
+	},
+}
+
+func init() {
+	initramfsCmd.AddCommand(initramfsBuildCmd)
+
+	initramfsBuildCmd.Flags().StringP("output", "o", "", "Archive path (default: initramfs.cpio.<ext> next to the disk image)")
+	initramfsBuildCmd.Flags().String("tree", "", "Directory to copy into the initramfs")
+	initramfsBuildCmd.Flags().String("compress", "", "Compression: gzip, zstd or none")
+	initramfsBuildCmd.Flags().String("busybox", "", "Static busybox binary to include")
+}
+
+// initramfsModulesDir is where built modules are placed in the initramfs
+const initramfsModulesDir = "/lib/modules/extra"
+
+// initramfsExtensions maps compressions to archive file extensions
+var initramfsExtensions = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+	"none": "",
+}
+
+// initramfsPath returns the configured archive path, or the default next to
+// the disk image
+func initramfsPath(cfg *core.Config) string {
+	if cfg.Initramfs.Output != "" {
+		return cfg.Initramfs.Output
+	}
+	compression := valueOr(cfg.Initramfs.Compression, core.DefaultCompression)
+	return filepath.Join(filepath.Dir(cfg.DiskImage()), "initramfs.cpio"+initramfsExtensions[compression])
+}
+
+func runInitramfsBuild() error {
+	cfg := ctx.Config
+
+	compression := valueOr(cfg.Initramfs.Compression, core.DefaultCompression)
+	if _, ok := initramfsExtensions[compression]; !ok {
+		return fmt.Errorf("invalid compression: %s (valid: gzip, zstd, none)", compression)
+	}
+	if compression == "zstd" {
+		if _, err := exec.LookPath("zstd"); err != nil {
+			return fmt.Errorf("zstd not found (run 'brew install zstd')")
+		}
+	}
+
+	output := initramfsPath(cfg)
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return err
+	}
+
+	printStep("Building initramfs for %s (%s)...", cfg.Build.Arch, compression)
+
+	// Write next to the output and rename, so a running QEMU keeps a whole file
+	tmp := output + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	stream, finish, err := compressStream(f, compression)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	archive := cpio.NewWriter(stream)
+	summary, err := writeInitramfs(archive)
+	if err == nil {
+		err = archive.Close()
+	}
+	if finishErr := finish(); err == nil {
+		err = finishErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to build initramfs: %w", err)
+	}
+
+	if err := os.Rename(tmp, output); err != nil {
+		return err
+	}
+
+	size := "?"
+	if info, err := os.Stat(output); err == nil {
+		size = image.FormatBytes(info.Size())
+	}
+	printSuccess("Initramfs built: %s (%s; %s)", output, size, summary)
+	printInfo("Boot it with: elmos qemu run --initrd")
+	return nil
+}
+
+// compressStream wraps w with the compressor; finish flushes it and waits
+// for an external compressor to exit
+func compressStream(w io.Writer, compression string) (io.Writer, func() error, error) {
+	switch compression {
+	case "gzip":
+		gz, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, gz.Close, nil
+	case "zstd":
+		// The kernel's decompressor limits the window size; -19 stays within it
+		cmd := exec.Command("zstd", "-q", "-19", "-c")
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, nil, fmt.Errorf("failed to start zstd: %w", err)
+		}
+		finish := func() error {
+			stdin.Close()
+			if err := cmd.Wait(); err != nil {
+				return fmt.Errorf("zstd failed: %w", err)
+			}
+			return nil
+		}
+		return stdin, finish, nil
+	default:
+		return w, func() error { return nil }, nil
+	}
+}
+
+// writeInitramfs adds the initramfs contents to the archive and returns a
+// summary of what was included
+func writeInitramfs(archive *cpio.Writer) (string, error) {
+	cfg := ctx.Config
+	var summary []string
+
+	for _, d := range busyboxDirs {
+		perm := uint32(0755)
+		if d == "tmp" {
+			perm = 01777
+		}
+		if err := archive.WriteDir(d, perm); err != nil {
+			return "", err
+		}
+	}
+	// The kernel opens /dev/console for /init before devtmpfs is mounted
+	if err := archive.WriteDevice("dev/console", cpio.TypeChar, 0600, 5, 1); err != nil {
+		return "", err
+	}
+	if err := archive.WriteDevice("dev/null", cpio.TypeChar, 0666, 1, 3); err != nil {
+		return "", err
+	}
+
+	hasShell := false
+	if busybox := cfg.Rootfs.BusyBox; busybox != "" {
+		if err := checkGuestBinary(busybox, cfg.Build.Arch); err != nil {
+			return "", err
+		}
+		if err := archive.CopyFile("bin/busybox", busybox); err != nil {
+			return "", err
+		}
+		if err := archive.WriteSymlink("bin/sh", "busybox"); err != nil {
+			return "", err
+		}
+		hasShell = true
+		summary = append(summary, "busybox")
+	}
+
+	modules, err := findBuiltModules(cfg.Paths.ModulesDir)
+	if err != nil {
+		return "", err
+	}
+	for _, ko := range modules {
+		if err := archive.CopyFile(filepath.Join(initramfsModulesDir, filepath.Base(ko)), ko); err != nil {
+			return "", err
+		}
+	}
+	summary = append(summary, fmt.Sprintf("%d modules", len(modules)))
+
+	apps, _ := getApps("")
+	appCount := 0
+	for _, app := range apps {
+		binary := filepath.Join(cfg.Paths.AppsDir, app, app)
+		if _, err := os.Stat(binary); err != nil {
+			continue
+		}
+		if err := checkGuestBinary(binary, cfg.Build.Arch); err != nil {
+			printWarn("Skipping app %s: %v", app, err)
+			continue
+		}
+		if err := archive.CopyFile(filepath.Join("usr/bin", app), binary); err != nil {
+			return "", err
+		}
+		appCount++
+	}
+	summary = append(summary, fmt.Sprintf("%d apps", appCount))
+
+	script, err := initScript(initOptions{ModulesDir: initramfsModulesDir})
+	if err != nil {
+		return "", err
+	}
+	if err := archive.WriteFile("init", 0755, []byte(script)); err != nil {
+		return "", err
+	}
+
+	if tree := cfg.Initramfs.Tree; tree != "" {
+		if info, err := os.Stat(tree); err != nil || !info.IsDir() {
+			return "", fmt.Errorf("initramfs tree not found: %s", tree)
+		}
+		if _, err := os.Lstat(filepath.Join(tree, "bin", "sh")); err == nil {
+			hasShell = true
+		}
+		if _, err := os.Lstat(filepath.Join(tree, "init")); err == nil {
+			printInfo("Using /init from %s", tree)
+		}
+		if err := archive.AddTree(tree, ""); err != nil {
+			return "", err
+		}
+		summary = append(summary, "tree "+filepath.Base(tree))
+	}
+
+	if !hasShell {
+		printWarn("No busybox or /bin/sh in the initramfs; /init will not run (set rootfs.busybox or --busybox)")
+	}
+	return strings.Join(summary, ", "), nil
+}
+
+// findBuiltModules returns the .ko files below the modules directory
+func findBuiltModules(dir string) ([]string, error) {
+	var modules []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), ".ko") {
+			modules = append(modules, path)
+		}
+		return nil
+	})
+	return modules, err
+}
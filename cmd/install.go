@@ -0,0 +1,297 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var rootfsInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install built modules and apps into the rootfs",
+	Long: `Install the kernel modules, the out-of-tree modules and the apps into the
+rootfs, so they are available in the guest without the 9p share:
+
+  - kernel modules: make modules_install, into /lib/modules/<release>
+  - out-of-tree modules: make M=<module> modules_install, into
+    /lib/modules/<release>/updates
+  - app binaries: /usr/local/bin
+
+modprobe and depmod then work in the guest. By default the disk image is
+rebuilt from the rootfs directory; --in-place writes the files into the
+existing image with debugfs instead, keeping changes made inside the guest.
+
+Examples:
+  elmos rootfs install
+  elmos rootfs install --no-kernel       # Only out-of-tree modules and apps
+  elmos rootfs install --in-place`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		noKernel, _ := cmd.Flags().GetBool("no-kernel")
+		noModules, _ := cmd.Flags().GetBool("no-modules")
+		noApps, _ := cmd.Flags().GetBool("no-apps")
+		opts := installOptions{Kernel: !noKernel, Modules: !noModules, Apps: !noApps}
+		opts.InPlace, _ = cmd.Flags().GetBool("in-place")
+		opts.Size, _ = cmd.Flags().GetString("size")
+		return runRootfsInstall(opts)
+	},
+}
+
+func init() {
+	rootfsCmd.AddCommand(rootfsInstallCmd)
+	rootfsInstallCmd.Flags().Bool("no-kernel", false, "Do not install the kernel's modules")
+	rootfsInstallCmd.Flags().Bool("no-modules", false, "Do not install out-of-tree modules")
+	rootfsInstallCmd.Flags().Bool("no-apps", false, "Do not install apps")
+	rootfsInstallCmd.Flags().Bool("in-place", false, "Update the disk image with debugfs instead of rebuilding it")
+	rootfsInstallCmd.Flags().StringP("size", "s", "", "Disk image size when rebuilding (default: size of the current image)")
+}
+
+// installOptions selects what rootfs install installs and how
+type installOptions struct {
+	Kernel  bool
+	Modules bool
+	Apps    bool
+	InPlace bool
+	Size    string
+}
+
+func runRootfsInstall(opts installOptions) error {
+	cfg := ctx.Config
+
+	rootfsDir := cfg.RootfsDir()
+	diskImage := cfg.DiskImage()
+	_, dirErr := os.Stat(filepath.Join(rootfsDir, "etc"))
+	_, imageErr := os.Stat(diskImage)
+	if opts.InPlace && imageErr != nil {
+		return fmt.Errorf("disk image not found: %s (run 'elmos rootfs create')", diskImage)
+	}
+	if !opts.InPlace && dirErr != nil {
+		return fmt.Errorf("rootfs not found: %s (run 'elmos rootfs create', or use --in-place)", rootfsDir)
+	}
+	// A rebuilt image replaces the file a running VM would keep writing to
+	if imageErr == nil {
+		if err := checkImageIdle(diskImage); err != nil {
+			return err
+		}
+	}
+
+	// Everything is installed into a staging tree first, as the user, and
+	// then copied into the rootfs with the privileges it needs
+	stage := filepath.Join(cfg.StateDir(), "install-"+cfg.RootfsKey())
+	os.RemoveAll(stage)
+	if err := os.MkdirAll(stage, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(stage)
+
+	var summary []string
+	if opts.Kernel {
+		if installed, err := installKernelModules(stage); err != nil {
+			return err
+		} else if installed {
+			summary = append(summary, "kernel modules")
+		}
+	}
+	if opts.Modules {
+		count, err := installOutOfTreeModules(stage)
+		if err != nil {
+			return err
+		}
+		summary = append(summary, fmt.Sprintf("%d modules", count))
+	}
+	if opts.Apps {
+		count, err := installApps(stage)
+		if err != nil {
+			return err
+		}
+		summary = append(summary, fmt.Sprintf("%d apps", count))
+	}
+
+	if entries, _ := os.ReadDir(stage); len(entries) == 0 {
+		printInfo("Nothing to install")
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(stage, "lib", "modules")); err == nil && !hasDepmod() {
+		printInfo("depmod not found on the host; run 'depmod -a' once in the guest")
+	}
+
+	if dirErr == nil {
+		if err := foldStageSymlinks(stage, rootfsDir); err != nil {
+			return err
+		}
+		printStep("Copying into %s...", rootfsDir)
+		cmd := rootfsCommand(rootfsDir, "sh", "-c", `tar -C "$1" -cf - . | tar -C "$2" -xpf - --no-same-owner`, "sh", stage, rootfsDir)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to install into rootfs: %w", err)
+		}
+	}
+
+	if opts.InPlace {
+		printStep("Writing into %s...", diskImage)
+		if err := writeImageTree(diskImage, stage, "/"); err != nil {
+			return err
+		}
+		printSuccess("Installed %s into %s", strings.Join(summary, ", "), diskImage)
+		return nil
+	}
+
+	size := opts.Size
+	if size == "" {
+		size = "5G"
+		if info, err := os.Stat(diskImage); err == nil {
+			size = fmt.Sprintf("%dk", info.Size()/1024)
+		}
+	}
+	if err := buildDiskImage(size); err != nil {
+		return err
+	}
+	printSuccess("Installed %s; disk image rebuilt: %s", strings.Join(summary, ", "), diskImage)
+	return nil
+}
+
+// installKernelModules runs the kernel's modules_install into stage. It
+// reports false if the kernel has no modules built.
+func installKernelModules(stage string) (bool, error) {
+	cfg := ctx.Config
+
+	if _, err := os.Stat(filepath.Join(ctx.KernelDir, "modules.order")); err != nil {
+		printWarn("Kernel modules not built; skipping them (run 'elmos build')")
+		return false, nil
+	}
+
+	printStep("Installing kernel modules...")
+	cmd := exec.Command("make",
+		fmt.Sprintf("-j%d", cfg.Build.Jobs),
+		fmt.Sprintf("ARCH=%s", cfg.Build.Arch),
+		"LLVM=1",
+		fmt.Sprintf("CROSS_COMPILE=%s", cfg.Build.CrossCompile),
+		fmt.Sprintf("INSTALL_MOD_PATH=%s", stage),
+		"modules_install",
+	)
+	cmd.Dir = ctx.KernelDir
+	cmd.Env = ctx.GetMakeEnv()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return false, fmt.Errorf("modules_install failed: %w", err)
+	}
+	return true, nil
+}
+
+// installOutOfTreeModules runs modules_install for every built module in
+// the modules directory and returns how many were installed
+func installOutOfTreeModules(stage string) (int, error) {
+	cfg := ctx.Config
+
+	modules, err := getModules("")
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, modName := range modules {
+		modPath := filepath.Join(cfg.Paths.ModulesDir, modName)
+		if built, _ := findBuiltModules(modPath); len(built) == 0 {
+			continue
+		}
+
+		printStep("Installing module: %s", modName)
+		cmd := exec.Command("make",
+			"-C", ctx.KernelDir,
+			fmt.Sprintf("M=%s", modPath),
+			fmt.Sprintf("ARCH=%s", cfg.Build.Arch),
+			"LLVM=1",
+			fmt.Sprintf("CROSS_COMPILE=%s", cfg.Build.CrossCompile),
+			fmt.Sprintf("INSTALL_MOD_PATH=%s", stage),
+			"modules_install",
+		)
+		cmd.Env = ctx.GetMakeEnv()
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return count, fmt.Errorf("modules_install failed for %s: %w", modName, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// installApps copies built app binaries into usr/local/bin of stage and
+// returns how many were installed
+func installApps(stage string) (int, error) {
+	cfg := ctx.Config
+
+	apps, err := getApps("")
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, app := range apps {
+		binary := filepath.Join(cfg.Paths.AppsDir, app, app)
+		if _, err := os.Stat(binary); err != nil {
+			continue
+		}
+		f, err := openGuestBinary(binary, cfg.Build.Arch)
+		if err != nil {
+			printWarn("Skipping app %s: %v", app, err)
+			continue
+		}
+		f.Close()
+
+		dst := filepath.Join(stage, "usr", "local", "bin", app)
+		if err := copyFile(binary, dst); err != nil {
+			return count, fmt.Errorf("failed to copy %s: %w", app, err)
+		}
+		if err := os.Chmod(dst, 0755); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if count > 0 {
+		printInfo("Installing %d apps into /usr/local/bin", count)
+	}
+	return count, nil
+}
+
+// foldStageSymlinks moves top-level directories of stage that are symlinks
+// in the rootfs (e.g. lib -> usr/lib on a merged-/usr Debian) to their
+// target, so copying stage does not replace the symlinks
+func foldStageSymlinks(stage, rootfsDir string) error {
+	entries, err := os.ReadDir(stage)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join(rootfsDir, entry.Name()))
+		if err != nil || filepath.IsAbs(target) || strings.HasPrefix(filepath.Clean(target), "..") {
+			continue
+		}
+		dst := filepath.Join(stage, target)
+		if _, err := os.Stat(dst); err == nil {
+			return fmt.Errorf("cannot install both /%s and /%s", entry.Name(), target)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(stage, entry.Name()), dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasDepmod reports whether modules_install could run depmod on the host
+func hasDepmod() bool {
+	_, err := exec.LookPath("depmod")
+	return err == nil
+}
@@ -0,0 +1,220 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// lockMode is how a command holds the workspace lock
+type lockMode string
+
+const (
+	// lockShared commands only read the tree and may run together
+	lockShared lockMode = "shared"
+	// lockExclusive commands mutate the tree and must run alone
+	lockExclusive lockMode = "exclusive"
+)
+
+// commandLocks maps command paths (without "elmos ") to the lock they take.
+// Commands not listed, such as status and list commands, take no lock.
+var commandLocks = map[string]lockMode{
+	"init":                   lockExclusive,
+	"image create":           lockExclusive,
+	"image resize":           lockExclusive,
+	"image compact":          lockExclusive,
+	"image snapshot create":  lockExclusive,
+	"image snapshot restore": lockExclusive,
+	"image snapshot delete":  lockExclusive,
+	"image mount":            lockExclusive,
+	"image unmount":          lockExclusive,
+	"repo clone":             lockExclusive,
+	"repo checkout":          lockExclusive,
+	"repo update":            lockExclusive,
+	"repo reset":             lockExclusive,
+	"repo reinit":            lockExclusive,
+	"repo restore":           lockExclusive,
+	"tree add":               lockExclusive,
+	"tree remove":            lockExclusive,
+	"tree use":               lockExclusive,
+	"kernel config":          lockExclusive,
+	"kernel clean":           lockExclusive,
+	"build":                  lockExclusive,
+	"patch apply":            lockExclusive,
+	"patch create":           lockExclusive,
+	"patch refresh":          lockExclusive,
+	"bisect start":           lockExclusive,
+	"bisect reset":           lockExclusive,
+	"rootfs create":          lockExclusive,
+	"rootfs init regen":      lockExclusive,
+	"rootfs apply":           lockExclusive,
+	"rootfs install":         lockExclusive,
+	"rootfs cp":              lockExclusive,
+	"rootfs chroot":          lockExclusive,
+	"rootfs finalize":        lockExclusive,
+	"patch check":            lockShared,
+	"module build":           lockShared,
+	"module clean":           lockShared,
+	"module headers":         lockShared,
+	"app build":              lockShared,
+	"initramfs build":        lockShared,
+	"rootfs cache create":    lockShared,
+	"rootfs ls":              lockShared,
+	"qemu run":               lockShared,
+	"qemu debug":             lockShared,
+}
+
+// lockHolder is one process holding the workspace lock
+type lockHolder struct {
+	PID     int       `json:"pid"`
+	Command string    `json:"command"`
+	Mode    lockMode  `json:"mode"`
+	Started time.Time `json:"started"`
+}
+
+func (h lockHolder) String() string {
+	return fmt.Sprintf("'%s' (PID %d, %s since %s)", h.Command, h.PID, h.Mode, h.Started.Format("15:04:05"))
+}
+
+// heldLock is the mode this process holds, if any
+var heldLock lockMode
+
+func init() {
+	cobra.OnFinalize(releaseLock)
+}
+
+// lockFile returns the workspace lock file
+func lockFile() string {
+	return filepath.Join(ctx.Config.StateDir(), "lock.json")
+}
+
+// acquireCommandLock takes the lock the command needs, if any
+func acquireCommandLock(cmd *cobra.Command, wait bool) error {
+	path := strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")
+	mode, ok := commandLocks[path]
+	if !ok {
+		return nil
+	}
+	command := strings.Join(append([]string{cmd.Root().Name()}, os.Args[1:]...), " ")
+	return acquireLock(mode, command, wait)
+}
+
+// acquireLock adds this process to the holders in the lock file. A conflict
+// with another holder is an error naming it, or with wait, a retry loop.
+func acquireLock(mode lockMode, command string, wait bool) error {
+	announced := false
+	for {
+		holder, err := tryLock(mode, command)
+		if err != nil {
+			return err
+		}
+		if holder == nil {
+			heldLock = mode
+			return nil
+		}
+		if !wait {
+			return fmt.Errorf("workspace is locked by %s; retry with --wait or stop that command", holder)
+		}
+		if !announced {
+			printInfo("Waiting for %s to finish...", holder)
+			announced = true
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// tryLock updates the lock file under flock(2). It drops holders whose
+// process is gone and returns a conflicting holder, or nil once this process
+// has been added.
+func tryLock(mode lockMode, command string) (*lockHolder, error) {
+	holders, save, err := openLockFile()
+	if err != nil {
+		return nil, err
+	}
+
+	var live []lockHolder
+	for _, h := range holders {
+		if h.PID == os.Getpid() {
+			continue
+		}
+		if !processAlive(h.PID) {
+			printInfo("Removed stale lock of %s", h)
+			continue
+		}
+		live = append(live, h)
+	}
+
+	for _, h := range live {
+		if mode == lockExclusive || h.Mode == lockExclusive {
+			return &h, save(live)
+		}
+	}
+
+	live = append(live, lockHolder{PID: os.Getpid(), Command: command, Mode: mode, Started: time.Now()})
+	return nil, save(live)
+}
+
+// releaseLock removes this process from the holders; it runs after every command
+func releaseLock() {
+	if heldLock == "" {
+		return
+	}
+	holders, save, err := openLockFile()
+	if err != nil {
+		return
+	}
+	var rest []lockHolder
+	for _, h := range holders {
+		if h.PID != os.Getpid() {
+			rest = append(rest, h)
+		}
+	}
+	save(rest)
+	heldLock = ""
+}
+
+// openLockFile opens and flocks the lock file, returning its holders and a
+// function that writes the new holders and releases the flock
+func openLockFile() ([]lockHolder, func([]lockHolder) error, error) {
+	path := lockFile()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	var holders []lockHolder
+	if content, err := io.ReadAll(f); err == nil && len(content) > 0 {
+		// A corrupt file is treated as unlocked and rewritten
+		json.Unmarshal(content, &holders)
+	}
+
+	save := func(holders []lockHolder) error {
+		// Closing the file releases the flock
+		defer f.Close()
+		content, err := json.MarshalIndent(holders, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		_, err = f.WriteAt(content, 0)
+		return err
+	}
+	return holders, save, nil
+}
@@ -117,7 +117,7 @@ func runModuleBuild(name string) error {
 		printStep("Building module: %s", modName)
 
 		cmd := exec.Command("make",
-			"-C", cfg.Paths.KernelDir,
+			"-C", ctx.KernelDir,
 			fmt.Sprintf("M=%s", modPath),
 			fmt.Sprintf("ARCH=%s", cfg.Build.Arch),
 			"LLVM=1",
@@ -153,7 +153,7 @@ func runModuleClean(name string) error {
 		printStep("Cleaning module: %s", modName)
 
 		cmd := exec.Command("make",
-			"-C", cfg.Paths.KernelDir,
+			"-C", ctx.KernelDir,
 			fmt.Sprintf("M=%s", modPath),
 			fmt.Sprintf("ARCH=%s", cfg.Build.Arch),
 			"clean",
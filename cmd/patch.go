@@ -0,0 +1,810 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/spf13/cobra"
+
+	"github.com/NguyenTrongPhuc552003/elmos/internal/mbox"
+)
+
+// patchCmd - patch management
+var patchCmd = &cobra.Command{
+	Use:   "patch",
+	Short: "Manage kernel patches",
+	Long:  `Apply and manage kernel patches.`,
+}
+
+var patchApplyCmd = &cobra.Command{
+	Use:   "apply [patch-file]",
+	Short: "Apply a patch file",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		return runPatchApply(args[0])
+	},
+}
+
+var patchListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List available patches with subject, author and touched files",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, _ := cmd.Flags().GetBool("json")
+		return runPatchList(asJSON)
+	},
+}
+
+var patchShowCmd = &cobra.Command{
+	Use:   "show [name]",
+	Short: "Show a patch's metadata, Signed-off-by chain and diffstat",
+	Long: `Show metadata for a single patch. The name may be the file name,
+"<version>/<file name>" or a unique prefix such as "0001".`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, _ := cmd.Flags().GetBool("json")
+		return runPatchShow(args[0], asJSON)
+	},
+}
+
+var patchCreateCmd = &cobra.Command{
+	Use:   "create [rev-range]",
+	Short: "Export kernel commits into the project patch series",
+	Long: `Export commits from the kernel tree as numbered patches into the
+version-matched patches directory (e.g. patches/v6.18/) and append them
+to its series file.
+
+Examples:
+  elmos patch create HEAD~2..HEAD   # Export the last two commits
+  elmos patch create v6.18..HEAD    # Export everything on top of v6.18`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		return runPatchCreate(args[0])
+	},
+}
+
+var patchRefreshCmd = &cobra.Command{
+	Use:   "refresh",
+	Short: "Regenerate series patches from their commits in the kernel tree",
+	Long: `Regenerate every patch in the version-matched series from the kernel
+commit it was applied as, so fixups made in the tree flow back into the
+project. Commits are matched by patch subject.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		base, _ := cmd.Flags().GetString("base")
+		return runPatchRefresh(base)
+	},
+}
+
+var patchCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Report whether the patch series applies to other kernel tags",
+	Long: `Try the version-matched patch series against one or more kernel tags,
+each in a temporary git worktree, and print a matrix of results:
+
+  clean     applies as-is
+  fuzz      applies only with a 3-way merge or reduced context
+  conflict  does not apply
+  upstream  already present in the tag (same patch-id or reverse-applies)
+
+Example:
+  elmos patch check --against v6.19-rc1,v6.19`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		tags, _ := cmd.Flags().GetStringSlice("against")
+		if len(tags) == 0 {
+			return fmt.Errorf("no tags given (use --against <tag>[,<tag>...])")
+		}
+		return runPatchCheck(tags)
+	},
+}
+
+func init() {
+	patchCmd.AddCommand(patchApplyCmd)
+	patchCmd.AddCommand(patchListCmd)
+	patchCmd.AddCommand(patchShowCmd)
+	patchCmd.AddCommand(patchCreateCmd)
+	patchCmd.AddCommand(patchRefreshCmd)
+	patchCmd.AddCommand(patchCheckCmd)
+
+	patchListCmd.Flags().Bool("json", false, "Output as JSON")
+	patchShowCmd.Flags().Bool("json", false, "Output as JSON")
+	patchCheckCmd.Flags().StringSlice("against", nil, "Comma-separated kernel tags to check against")
+	patchRefreshCmd.Flags().String("base", "", "Only search commits after this revision (default: last 1000 commits)")
+}
+
+func runPatchApply(patchFile string) error {
+	cfg := ctx.Config
+
+	// Resolve patch path
+	fullPath := patchFile
+	if patchFile[0] != '/' {
+		fullPath = fmt.Sprintf("%s/%s", cfg.Paths.ProjectRoot, patchFile)
+	}
+
+	// Check file exists
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		return fmt.Errorf("patch file not found: %s", fullPath)
+	}
+
+	printStep("Checking patch applicability...")
+
+	// Clean any aborted am session
+	exec.Command("git", "am", "--abort").Run()
+
+	// Test with dry-run
+	testCmd := exec.Command("git", "am", "--3way", "--dry-run", fullPath)
+	testCmd.Dir = ctx.KernelDir
+	if err := testCmd.Run(); err != nil {
+		printWarn("git am dry-run failed, trying git apply...")
+		testCmd2 := exec.Command("git", "apply", "--3way", "--check", fullPath)
+		testCmd2.Dir = ctx.KernelDir
+		if err := testCmd2.Run(); err != nil {
+			return fmt.Errorf("patch cannot be applied cleanly")
+		}
+	}
+
+	printStep("Applying patch...")
+
+	applyCmd := exec.Command("git", "am", "--3way", "--signoff", fullPath)
+	applyCmd.Dir = ctx.KernelDir
+	applyCmd.Stdout = os.Stdout
+	applyCmd.Stderr = os.Stderr
+
+	if err := applyCmd.Run(); err != nil {
+		printError("Patch application failed")
+		printInfo("Run 'git am --abort' to cancel, or 'git am --continue' after resolving")
+		return err
+	}
+
+	printSuccess("Patch applied successfully")
+	return nil
+}
+
+// patchSeries is a version directory of patches with their parsed metadata
+type patchSeries struct {
+	Version string        `json:"version"`
+	Patches []*mbox.Patch `json:"patches"`
+}
+
+// loadAllSeries parses every version directory under the patches directory
+func loadAllSeries() ([]patchSeries, error) {
+	patchesDir := ctx.Config.Paths.PatchesDir
+
+	entries, err := os.ReadDir(patchesDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read patches directory: %w", err)
+	}
+
+	var all []patchSeries
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(patchesDir, entry.Name())
+		names, err := loadSeries(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read series in %s: %w", dir, err)
+		}
+
+		series := patchSeries{Version: entry.Name()}
+		for _, name := range names {
+			meta, err := mbox.ParseFile(filepath.Join(dir, name))
+			if err != nil {
+				printWarn("%v", err)
+				meta = &mbox.Patch{Name: name}
+			}
+			series.Patches = append(series.Patches, meta)
+		}
+		all = append(all, series)
+	}
+
+	return all, nil
+}
+
+func runPatchList(asJSON bool) error {
+	all, err := loadAllSeries()
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(all)
+	}
+
+	if len(all) == 0 {
+		printInfo("No patches found in %s", ctx.Config.Paths.PatchesDir)
+		return nil
+	}
+
+	fmt.Println("Available patches:")
+	for _, series := range all {
+		fmt.Println()
+		fmt.Printf("  %s/\n", accentStyle.Render(series.Version))
+		for _, p := range series.Patches {
+			fmt.Printf("    %s\n", p.Name)
+			if p.Subject == "" {
+				continue
+			}
+			fmt.Printf("      %s\n", p.Subject)
+			fmt.Printf("      %s, %s\n", p.From, p.Date)
+			fmt.Printf("      %d file(s), %s %s\n", len(p.Files),
+				successStyle.Render(fmt.Sprintf("+%d", p.Insertions())),
+				errorStyle.Render(fmt.Sprintf("-%d", p.Deletions())))
+			for _, f := range p.Files {
+				fmt.Printf("        %s\n", f.Path)
+			}
+		}
+	}
+
+	return nil
+}
+
+// findPatch resolves a patch by file name, "version/name" or unique name prefix
+func findPatch(name string) (*mbox.Patch, string, error) {
+	all, err := loadAllSeries()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var matches []string
+	var found *mbox.Patch
+	for _, series := range all {
+		for _, p := range series.Patches {
+			qualified := series.Version + "/" + p.Name
+			if name == p.Name || name == qualified {
+				return p, series.Version, nil
+			}
+			if strings.HasPrefix(p.Name, name) || strings.HasPrefix(qualified, name) {
+				matches = append(matches, qualified)
+				found = p
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, "", fmt.Errorf("patch not found: %s", name)
+	case 1:
+		version, _, _ := strings.Cut(matches[0], "/")
+		return found, version, nil
+	default:
+		return nil, "", fmt.Errorf("ambiguous patch name %q, matches: %s", name, strings.Join(matches, ", "))
+	}
+}
+
+func runPatchShow(name string, asJSON bool) error {
+	p, version, err := findPatch(name)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(p)
+	}
+
+	fmt.Printf("Patch:   %s/%s\n", version, p.Name)
+	fmt.Printf("Subject: %s\n", accentStyle.Render(p.Subject))
+	fmt.Printf("From:    %s\n", p.From)
+	fmt.Printf("Date:    %s\n", p.Date)
+	if len(p.SignedOffBy) > 0 {
+		fmt.Println("Signed-off-by:")
+		for _, sob := range p.SignedOffBy {
+			fmt.Printf("  %s\n", sob)
+		}
+	}
+
+	fmt.Println()
+	width := 0
+	for _, f := range p.Files {
+		width = max(width, len(f.Path))
+	}
+	for _, f := range p.Files {
+		fmt.Printf(" %-*s | %4d %s%s\n", width, f.Path, f.Insertions+f.Deletions,
+			successStyle.Render(strings.Repeat("+", min(f.Insertions, 40))),
+			errorStyle.Render(strings.Repeat("-", min(f.Deletions, 40))))
+	}
+	fmt.Printf(" %d file(s) changed, %d insertions(+), %d deletions(-)\n",
+		len(p.Files), p.Insertions(), p.Deletions())
+
+	return nil
+}
+
+// seriesFileName is the file listing the patch order within a version directory
+const seriesFileName = "series"
+
+// refreshSearchDepth limits how far back refresh looks when no base is given
+const refreshSearchDepth = 1000
+
+// patchSeriesDir returns the patches directory matching the kernel tree version
+func patchSeriesDir() (string, error) {
+	ver, err := ctx.KernelVersion()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(ctx.Config.Paths.PatchesDir, "v"+ver), nil
+}
+
+// loadSeries returns the ordered patch file names of a series directory.
+// The series file is authoritative; without one, *.patch files are used in name order.
+func loadSeries(dir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(dir, seriesFileName))
+	if err == nil {
+		defer f.Close()
+		var names []string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			names = append(names, line)
+		}
+		return names, scanner.Err()
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*.patch"))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(matches))
+	for _, m := range matches {
+		names = append(names, filepath.Base(m))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// writeSeries writes the series file for a directory
+func writeSeries(dir string, names []string) error {
+	content := strings.Join(names, "\n")
+	if len(names) > 0 {
+		content += "\n"
+	}
+	return os.WriteFile(filepath.Join(dir, seriesFileName), []byte(content), 0644)
+}
+
+func runPatchCreate(revRange string) error {
+	dir, err := patchSeriesDir()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create patches directory: %w", err)
+	}
+
+	series, err := loadSeries(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read series: %w", err)
+	}
+
+	printStep("Exporting %s into %s...", revRange, dir)
+
+	// --no-numbered keeps subjects as "[PATCH]" so refresh regenerates identical files
+	out, err := gitOutput("format-patch", "--no-numbered",
+		fmt.Sprintf("--start-number=%d", len(series)+1),
+		"-o", dir,
+		revRange,
+	)
+	if err != nil {
+		return fmt.Errorf("git format-patch failed: %w", err)
+	}
+	if out == "" {
+		printInfo("No commits in %s", revRange)
+		return nil
+	}
+
+	for _, path := range strings.Split(out, "\n") {
+		name := filepath.Base(strings.TrimSpace(path))
+		if !slices.Contains(series, name) {
+			series = append(series, name)
+		}
+		printInfo("  %s", name)
+	}
+
+	if err := writeSeries(dir, series); err != nil {
+		return fmt.Errorf("failed to update series: %w", err)
+	}
+
+	printSuccess("Series updated (%d patches)", len(series))
+	return nil
+}
+
+func runPatchRefresh(base string) error {
+	dir, err := patchSeriesDir()
+	if err != nil {
+		return err
+	}
+
+	series, err := loadSeries(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read series: %w", err)
+	}
+	if len(series) == 0 {
+		printInfo("No patches in %s", dir)
+		return nil
+	}
+
+	commits, err := commitsBySubject(base)
+	if err != nil {
+		return err
+	}
+
+	printStep("Refreshing %d patches in %s...", len(series), dir)
+
+	missing := 0
+	for _, name := range series {
+		path := filepath.Join(dir, name)
+		meta, err := mbox.ParseFile(path)
+		if err != nil {
+			printWarn("%v", err)
+			missing++
+			continue
+		}
+
+		sha, ok := commits[meta.Subject]
+		if !ok {
+			printWarn("%s: no commit found for %q", name, meta.Subject)
+			missing++
+			continue
+		}
+
+		cmd := exec.Command("git", "format-patch", "-1", "--stdout", sha)
+		cmd.Dir = ctx.KernelDir
+		fresh, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("git format-patch %s failed: %w", sha, err)
+		}
+
+		old, _ := os.ReadFile(path)
+		if bytes.Equal(stripFromLine(old), stripFromLine(fresh)) {
+			fmt.Printf("  = %s\n", name)
+			continue
+		}
+
+		if err := os.WriteFile(path, fresh, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		fmt.Printf("  ~ %s (from %s)\n", name, sha[:12])
+	}
+
+	if err := writeSeries(dir, series); err != nil {
+		return fmt.Errorf("failed to update series: %w", err)
+	}
+
+	if missing > 0 {
+		printWarn("%d patch(es) could not be matched to a commit", missing)
+		return nil
+	}
+
+	printSuccess("Patches refreshed")
+	return nil
+}
+
+// commitsBySubject maps commit subjects to their most recent commit hash
+func commitsBySubject(base string) (map[string]string, error) {
+	args := []string{"log", "--no-merges", "--format=%H%x00%s"}
+	if base != "" {
+		args = append(args, base+"..HEAD")
+	} else {
+		args = append(args, fmt.Sprintf("--max-count=%d", refreshSearchDepth), "HEAD")
+	}
+
+	out, err := gitOutput(args...)
+	if err != nil {
+		return nil, fmt.Errorf("git log failed: %w", err)
+	}
+
+	commits := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		sha, subject, ok := strings.Cut(line, "\x00")
+		if !ok {
+			continue
+		}
+		// git log lists newest first; keep the first occurrence
+		if _, seen := commits[subject]; !seen {
+			commits[subject] = sha
+		}
+	}
+	return commits, nil
+}
+
+// appliedPatches returns the series patches already present in the kernel tree,
+// detected by checking whether each one reverse-applies cleanly
+func appliedPatches(dir string, series []string) []string {
+	var applied []string
+	for _, name := range series {
+		cmd := exec.Command("git", "apply", "--check", "--reverse", filepath.Join(dir, name))
+		cmd.Dir = ctx.KernelDir
+		if cmd.Run() == nil {
+			applied = append(applied, name)
+		}
+	}
+	return applied
+}
+
+// applyPatchSeries applies the version-matched series to the kernel tree with
+// git am, skipping patches that are already present. It returns the names of
+// the patches it applied.
+func applyPatchSeries() ([]string, error) {
+	dir, err := patchSeriesDir()
+	if err != nil {
+		return nil, err
+	}
+
+	series, err := loadSeries(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			printInfo("No patch series for %s", filepath.Base(dir))
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read series: %w", err)
+	}
+	if len(series) == 0 {
+		printInfo("No patch series for %s", filepath.Base(dir))
+		return nil, nil
+	}
+
+	present := appliedPatches(dir, series)
+
+	var applied []string
+	for _, name := range series {
+		if slices.Contains(present, name) {
+			continue
+		}
+
+		printStep("Applying %s...", name)
+		if err := runGitCommand("am", "--3way", "--quiet", filepath.Join(dir, name)); err != nil {
+			runGitCommand("am", "--abort")
+			return applied, fmt.Errorf("failed to apply %s: %w", name, err)
+		}
+		applied = append(applied, name)
+	}
+
+	return applied, nil
+}
+
+// Patch applicability states reported by 'patch check'
+const (
+	patchClean    = "clean"
+	patchFuzz     = "fuzz"
+	patchConflict = "conflict"
+	patchUpstream = "upstream"
+)
+
+// patchIDSearchDepth limits how many commits per tag are scanned for matching patch-ids
+const patchIDSearchDepth = 500
+
+func runPatchCheck(tags []string) error {
+	dir, err := patchSeriesDir()
+	if err != nil {
+		return err
+	}
+
+	series, err := loadSeries(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read series: %w", err)
+	}
+	if len(series) == 0 {
+		printInfo("No patches in %s", dir)
+		return nil
+	}
+
+	results := make(map[string][]string, len(tags))
+	for _, tag := range tags {
+		printStep("Checking %d patches against %s...", len(series), tag)
+		states, err := checkSeriesAgainst(dir, series, tag)
+		if err != nil {
+			return err
+		}
+		results[tag] = states
+	}
+
+	nameWidth := len("PATCH")
+	for _, name := range series {
+		nameWidth = max(nameWidth, len(name))
+	}
+	colWidth := len(patchConflict)
+	for _, tag := range tags {
+		colWidth = max(colWidth, len(tag))
+	}
+
+	fmt.Println()
+	fmt.Printf("  %-*s", nameWidth, "PATCH")
+	for _, tag := range tags {
+		fmt.Printf("  %-*s", colWidth, tag)
+	}
+	fmt.Println()
+	fmt.Println("  " + strings.Repeat("-", nameWidth+len(tags)*(colWidth+2)))
+
+	for i, name := range series {
+		fmt.Printf("  %-*s", nameWidth, name)
+		for _, tag := range tags {
+			state := results[tag][i]
+			fmt.Printf("  %s", patchStateStyle(state).Render(fmt.Sprintf("%-*s", colWidth, state)))
+		}
+		fmt.Println()
+	}
+	fmt.Println()
+
+	return nil
+}
+
+// checkSeriesAgainst applies the series in order to a temporary worktree of tag
+// and returns the state of each patch
+func checkSeriesAgainst(dir string, series []string, tag string) ([]string, error) {
+	// The worktree lives on the case-sensitive kernel volume, not in $TMPDIR
+	worktree, err := os.MkdirTemp(ctx.Config.Image.MountPoint, "patch-check-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create worktree directory: %w", err)
+	}
+	defer os.RemoveAll(worktree)
+
+	if _, err := gitOutput("worktree", "add", "--detach", "--quiet", worktree, tag); err != nil {
+		return nil, fmt.Errorf("failed to create worktree for %s: %w", tag, err)
+	}
+	defer gitOutput("worktree", "remove", "--force", worktree)
+
+	states := make([]string, 0, len(series))
+	for _, name := range series {
+		path := filepath.Join(dir, name)
+		state := checkPatchIn(worktree, path, tag)
+		states = append(states, state)
+		if ctx.Verbose {
+			printInfo("  %s: %s", name, state)
+		}
+	}
+	return states, nil
+}
+
+// checkPatchIn classifies a patch against a worktree, committing it when it fits
+// so that later patches in the series are checked on top of it
+func checkPatchIn(worktree, path, tag string) string {
+	git := func(args ...string) bool {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = worktree
+		return cmd.Run() == nil
+	}
+	apply := func(args ...string) bool {
+		return git(append(append([]string{"apply"}, args...), path)...)
+	}
+	commit := func() {
+		git("-c", "user.name=elmos", "-c", "user.email=elmos@localhost",
+			"commit", "--quiet", "--no-verify", "-m", filepath.Base(path))
+	}
+
+	if apply("--check", "--reverse") || isPatchUpstream(path, tag) {
+		return patchUpstream
+	}
+	if apply("--check") {
+		apply("--index")
+		commit()
+		return patchClean
+	}
+
+	// --3way --check only proves the preimages are known; the merge itself
+	// may still conflict, so try it for real and roll back on failure
+	if apply("--3way", "--check") {
+		if apply("--3way") {
+			commit()
+			return patchFuzz
+		}
+		git("reset", "--hard", "--quiet")
+		git("clean", "-fdq")
+	}
+	if apply("--check", "-C1") {
+		apply("--index", "-C1")
+		commit()
+		return patchFuzz
+	}
+	return patchConflict
+}
+
+// isPatchUpstream reports whether a commit reachable from tag has the same
+// stable patch-id as the patch file
+func isPatchUpstream(path, tag string) bool {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	id := patchIDs(content)
+	if len(id) != 1 {
+		return false
+	}
+
+	meta, err := mbox.Parse(bytes.NewReader(content))
+	if err != nil || len(meta.Files) == 0 {
+		return false
+	}
+	files := meta.Paths()
+
+	args := []string{"log", "-p", "--no-merges", "--format=commit %H",
+		fmt.Sprintf("--max-count=%d", patchIDSearchDepth), tag, "--"}
+	cmd := exec.Command("git", append(args, files...)...)
+	cmd.Dir = ctx.KernelDir
+	history, err := cmd.Output()
+	if err != nil {
+		return false
+	}
+
+	for _, upstream := range patchIDs(history) {
+		if upstream == id[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// patchIDs returns the stable patch-ids of the patches in input
+func patchIDs(input []byte) []string {
+	cmd := exec.Command("git", "patch-id", "--stable")
+	cmd.Dir = ctx.KernelDir
+	cmd.Stdin = bytes.NewReader(input)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+
+	var ids []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if id, _, ok := strings.Cut(line, " "); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// patchStateStyle returns the output style for a patch check state
+func patchStateStyle(state string) lipgloss.Style {
+	switch state {
+	case patchClean:
+		return successStyle
+	case patchFuzz:
+		return warnStyle
+	case patchUpstream:
+		return infoStyle
+	default:
+		return errorStyle
+	}
+}
+
+// stripFromLine drops the leading "From <sha> <date>" mbox separator, which
+// changes whenever a patch is re-applied even if its content is identical
+func stripFromLine(patch []byte) []byte {
+	if bytes.HasPrefix(patch, []byte("From ")) {
+		if i := bytes.IndexByte(patch, '\n'); i >= 0 {
+			return patch[i+1:]
+		}
+	}
+	return patch
+}
@@ -2,11 +2,13 @@
 package cmd
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -27,7 +29,7 @@ var qemuRunCmd = &cobra.Command{
 		}
 		debug, _ := cmd.Flags().GetBool("debug")
 		verbose, _ := cmd.Flags().GetBool("verbose")
-		return runQEMU(debug, verbose)
+		return runQEMU(debug, verbose, initrdFromFlags(cmd))
 	},
 }
 
@@ -39,7 +41,7 @@ var qemuDebugCmd = &cobra.Command{
 			return err
 		}
 		verbose, _ := cmd.Flags().GetBool("verbose")
-		return runQEMU(true, verbose)
+		return runQEMU(true, verbose, initrdFromFlags(cmd))
 	},
 }
 
@@ -59,6 +61,16 @@ func init() {
 	qemuRunCmd.Flags().BoolP("debug", "d", false, "Enable GDB stub")
 	qemuRunCmd.Flags().BoolP("verbose", "g", false, "Graphical mode (window)")
 	qemuDebugCmd.Flags().BoolP("verbose", "g", false, "Graphical mode (window)")
+	qemuRunCmd.Flags().Bool("initrd", false, "Boot the initramfs from 'elmos initramfs build' instead of the disk image")
+	qemuDebugCmd.Flags().Bool("initrd", false, "Boot the initramfs from 'elmos initramfs build' instead of the disk image")
+}
+
+// initrdFromFlags returns the initramfs to boot with --initrd, or ""
+func initrdFromFlags(cmd *cobra.Command) string {
+	if initrd, _ := cmd.Flags().GetBool("initrd"); initrd {
+		return initramfsPath(ctx.Config)
+	}
+	return ""
 }
 
 // QEMUConfig holds architecture-specific QEMU settings
@@ -94,7 +106,9 @@ var qemuArchConfigs = map[string]QEMUArchConfig{
 	},
 }
 
-func runQEMU(debug, graphical bool) error {
+// runQEMU boots the built kernel with the disk image, or with initrd as
+// the root filesystem when it is set
+func runQEMU(debug, graphical bool, initrd string) error {
 	cfg := ctx.Config
 
 	// Get arch-specific config
@@ -114,9 +128,19 @@ func runQEMU(debug, graphical bool) error {
 		return fmt.Errorf("kernel image not found: %s (run 'elmos build')", kernelImage)
 	}
 
-	// Check disk image
-	if _, err := os.Stat(cfg.Paths.DiskImage); os.IsNotExist(err) {
-		return fmt.Errorf("disk image not found: %s (run 'elmos rootfs create')", cfg.Paths.DiskImage)
+	// Check disk image or initramfs
+	if initrd != "" {
+		if _, err := os.Stat(initrd); os.IsNotExist(err) {
+			return fmt.Errorf("initramfs not found: %s (run 'elmos initramfs build')", initrd)
+		}
+	} else if _, err := os.Stat(cfg.DiskImage()); os.IsNotExist(err) {
+		if _, err := os.Stat(cfg.Paths.DiskImage); err == nil {
+			return fmt.Errorf("disk image not found: %s (run 'elmos rootfs create', or rename %s if it is a %s image)",
+				cfg.DiskImage(), cfg.Paths.DiskImage, cfg.Build.Arch)
+		}
+		return fmt.Errorf("disk image not found: %s (run 'elmos rootfs create')", cfg.DiskImage())
+	} else if err := checkImageArch(cfg.DiskImage()); err != nil {
+		return err
 	}
 
 	// Prepare modules sync script
@@ -130,36 +154,23 @@ func runQEMU(debug, graphical bool) error {
 	}
 
 	// Build QEMU command
-	args := []string{
-		"-m", cfg.QEMU.Memory,
-		"-smp", fmt.Sprintf("%d", cfg.QEMU.SMP),
-		"-kernel", kernelImage,
-		"-machine", archCfg.Machine,
-	}
+	args := qemuMachineArgs(archCfg, kernelImage)
 
-	if archCfg.CPU != "" {
-		args = append(args, "-cpu", archCfg.CPU)
-	}
-
-	if archCfg.BIOS != "" {
-		args = append(args, "-bios", "default")
+	// Root filesystem and networking
+	appendStr := qemuRootAppend
+	if initrd != "" {
+		args = append(args, "-initrd", initrd)
+		appendStr = qemuInitrdAppend
+	} else {
+		args = append(args, "-drive", fmt.Sprintf("file=%s,format=raw,if=virtio", cfg.DiskImage()))
 	}
-
-	// Disk and networking
 	args = append(args,
-		"-drive", fmt.Sprintf("file=%s,format=raw,if=virtio", cfg.Paths.DiskImage),
 		"-device", "virtio-net-device,netdev=net0",
 		"-netdev", "user,id=net0,hostfwd=tcp::2222-:22",
 	)
 
-	// 9p share for modules
-	args = append(args,
-		"-fsdev", fmt.Sprintf("local,id=moddev,path=%s,security_model=none", cfg.Paths.ModulesDir),
-		"-device", "virtio-9p-pci,fsdev=moddev,mount_tag=modules_mount",
-	)
-
-	// Boot parameters
-	appendStr := "root=/dev/vda rw init=/init earlycon"
+	// 9p share for modules and the guest.mounts shares
+	args = append(args, guestShareArgs()...)
 
 	// Display mode
 	if graphical {
@@ -189,6 +200,15 @@ func runQEMU(debug, graphical bool) error {
 		args = append(args, "-s", "-S")
 	}
 
+	// Control socket for 'elmos qemu ctl'
+	qmpArgs, err := qmpLaunchArgs()
+	if err != nil {
+		return err
+	}
+	args = append(args, qmpArgs...)
+	defer os.Remove(cfg.QMPSocket())
+	printInfo("Control socket: %s ('elmos qemu ctl')", cfg.QMPSocket())
+
 	// Execute
 	printInfo("Command: %s %v", archCfg.Binary, args)
 	cmd := exec.Command(archCfg.Binary, args...)
@@ -199,6 +219,195 @@ func runQEMU(debug, graphical bool) error {
 	return cmd.Run()
 }
 
+// qemuRootAppend is the kernel command line for booting the rootfs disk image
+const qemuRootAppend = "root=/dev/vda rw init=/init earlycon"
+
+// qemuInitrdAppend is the kernel command line for booting an initramfs
+const qemuInitrdAppend = "rdinit=/init earlycon"
+
+// qemuMachineArgs returns the memory, CPU, machine and kernel arguments
+// shared by every QEMU launch
+func qemuMachineArgs(archCfg QEMUArchConfig, kernelImage string) []string {
+	cfg := ctx.Config
+
+	args := []string{
+		"-m", cfg.QEMU.Memory,
+		"-smp", fmt.Sprintf("%d", cfg.QEMU.SMP),
+		"-kernel", kernelImage,
+		"-machine", archCfg.Machine,
+	}
+
+	if archCfg.CPU != "" {
+		args = append(args, "-cpu", archCfg.CPU)
+	}
+
+	if archCfg.BIOS != "" {
+		args = append(args, "-bios", "default")
+	}
+
+	return args
+}
+
+// Headless boot outcomes
+const (
+	bootSucceeded = "success"
+	bootFailed    = "failure"
+	bootTimedOut  = "timeout"
+)
+
+// bootPanicMarkers are serial console lines that mean the kernel crashed
+var bootPanicMarkers = []string{
+	"Kernel panic - not syncing",
+	"Unable to handle kernel",
+	"Oops:",
+	"BUG: ",
+}
+
+// headlessBoot describes an unattended QEMU boot that watches the serial console
+type headlessBoot struct {
+	// Disk is the raw disk image attached as /dev/vda
+	Disk string
+	// Snapshot discards guest writes to the disk
+	Snapshot bool
+	// Success and Failure are substrings searched for in each console line
+	Success []string
+	Failure []string
+	Timeout time.Duration
+	// LogPath receives the full serial console output
+	LogPath string
+	// Shutdown waits for the guest to power off after the success marker
+	// instead of stopping QEMU, so its writes reach the disk
+	Shutdown bool
+}
+
+// headlessResult is the outcome of a headless boot
+type headlessResult struct {
+	Outcome string
+	// Line is the console line that decided the outcome
+	Line string
+}
+
+// runHeadlessBoot boots the built kernel without a display, copying the serial
+// console to a log until a success or failure marker appears, QEMU exits or
+// the timeout expires. QEMU is stopped once the outcome is known, or with
+// Shutdown, after a success, once the guest powers off.
+func runHeadlessBoot(boot headlessBoot) (*headlessResult, error) {
+	cfg := ctx.Config
+
+	archCfg, ok := qemuArchConfigs[cfg.Build.Arch]
+	if !ok {
+		return nil, fmt.Errorf("unsupported architecture for QEMU: %s", cfg.Build.Arch)
+	}
+	if _, err := exec.LookPath(archCfg.Binary); err != nil {
+		return nil, fmt.Errorf("QEMU not found: %s (run 'brew install qemu')", archCfg.Binary)
+	}
+
+	if err := checkImageArch(boot.Disk); err != nil {
+		return nil, err
+	}
+
+	args := qemuMachineArgs(archCfg, ctx.GetKernelImage())
+	drive := fmt.Sprintf("file=%s,format=raw,if=virtio", boot.Disk)
+	if boot.Snapshot {
+		drive += ",snapshot=on"
+	}
+	args = append(args,
+		"-drive", drive,
+		"-display", "none",
+		"-serial", "stdio",
+		"-monitor", "none",
+		"-no-reboot",
+		"-append", fmt.Sprintf("%s console=%s panic=-1", qemuRootAppend, archCfg.Console),
+	)
+	qmpArgs, err := qmpLaunchArgs()
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, qmpArgs...)
+	defer os.Remove(cfg.QMPSocket())
+
+	logFile, err := os.Create(boot.LogPath)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(archCfg.Binary, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start QEMU: %w", err)
+	}
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			lines <- strings.TrimRight(scanner.Text(), "\r")
+		}
+	}()
+
+	result := &headlessResult{Outcome: bootTimedOut}
+	timeout := time.After(boot.Timeout)
+watch:
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				if result.Outcome != bootSucceeded {
+					// QEMU exited (-no-reboot) without a success marker
+					result.Outcome = bootFailed
+				}
+				break watch
+			}
+			fmt.Fprintln(logFile, line)
+			if result.Outcome == bootSucceeded {
+				// Shutting down
+				continue
+			}
+			if containsAny(line, boot.Failure) {
+				result.Outcome, result.Line = bootFailed, line
+				break watch
+			}
+			if containsAny(line, boot.Success) {
+				result.Outcome, result.Line = bootSucceeded, line
+				if !boot.Shutdown {
+					break watch
+				}
+			}
+		case <-timeout:
+			if result.Outcome == bootSucceeded {
+				result.Outcome, result.Line = bootTimedOut, "the guest did not power off"
+			}
+			break watch
+		}
+	}
+
+	_ = cmd.Process.Kill()
+	// Drain remaining output so the reader goroutine can finish
+	for line := range lines {
+		fmt.Fprintln(logFile, line)
+	}
+	_ = cmd.Wait()
+
+	return result, nil
+}
+
+// containsAny reports whether s contains any of the substrings
+func containsAny(s string, substrs []string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
 func prepareModulesSync() error {
 	cfg := ctx.Config
 	syncPath := fmt.Sprintf("%s/guesync.sh", cfg.Paths.ModulesDir)
@@ -239,7 +448,7 @@ func checkDebugConfig() error {
 	// if we can't easily parse it.
 	// Since we are in Go, we could read .config and check lines.
 
-	configFile := filepath.Join(ctx.Config.Paths.KernelDir, ".config")
+	configFile := filepath.Join(ctx.KernelDir, ".config")
 	content, err := os.ReadFile(configFile)
 	if err != nil {
 		return err
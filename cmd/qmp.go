@@ -0,0 +1,272 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/NguyenTrongPhuc552003/elmos/internal/qmp"
+)
+
+var qemuCtlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Control the running VM over QMP",
+	Long: `Control the VM started by 'elmos qemu run' (or a headless boot) through its
+QMP socket, from another terminal.
+
+Examples:
+  elmos qemu ctl status
+  elmos qemu ctl pause
+  elmos qemu ctl screendump screen.png
+  elmos qemu ctl hmp "info registers"`,
+}
+
+var qemuCtlStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show whether the VM is running or paused",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runQMPStatus(qmpTimeoutFlag(cmd))
+	},
+}
+
+var qemuCtlPauseCmd = &cobra.Command{
+	Use:   "pause",
+	Short: "Stop the guest's CPUs",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runQMPAction(qmpTimeoutFlag(cmd), qmpAction{Command: "stop", Event: "STOP", Done: "VM paused", Skip: qmpPaused})
+	},
+}
+
+var qemuCtlResumeCmd = &cobra.Command{
+	Use:   "resume",
+	Short: "Resume a paused guest",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runQMPAction(qmpTimeoutFlag(cmd), qmpAction{Command: "cont", Event: "RESUME", Done: "VM resumed", Skip: qmpRunning})
+	},
+}
+
+var qemuCtlResetCmd = &cobra.Command{
+	Use:   "reset",
+	Short: "Reset the VM, like the reset button",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runQMPAction(qmpTimeoutFlag(cmd), qmpAction{Command: "system_reset", Event: "RESET", Done: "VM reset"})
+	},
+}
+
+var qemuCtlPowerdownCmd = &cobra.Command{
+	Use:   "powerdown",
+	Short: "Press the power button; the guest decides whether to shut down",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runQMPAction(qmpTimeoutFlag(cmd), qmpAction{Command: "system_powerdown", Event: "POWERDOWN", Done: "Power button pressed"})
+	},
+}
+
+var qemuCtlQuitCmd = &cobra.Command{
+	Use:   "quit",
+	Short: "Stop QEMU immediately",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runQMPAction(qmpTimeoutFlag(cmd), qmpAction{Command: "quit", Event: "SHUTDOWN", Done: "QEMU stopped"})
+	},
+}
+
+var qemuCtlScreendumpCmd = &cobra.Command{
+	Use:   "screendump <file>",
+	Short: "Save the display as PPM, or PNG for a .png file",
+	Long: `Save the VM's display to a file. This needs a graphical console
+('elmos qemu run -g'); the serial console cannot be captured.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runQMPScreendump(qmpTimeoutFlag(cmd), args[0])
+	},
+}
+
+var qemuCtlHMPCmd = &cobra.Command{
+	Use:   `hmp "<command>"`,
+	Short: "Run a human monitor command and print its output",
+	Long: `Run a command of QEMU's human monitor, the one 'Ctrl-a c' opens on the
+serial console, e.g. "info registers", "info mtree" or "sendkey ctrl-alt-f2".`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runQMPHMP(qmpTimeoutFlag(cmd), strings.Join(args, " "))
+	},
+}
+
+func init() {
+	qemuCmd.AddCommand(qemuCtlCmd)
+	qemuCtlCmd.AddCommand(qemuCtlStatusCmd)
+	qemuCtlCmd.AddCommand(qemuCtlPauseCmd)
+	qemuCtlCmd.AddCommand(qemuCtlResumeCmd)
+	qemuCtlCmd.AddCommand(qemuCtlResetCmd)
+	qemuCtlCmd.AddCommand(qemuCtlPowerdownCmd)
+	qemuCtlCmd.AddCommand(qemuCtlQuitCmd)
+	qemuCtlCmd.AddCommand(qemuCtlScreendumpCmd)
+	qemuCtlCmd.AddCommand(qemuCtlHMPCmd)
+
+	qemuCtlCmd.PersistentFlags().Duration("timeout", 10*time.Second, "Time limit for QEMU to answer")
+}
+
+// qmpTimeoutFlag returns the --timeout of a ctl subcommand
+func qmpTimeoutFlag(cmd *cobra.Command) time.Duration {
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	return timeout
+}
+
+// qmpLaunchArgs returns the QEMU arguments serving QMP on the workspace's
+// control socket, removing a socket left by a QEMU that did not exit cleanly
+func qmpLaunchArgs() ([]string, error) {
+	socket := ctx.Config.QMPSocket()
+	if conn, err := net.DialTimeout("unix", socket, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a VM is already running with control socket %s (stop it with 'elmos qemu ctl quit')", socket)
+	}
+	os.Remove(socket)
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		return nil, err
+	}
+	// QEMU option values escape commas by doubling them
+	return []string{"-qmp", fmt.Sprintf("unix:%s,server=on,wait=off", strings.ReplaceAll(socket, ",", ",,"))}, nil
+}
+
+// dialQMP connects to the running VM; the timeout bounds the whole session
+func dialQMP(timeout time.Duration) (*qmp.Client, error) {
+	socket := ctx.Config.QMPSocket()
+	if _, err := os.Stat(socket); err != nil {
+		return nil, fmt.Errorf("no VM running (control socket %s not found; start one with 'elmos qemu run')", socket)
+	}
+	client, err := qmp.Dial(socket, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to QEMU at %s: %w", socket, err)
+	}
+	client.SetDeadline(time.Now().Add(timeout))
+	return client, nil
+}
+
+// qmpStatus is the reply to query-status
+type qmpStatus struct {
+	Running bool   `json:"running"`
+	Status  string `json:"status"`
+}
+
+// Conditions under which a ctl action has nothing to do
+func qmpPaused(s qmpStatus) bool  { return !s.Running }
+func qmpRunning(s qmpStatus) bool { return s.Running }
+
+// qmpAction is a ctl command confirmed by an event
+type qmpAction struct {
+	Command string
+	// Event is what QEMU emits once the command took effect
+	Event string
+	// Done is printed on success
+	Done string
+	// Skip, if set, tells from the VM status that the command is not needed
+	Skip func(qmpStatus) bool
+}
+
+func runQMPStatus(timeout time.Duration) error {
+	client, err := dialQMP(timeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var status qmpStatus
+	if err := client.Execute("query-status", nil, &status); err != nil {
+		return fmt.Errorf("query-status failed: %w", err)
+	}
+	fmt.Printf("Status:  %s\n", status.Status)
+	fmt.Printf("QEMU:    %s\n", client.Greeting().Version())
+	fmt.Printf("Socket:  %s\n", ctx.Config.QMPSocket())
+	return nil
+}
+
+// runQMPAction runs a command and waits for the event that confirms it
+func runQMPAction(timeout time.Duration, action qmpAction) error {
+	client, err := dialQMP(timeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if action.Skip != nil {
+		var status qmpStatus
+		if err := client.Execute("query-status", nil, &status); err != nil {
+			return fmt.Errorf("query-status failed: %w", err)
+		}
+		if action.Skip(status) {
+			printInfo("VM already %s", status.Status)
+			return nil
+		}
+	}
+
+	err = client.Execute(action.Command, nil, nil)
+	// QEMU may exit before answering quit
+	if err != nil && !(action.Command == "quit" && errors.Is(err, qmp.ErrClosed)) {
+		return fmt.Errorf("%s failed: %w", action.Command, err)
+	}
+
+	confirmed := false
+	for event := range client.Events() {
+		if event.Event == action.Event {
+			confirmed = true
+			break
+		}
+	}
+	if !confirmed && action.Command != "quit" {
+		printWarn("QEMU accepted %s but sent no %s event within %s", action.Command, action.Event, timeout)
+	}
+	printSuccess("%s", action.Done)
+	return nil
+}
+
+func runQMPScreendump(timeout time.Duration, file string) error {
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+
+	client, err := dialQMP(timeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// QEMU writes the file itself, so the path must not be relative to
+	// our working directory
+	args := map[string]string{"filename": path}
+	if strings.EqualFold(filepath.Ext(path), ".png") {
+		args["format"] = "png"
+	}
+	if err := client.Execute("screendump", args, nil); err != nil {
+		return fmt.Errorf("screendump failed: %w", err)
+	}
+	printSuccess("Saved the display to %s", path)
+	return nil
+}
+
+func runQMPHMP(timeout time.Duration, line string) error {
+	client, err := dialQMP(timeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	out, err := client.HumanMonitorCommand(line)
+	if err != nil {
+		return fmt.Errorf("%s: %w", line, err)
+	}
+	fmt.Print(strings.ReplaceAll(out, "\r\n", "\n"))
+	return nil
+}
@@ -2,15 +2,19 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
-)
 
-const kernelRepoURL = "https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git"
+	"github.com/NguyenTrongPhuc552003/elmos/internal/core"
+)
 
 // repoCmd - git repository management
 var repoCmd = &cobra.Command{
@@ -21,12 +25,43 @@ var repoCmd = &cobra.Command{
 
 var repoStatusCmd = &cobra.Command{
 	Use:   "status",
-	Short: "Show git status",
+	Short: "Show a summary of the kernel tree",
+	Long: `Show the kernel version, checked out branch or tag, HEAD commit,
+ahead/behind counts against the configured upstream, applied project
+patches, .config and build state, and dirty file counts.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if err := ctx.EnsureMounted(); err != nil {
 			return err
 		}
-		return runGitCommand("status")
+		asJSON, _ := cmd.Flags().GetBool("json")
+		return runRepoStatus(asJSON)
+	},
+}
+
+var repoCloneCmd = &cobra.Command{
+	Use:   "clone",
+	Short: "Clone the kernel repository",
+	Long: `Clone the configured kernel repository (repo.url) into the workspace.
+
+Examples:
+  elmos repo clone                                # Full clone of repo.branch
+  elmos repo clone --depth 1 --tag v6.18          # Shallow clone of a single tag
+  elmos repo clone --filter blob:none             # Partial clone, blobs fetched on demand
+  elmos repo clone --reference ~/src/linux.git    # Borrow objects from a local store`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		opts := repoCloneOptions{}
+		opts.Depth, _ = cmd.Flags().GetInt("depth")
+		opts.Filter, _ = cmd.Flags().GetString("filter")
+		opts.Tag, _ = cmd.Flags().GetString("tag")
+		opts.Reference, _ = cmd.Flags().GetString("reference")
+
+		if _, err := os.Stat(filepath.Join(ctx.Config.Paths.KernelDir, ".git")); err == nil {
+			return fmt.Errorf("kernel repository already exists at %s (use 'elmos repo reinit')", ctx.Config.Paths.KernelDir)
+		}
+		return runRepoClone(opts)
 	},
 }
 
@@ -44,23 +79,23 @@ var repoCheckoutCmd = &cobra.Command{
 
 var repoUpdateCmd = &cobra.Command{
 	Use:   "update",
-	Short: "Fetch and reset to origin/master",
+	Short: "Fetch and reset to the configured upstream branch",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if err := ctx.EnsureMounted(); err != nil {
 			return err
 		}
-		return runRepoUpdate()
+		return runRepoUpdate(guardFromFlags(cmd))
 	},
 }
 
 var repoResetCmd = &cobra.Command{
 	Use:   "reset",
-	Short: "Hard reset to origin/master (no fetch)",
+	Short: "Hard reset to the configured upstream branch (no fetch)",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if err := ctx.EnsureMounted(); err != nil {
 			return err
 		}
-		return runRepoReset()
+		return runRepoReset(guardFromFlags(cmd))
 	},
 }
 
@@ -71,16 +106,36 @@ var repoReinitCmd = &cobra.Command{
 		if err := ctx.EnsureMounted(); err != nil {
 			return err
 		}
-		return runRepoReinit()
+		return runRepoReinit(guardFromFlags(cmd))
 	},
 }
 
 func init() {
 	repoCmd.AddCommand(repoStatusCmd)
+	repoCmd.AddCommand(repoCloneCmd)
 	repoCmd.AddCommand(repoCheckoutCmd)
 	repoCmd.AddCommand(repoUpdateCmd)
 	repoCmd.AddCommand(repoResetCmd)
 	repoCmd.AddCommand(repoReinitCmd)
+
+	repoStatusCmd.Flags().Bool("json", false, "Output as JSON")
+
+	addGuardFlags(repoUpdateCmd)
+	addGuardFlags(repoResetCmd)
+	addGuardFlags(repoReinitCmd)
+
+	repoCloneCmd.Flags().Int("depth", 0, "Create a shallow clone with N commits of history")
+	repoCloneCmd.Flags().String("filter", "", "Partial clone filter (e.g. blob:none)")
+	repoCloneCmd.Flags().String("tag", "", "Clone and check out this tag instead of repo.branch")
+	repoCloneCmd.Flags().String("reference", "", "Borrow objects from a local repository or shared object store")
+}
+
+// repoCloneOptions controls how the kernel repository is cloned
+type repoCloneOptions struct {
+	Depth     int
+	Filter    string
+	Tag       string
+	Reference string
 }
 
 func runRepoCheck() error {
@@ -92,10 +147,53 @@ func runRepoCheck() error {
 		return nil
 	}
 
-	printStep("Cloning Linux kernel into %s...", kernelDir)
-	printInfo("This may take a while for the full history")
+	return runRepoClone(repoCloneOptions{})
+}
+
+func runRepoClone(opts repoCloneOptions) error {
+	cfg := ctx.Config
+	kernelDir := cfg.Paths.KernelDir
+	url := cfg.Repo.URL
+
+	// git ignores --depth and --filter for plain local paths; file:// makes
+	// it use the regular transport so local mirrors behave like remotes
+	if (opts.Depth > 0 || opts.Filter != "") && isLocalPath(url) {
+		abs, err := filepath.Abs(url)
+		if err != nil {
+			return err
+		}
+		url = "file://" + abs
+	}
+
+	args := []string{"clone"}
+	ref := cfg.Repo.Branch
+	if opts.Tag != "" {
+		ref = opts.Tag
+	}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	if opts.Depth > 0 {
+		args = append(args, "--depth", fmt.Sprintf("%d", opts.Depth))
+		if opts.Tag == "" {
+			// Shallow clones default to a single branch; keep the other branches fetchable
+			args = append(args, "--no-single-branch")
+		}
+	}
+	if opts.Filter != "" {
+		args = append(args, "--filter", opts.Filter)
+	}
+	if opts.Reference != "" {
+		args = append(args, "--reference", opts.Reference)
+	}
+	args = append(args, url, kernelDir)
 
-	cmd := exec.Command("git", "clone", kernelRepoURL, kernelDir)
+	printStep("Cloning %s (%s) into %s...", url, ref, kernelDir)
+	if opts.Depth == 0 && opts.Filter == "" {
+		printInfo("This may take a while for the full history")
+	}
+
+	cmd := exec.Command("git", args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -103,17 +201,70 @@ func runRepoCheck() error {
 		return fmt.Errorf("git clone failed: %w", err)
 	}
 
+	if err := ensureRemotes(); err != nil {
+		return err
+	}
+
 	printSuccess("Repository cloned successfully")
+
+	if cfg.Patches.AutoApply {
+		return autoApplyPatches(nil)
+	}
+	return nil
+}
+
+// ensureRemotes adds the extra remotes from repo.remotes that are missing in the
+// kernel tree, and updates the URL of those that changed
+func ensureRemotes() error {
+	kernelDir := ctx.Config.Paths.KernelDir
+	for name, url := range ctx.Config.Repo.Remotes {
+		current, err := gitOutputIn(kernelDir, "remote", "get-url", name)
+		switch {
+		case err != nil:
+			printStep("Adding remote %s (%s)...", name, url)
+			if err := runGitIn(kernelDir, "remote", "add", name, url); err != nil {
+				return fmt.Errorf("failed to add remote %s: %w", name, err)
+			}
+		case current != url:
+			printStep("Updating remote %s (%s)...", name, url)
+			if err := runGitIn(kernelDir, "remote", "set-url", name, url); err != nil {
+				return fmt.Errorf("failed to update remote %s: %w", name, err)
+			}
+		}
+	}
 	return nil
 }
 
+// isLocalPath reports whether a repository URL refers to a local directory
+func isLocalPath(url string) bool {
+	if strings.Contains(url, "://") {
+		return false
+	}
+	// scp-like syntax (host:path) is remote; a colon after a slash is a path
+	colon := strings.Index(url, ":")
+	return colon < 0 || strings.Contains(url[:colon], "/")
+}
+
+// upstreamRef returns the remote-tracking ref of the configured branch
+func upstreamRef() string {
+	return "origin/" + ctx.Config.Repo.Branch
+}
+
+// fetchUpstream fetches the configured branch from origin, with an explicit
+// refspec so it also works for single-branch and tag clones
+func fetchUpstream() error {
+	branch := ctx.Config.Repo.Branch
+	refspec := fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", branch, branch)
+	return runGitCommand("fetch", "origin", refspec)
+}
+
 func runRepoCheckout(target string) error {
 	printStep("Checking out %s...", target)
 
 	// First, try as a tag
 	if err := runGitCommand("checkout", target); err != nil {
 		// If tag doesn't exist, try creating a new branch
-		if err := runGitCommand("checkout", "-b", target, "--track", "origin/master"); err != nil {
+		if err := runGitCommand("checkout", "-b", target, "--track", upstreamRef()); err != nil {
 			return fmt.Errorf("failed to checkout %s: %w", target, err)
 		}
 		printSuccess("Created and switched to new branch: %s", target)
@@ -124,14 +275,45 @@ func runRepoCheckout(target string) error {
 	return nil
 }
 
-func runRepoUpdate() error {
-	printStep("Fetching from origin...")
-	if err := runGitCommand("fetch", "origin"); err != nil {
+// checkResettableTree refuses to reset a tree that does not follow the
+// upstream branch: another tree (tags and commits are pinned there) or a
+// detached HEAD
+func checkResettableTree(operation string) error {
+	cfg := ctx.Config
+
+	if ctx.KernelDir != cfg.Paths.KernelDir {
+		return fmt.Errorf("%s resets the main clone, but tree %s is active (run 'elmos tree use %s' first)",
+			operation, cfg.Tree.Active, core.MainTreeName)
+	}
+	if _, err := gitOutputIn(ctx.KernelDir, "symbolic-ref", "-q", "HEAD"); err != nil {
+		head, _ := gitOutputIn(ctx.KernelDir, "describe", "--tags", "--always", "HEAD")
+		return fmt.Errorf("HEAD is detached at %s; %s would move it to %s (run 'elmos repo checkout <branch>' first)",
+			head, operation, upstreamRef())
+	}
+	return nil
+}
+
+func runRepoUpdate(guard repoGuard) error {
+	if err := checkResettableTree("repo update"); err != nil {
+		return err
+	}
+	if err := guardLocalWork(ctx.KernelDir, "repo update", guard, false); err != nil {
+		return err
+	}
+
+	if err := ensureRemotes(); err != nil {
+		return err
+	}
+
+	printStep("Fetching %s from origin...", ctx.Config.Repo.Branch)
+	if err := fetchUpstream(); err != nil {
 		return err
 	}
 
-	printStep("Resetting to origin/master...")
-	if err := runGitCommand("reset", "--hard", "origin/master"); err != nil {
+	local := reportLocalPatches()
+
+	printStep("Resetting to %s...", upstreamRef())
+	if err := runGitCommand("reset", "--hard", upstreamRef()); err != nil {
 		return err
 	}
 
@@ -140,15 +322,26 @@ func runRepoUpdate() error {
 		return err
 	}
 
-	printSuccess("Repository updated to origin/master")
+	printSuccess("Repository updated to %s", upstreamRef())
+
+	if ctx.Config.Patches.AutoApply {
+		return autoApplyPatches(local)
+	}
 	return nil
 }
 
-func runRepoReset() error {
+func runRepoReset(guard repoGuard) error {
+	if err := checkResettableTree("repo reset"); err != nil {
+		return err
+	}
 	printWarn("This will discard all local changes")
+	if err := guardLocalWork(ctx.KernelDir, "repo reset", guard, false); err != nil {
+		return err
+	}
+	local := reportLocalPatches()
 
-	printStep("Resetting to origin/master...")
-	if err := runGitCommand("reset", "--hard", "origin/master"); err != nil {
+	printStep("Resetting to %s...", upstreamRef())
+	if err := runGitCommand("reset", "--hard", upstreamRef()); err != nil {
 		return err
 	}
 
@@ -158,17 +351,77 @@ func runRepoReset() error {
 	}
 
 	printSuccess("Local changes discarded")
+
+	if ctx.Config.Patches.AutoApply {
+		return autoApplyPatches(local)
+	}
+	return nil
+}
+
+// reportLocalPatches prints and returns the project patches currently applied
+// to the kernel tree, so they can be compared after a reset
+func reportLocalPatches() []string {
+	dir, err := patchSeriesDir()
+	if err != nil {
+		return nil
+	}
+	series, err := loadSeries(dir)
+	if err != nil {
+		return nil
+	}
+
+	local := appliedPatches(dir, series)
+	if len(local) > 0 {
+		printInfo("Project patches present before reset:")
+		for _, name := range local {
+			fmt.Printf("  - %s\n", name)
+		}
+	}
+	return local
+}
+
+// autoApplyPatches applies the version-matched series and reports which
+// patches were (re-)applied compared to those present before
+func autoApplyPatches(before []string) error {
+	printStep("Applying project patch series...")
+	applied, err := applyPatchSeries()
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		printInfo("Patch series already applied")
+		return nil
+	}
+
+	for _, name := range applied {
+		if slices.Contains(before, name) {
+			fmt.Printf("  ↻ %s (re-applied)\n", name)
+		} else {
+			fmt.Printf("  + %s\n", name)
+		}
+	}
+	printSuccess("Applied %d patch(es)", len(applied))
 	return nil
 }
 
-func runRepoReinit() error {
+func runRepoReinit(guard repoGuard) error {
 	kernelDir := ctx.Config.Paths.KernelDir
 
 	printWarn("This will DELETE the entire kernel tree and re-clone")
-	printInfo("Press Ctrl+C to cancel, or wait 5 seconds to continue...")
-
-	// In interactive mode, we'd prompt here
-	// For now, just proceed
+	if _, err := os.Stat(filepath.Join(kernelDir, ".git")); err == nil {
+		// Worktrees keep their repository data in the main clone
+		if worktrees := linkedWorktrees(kernelDir); len(worktrees) > 0 {
+			printWarn("%d worktree(s) depend on %s:", len(worktrees), kernelDir)
+			for _, path := range worktrees {
+				fmt.Printf("    %s\n", path)
+			}
+			return fmt.Errorf("remove them first ('elmos tree remove <name>' or 'git worktree remove <path>')")
+		}
+		if err := guardLocalWork(kernelDir, "repo reinit", guard, true); err != nil {
+			return err
+		}
+	}
 
 	printStep("Removing %s...", kernelDir)
 	if err := os.RemoveAll(kernelDir); err != nil {
@@ -178,10 +431,315 @@ func runRepoReinit() error {
 	return runRepoCheck()
 }
 
+// linkedWorktrees returns the worktrees of a clone other than the clone
+// itself
+func linkedWorktrees(dir string) []string {
+	main := filepath.Clean(dir)
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		main = resolved
+	}
+	var paths []string
+	for _, line := range outputLines(gitOutputIn(dir, "worktree", "list", "--porcelain")) {
+		if path, ok := strings.CutPrefix(line, "worktree "); ok && filepath.Clean(path) != main && filepath.Clean(path) != filepath.Clean(dir) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// runGitCommand runs a git command in the active kernel tree
 func runGitCommand(args ...string) error {
+	return runGitIn(ctx.KernelDir, args...)
+}
+
+// runGitIn runs a git command in dir with output attached to the terminal
+func runGitIn(dir string, args ...string) error {
 	cmd := exec.Command("git", args...)
-	cmd.Dir = ctx.Config.Paths.KernelDir
+	cmd.Dir = dir
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
+
+// gitOutput runs a git command in the active kernel tree and returns its trimmed stdout
+func gitOutput(args ...string) (string, error) {
+	return gitOutputIn(ctx.KernelDir, args...)
+}
+
+// gitOutputIn runs a git command in dir and returns its trimmed stdout
+func gitOutputIn(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// Image states reported by repo status
+const (
+	imageNone    = "none"
+	imageCurrent = "current"
+	imageStale   = "stale"
+	imageUnknown = "unknown"
+)
+
+// repoStatus is the summary shown by repo status
+type repoStatus struct {
+	Tree     string `json:"tree"`
+	Path     string `json:"path"`
+	Version  string `json:"version"`
+	Describe string `json:"describe"`
+	Branch   string `json:"branch,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+	Head     string `json:"head"`
+	Subject  string `json:"subject"`
+	Upstream struct {
+		Ref    string `json:"ref"`
+		Known  bool   `json:"known"`
+		Ahead  int    `json:"ahead"`
+		Behind int    `json:"behind"`
+	} `json:"upstream"`
+	Patches struct {
+		Series  string   `json:"series"`
+		Total   int      `json:"total"`
+		Applied []string `json:"applied"`
+	} `json:"patches"`
+	Config struct {
+		Exists bool   `json:"exists"`
+		Arch   string `json:"arch,omitempty"`
+	} `json:"config"`
+	Image struct {
+		Path   string `json:"path"`
+		State  string `json:"state"`
+		Head   string `json:"head,omitempty"`
+		Dirty  bool   `json:"dirty,omitempty"`
+		Arch   string `json:"arch,omitempty"`
+		Reason string `json:"reason,omitempty"`
+	} `json:"image"`
+	Changes struct {
+		Staged     int `json:"staged"`
+		Modified   int `json:"modified"`
+		Untracked  int `json:"untracked"`
+		Conflicted int `json:"conflicted"`
+	} `json:"changes"`
+}
+
+func runRepoStatus(asJSON bool) error {
+	if !ctx.KernelExists() {
+		return fmt.Errorf("kernel repository not found at %s (run 'elmos repo clone')", ctx.KernelDir)
+	}
+
+	st, err := collectRepoStatus()
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(st)
+	}
+
+	printRepoStatus(st)
+	return nil
+}
+
+// collectRepoStatus gathers the state of the active kernel tree
+func collectRepoStatus() (*repoStatus, error) {
+	st := &repoStatus{Tree: ctx.Config.Tree.Active, Path: ctx.KernelDir}
+	if st.Tree == "" {
+		st.Tree = core.MainTreeName
+	}
+
+	head, err := gitOutput("rev-parse", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HEAD: %w", err)
+	}
+	st.Head = head
+	st.Subject, _ = gitOutput("log", "-1", "--format=%s")
+	st.Version, _ = ctx.KernelRelease()
+	st.Describe, _ = gitOutput("describe", "--tags", "--always")
+	st.Tag, _ = gitOutput("describe", "--tags", "--exact-match")
+	if branch, err := gitOutput("symbolic-ref", "--short", "-q", "HEAD"); err == nil {
+		st.Branch = branch
+	}
+
+	// Ahead/behind against the configured upstream branch
+	st.Upstream.Ref = upstreamRef()
+	if _, err := gitOutput("rev-parse", "--verify", "-q", st.Upstream.Ref); err == nil {
+		counts, err := gitOutput("rev-list", "--left-right", "--count", "HEAD..."+st.Upstream.Ref)
+		if err == nil {
+			if _, err := fmt.Sscan(counts, &st.Upstream.Ahead, &st.Upstream.Behind); err == nil {
+				st.Upstream.Known = true
+			}
+		}
+	}
+
+	// Project patches for this kernel version
+	if dir, err := patchSeriesDir(); err == nil {
+		st.Patches.Series = filepath.Base(dir)
+		if series, err := loadSeries(dir); err == nil {
+			st.Patches.Total = len(series)
+			st.Patches.Applied = appliedPatches(dir, series)
+		}
+	}
+
+	st.Config.Exists = ctx.HasConfig()
+	st.Config.Arch = ctx.ConfigArch()
+
+	collectImageStatus(st)
+
+	changes, _ := gitOutput("status", "--porcelain")
+	for _, line := range strings.Split(changes, "\n") {
+		if len(line) < 2 {
+			continue
+		}
+		x, y := line[0], line[1]
+		switch {
+		case x == '?':
+			st.Changes.Untracked++
+		case x == 'U' || y == 'U' || (x == 'A' && y == 'A') || (x == 'D' && y == 'D'):
+			st.Changes.Conflicted++
+		default:
+			if x != ' ' {
+				st.Changes.Staged++
+			}
+			if y != ' ' {
+				st.Changes.Modified++
+			}
+		}
+	}
+
+	return st, nil
+}
+
+// collectImageStatus decides whether the built kernel image matches HEAD,
+// using the stamp written by elmos build and falling back to timestamps
+func collectImageStatus(st *repoStatus) {
+	st.Image.Path = ctx.GetKernelImage()
+	info, err := os.Stat(st.Image.Path)
+	if err != nil {
+		st.Image.State = imageNone
+		return
+	}
+
+	stamp, err := readBuildStamp()
+	if err != nil {
+		// Built outside elmos: an image older than the HEAD commit is certainly stale
+		st.Image.State = imageUnknown
+		st.Image.Reason = "no build record"
+		if ts, err := gitOutput("log", "-1", "--format=%ct"); err == nil {
+			var commitTime int64
+			if _, err := fmt.Sscan(ts, &commitTime); err == nil && info.ModTime().Unix() < commitTime {
+				st.Image.State = imageStale
+				st.Image.Reason = "image is older than HEAD"
+			}
+		}
+		return
+	}
+
+	st.Image.Head = stamp.Head
+	st.Image.Dirty = stamp.Dirty
+	st.Image.Arch = stamp.Arch
+	switch {
+	case info.ModTime().After(stamp.Built.Add(time.Minute)):
+		st.Image.State = imageUnknown
+		st.Image.Reason = "image was rebuilt outside elmos"
+	case stamp.Head != st.Head:
+		st.Image.State = imageStale
+		st.Image.Reason = "built from " + stamp.Head[:min(12, len(stamp.Head))]
+	default:
+		st.Image.State = imageCurrent
+		if stamp.Dirty {
+			st.Image.Reason = "built with uncommitted changes"
+		}
+	}
+}
+
+// printRepoStatus renders the status summary
+func printRepoStatus(st *repoStatus) {
+	dim := func(s string) string { return infoStyle.Render(s) }
+
+	fmt.Println("Kernel Tree:")
+	fmt.Printf("  Tree:     %s (%s)\n", st.Tree, st.Path)
+	fmt.Printf("  Version:  %s %s\n", st.Version, dim("("+st.Describe+")"))
+	switch {
+	case st.Branch != "":
+		fmt.Printf("  Branch:   %s\n", st.Branch)
+	case st.Tag != "":
+		fmt.Printf("  Tag:      %s (detached)\n", st.Tag)
+	default:
+		fmt.Printf("  Branch:   %s\n", dim("(detached)"))
+	}
+	fmt.Printf("  HEAD:     %s %s\n", st.Head[:min(12, len(st.Head))], st.Subject)
+	if st.Upstream.Known {
+		sync := successStyle.Render("up to date")
+		if st.Upstream.Ahead > 0 || st.Upstream.Behind > 0 {
+			sync = warnStyle.Render(fmt.Sprintf("%d ahead, %d behind", st.Upstream.Ahead, st.Upstream.Behind))
+		}
+		fmt.Printf("  Upstream: %s: %s\n", st.Upstream.Ref, sync)
+	} else {
+		fmt.Printf("  Upstream: %s: %s\n", st.Upstream.Ref, dim("not fetched"))
+	}
+	fmt.Println()
+
+	fmt.Println("Patches:")
+	if st.Patches.Total == 0 {
+		fmt.Printf("  %s\n", dim("no project patches for "+st.Patches.Series))
+	} else {
+		style := successStyle
+		if len(st.Patches.Applied) < st.Patches.Total {
+			style = warnStyle
+		}
+		fmt.Printf("  %s: %s\n", st.Patches.Series,
+			style.Render(fmt.Sprintf("%d/%d applied", len(st.Patches.Applied), st.Patches.Total)))
+		for _, name := range st.Patches.Applied {
+			fmt.Printf("    %s %s\n", successStyle.Render("✓"), name)
+		}
+	}
+	fmt.Println()
+
+	fmt.Println("Build:")
+	switch {
+	case !st.Config.Exists:
+		fmt.Printf("  .config:  %s\n", warnStyle.Render("missing"))
+	case st.Config.Arch != "" && st.Config.Arch != ctx.Config.Build.Arch:
+		fmt.Printf("  .config:  %s\n", warnStyle.Render(fmt.Sprintf("%s (configured arch is %s)", st.Config.Arch, ctx.Config.Build.Arch)))
+	default:
+		fmt.Printf("  .config:  %s\n", successStyle.Render(valueOr(st.Config.Arch, "present")))
+	}
+	image := st.Image.State
+	switch st.Image.State {
+	case imageCurrent:
+		image = successStyle.Render("matches HEAD")
+	case imageStale:
+		image = warnStyle.Render("stale")
+	case imageNone:
+		image = dim("not built")
+	}
+	if st.Image.Reason != "" {
+		image += " " + dim("("+st.Image.Reason+")")
+	}
+	fmt.Printf("  Image:    %s\n", image)
+	fmt.Println()
+
+	fmt.Println("Working Tree:")
+	c := st.Changes
+	if c.Staged+c.Modified+c.Untracked+c.Conflicted == 0 {
+		fmt.Printf("  %s\n", successStyle.Render("clean"))
+	} else {
+		fmt.Printf("  %d staged, %d modified, %d untracked", c.Staged, c.Modified, c.Untracked)
+		if c.Conflicted > 0 {
+			fmt.Print(", " + errorStyle.Render(fmt.Sprintf("%d conflicted", c.Conflicted)))
+		}
+		fmt.Println()
+	}
+}
+
+// valueOr returns value, or fallback if value is empty
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
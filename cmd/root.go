@@ -17,6 +17,8 @@ var (
 	cfgFile     string
 	verbose     bool
 	interactive bool
+	profileName string
+	waitLock    bool
 
 	// Global context
 	ctx *core.Context
@@ -59,11 +61,21 @@ Common workflow:
 			return err
 		}
 
+		if profileName != "" {
+			if err := cfg.ApplyProfile(profileName); err != nil {
+				return err
+			}
+		}
+
 		// Initialize global context
 		ctx = core.NewContext(cfg)
 		ctx.Verbose = verbose
+		ctx.OnAutoMount = func() {
+			printStep("Auto-mounting %s at %s...", cfg.Image.VolumeName, cfg.Image.MountPoint)
+		}
 
-		return nil
+		// Serialize commands that change the workspace
+		return acquireCommandLock(cmd, waitLock)
 	},
 }
 
@@ -77,6 +89,8 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default: ./elmos.yaml)")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
 	rootCmd.PersistentFlags().BoolVarP(&interactive, "interactive", "i", false, "enable interactive TUI mode")
+	rootCmd.PersistentFlags().StringVarP(&profileName, "profile", "p", "", "apply a named configuration profile")
+	rootCmd.PersistentFlags().BoolVar(&waitLock, "wait", false, "wait for other elmos commands holding the workspace lock")
 
 	// Add subcommands
 	rootCmd.AddCommand(versionCmd)
@@ -84,13 +98,16 @@ func init() {
 	rootCmd.AddCommand(initCmd)
 	rootCmd.AddCommand(imageCmd)
 	rootCmd.AddCommand(repoCmd)
+	rootCmd.AddCommand(treeCmd)
 	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(kernelCmd)
 	rootCmd.AddCommand(buildCmd)
 	rootCmd.AddCommand(moduleCmd)
 	rootCmd.AddCommand(qemuCmd)
 	rootCmd.AddCommand(rootfsCmd)
+	rootCmd.AddCommand(initramfsCmd)
 	rootCmd.AddCommand(patchCmd)
+	rootCmd.AddCommand(bisectCmd)
 }
 
 // Helper functions for consistent output
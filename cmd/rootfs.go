@@ -0,0 +1,482 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/NguyenTrongPhuc552003/elmos/internal/core"
+)
+
+// rootfsCmd - rootfs management
+var rootfsCmd = &cobra.Command{
+	Use:   "rootfs",
+	Short: "Manage root filesystem",
+	Long: `Create and manage the root filesystem for QEMU.
+
+The rootfs is populated by a provider, selected with rootfs.provider or
+--provider:
+  debootstrap  Debian stable via debootstrap (default; needs the network)
+  busybox      minimal BusyBox system from a local static busybox binary
+  tarball      import of a local rootfs archive (Alpine minirootfs,
+               Buildroot rootfs.tar)`,
+}
+
+var rootfsCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create ext4 disk image with a rootfs",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		cfg := ctx.Config
+		if cmd.Flags().Changed("provider") {
+			cfg.Rootfs.Provider, _ = cmd.Flags().GetString("provider")
+		}
+		if cmd.Flags().Changed("busybox") {
+			cfg.Rootfs.BusyBox, _ = cmd.Flags().GetString("busybox")
+		}
+		if cmd.Flags().Changed("tarball") {
+			cfg.Rootfs.Tarball, _ = cmd.Flags().GetString("tarball")
+		}
+		size, _ := cmd.Flags().GetString("size")
+		return runRootfsCreate(size)
+	},
+}
+
+var rootfsInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Show or regenerate the guest /init script",
+	Long: `The guest /init script is generated from the guest: configuration
+(networking, hostname, extra mounts, startup hooks, poweroff).
+
+Examples:
+  elmos rootfs init show
+  elmos config set guest_network dhcp
+  elmos rootfs init regen`,
+}
+
+var rootfsInitShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the /init script generated from the current configuration",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		script, err := initScript(initOptions{SecondStage: needsSecondStage(ctx.Config.RootfsDir())})
+		if err != nil {
+			return err
+		}
+		fmt.Print(script)
+		return nil
+	},
+}
+
+var rootfsInitRegenCmd = &cobra.Command{
+	Use:   "regen",
+	Short: "Rewrite /init in the rootfs directory and the disk image",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		return runRootfsInitRegen()
+	},
+}
+
+func init() {
+	rootfsCmd.AddCommand(rootfsCreateCmd)
+	rootfsCmd.AddCommand(rootfsInitCmd)
+	rootfsInitCmd.AddCommand(rootfsInitShowCmd)
+	rootfsInitCmd.AddCommand(rootfsInitRegenCmd)
+	rootfsCreateCmd.Flags().StringP("size", "s", "5G", "Disk image size")
+	rootfsCreateCmd.Flags().String("provider", "", "Rootfs provider: "+strings.Join(rootfsProviderNames(), ", "))
+	rootfsCreateCmd.Flags().String("busybox", "", "Static busybox binary for the busybox provider")
+	rootfsCreateCmd.Flags().String("tarball", "", "Rootfs archive for the tarball provider")
+}
+
+// RootfsProvider populates the root filesystem directory that becomes the
+// disk image
+type RootfsProvider interface {
+	// Name is the rootfs.provider value selecting this provider
+	Name() string
+	// Description names what the provider builds, for progress output
+	Description() string
+	// Populate fills the empty rootfs directory, including /init
+	Populate(dir string) error
+}
+
+// rootfsProviders maps provider names to their constructors
+var rootfsProviders = map[string]func(cfg *core.Config) RootfsProvider{
+	"debootstrap": func(cfg *core.Config) RootfsProvider { return &debootstrapProvider{cfg: cfg} },
+	"busybox":     func(cfg *core.Config) RootfsProvider { return &busyboxProvider{cfg: cfg} },
+	"tarball":     func(cfg *core.Config) RootfsProvider { return &tarballProvider{cfg: cfg} },
+}
+
+// rootfsProviderNames returns the provider names, sorted
+func rootfsProviderNames() []string {
+	var names []string
+	for name := range rootfsProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newRootfsProvider returns the configured provider
+func newRootfsProvider(cfg *core.Config) (RootfsProvider, error) {
+	name := valueOr(cfg.Rootfs.Provider, core.DefaultRootfs)
+	newProvider, ok := rootfsProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown rootfs provider: %s (valid: %s)", name, strings.Join(rootfsProviderNames(), ", "))
+	}
+	return newProvider(cfg), nil
+}
+
+func runRootfsCreate(size string) error {
+	cfg := ctx.Config
+
+	provider, err := newRootfsProvider(cfg)
+	if err != nil {
+		return err
+	}
+
+	printStep("Creating %s rootfs for %s...", provider.Description(), cfg.Build.Arch)
+	warnLowSpace()
+
+	// Create rootfs directory
+	os.RemoveAll(cfg.RootfsDir())
+	os.MkdirAll(cfg.RootfsDir(), 0755)
+	os.Remove(fakerootStateFile())
+	os.Remove(imageMetaPath(cfg.DiskImage()))
+
+	if err := provider.Populate(cfg.RootfsDir()); err != nil {
+		return err
+	}
+
+	if err := applyRootfsCustomization(cfg.RootfsDir()); err != nil {
+		return err
+	}
+
+	if err := buildDiskImage(size); err != nil {
+		return err
+	}
+
+	printSuccess("Disk image created: %s (%s)", cfg.DiskImage(), provider.Name())
+	if needsSecondStage(cfg.RootfsDir()) {
+		finalize := "elmos rootfs finalize --qemu"
+		if runtime.GOOS == "linux" {
+			finalize = "elmos rootfs finalize"
+		}
+		printInfo("Run '%s' to complete the second stage now instead of on first boot", finalize)
+	}
+	return nil
+}
+
+// buildDiskImage packs the rootfs directory into a new ext4 disk image
+func buildDiskImage(size string) error {
+	cfg := ctx.Config
+
+	printStep("Creating ext4 disk image (%s)...", size)
+
+	// Build next to the image and rename, so a failure keeps the old image
+	tmp := cfg.DiskImage() + ".tmp"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+
+	mke2fsPath := e2fsTool("mke2fs")
+	mke2fsArgs := []string{
+		"-t", "ext4",
+		"-E", "lazy_itable_init=0,lazy_journal_init=0",
+		"-d", cfg.RootfsDir(),
+		tmp,
+		size,
+	}
+	// A rootfs populated under fakeroot is read back with the ownership and
+	// device nodes recorded there
+	mke2fsCmd := exec.Command(mke2fsPath, mke2fsArgs...)
+	if _, err := os.Stat(fakerootStateFile()); err == nil {
+		mke2fsCmd = fakerootCommand(mke2fsPath, mke2fsArgs...)
+	}
+	mke2fsCmd.Stdout = os.Stdout
+	mke2fsCmd.Stderr = os.Stderr
+
+	if err := mke2fsCmd.Run(); err != nil {
+		return fmt.Errorf("mke2fs failed: %w", err)
+	}
+	if err := os.Rename(tmp, cfg.DiskImage()); err != nil {
+		return err
+	}
+	return writeImageMeta(cfg.DiskImage())
+}
+
+// imageMeta records what a disk image was built for; it is stored next to
+// the image (disk-arm64.img has disk-arm64.json)
+type imageMeta struct {
+	Arch       string    `json:"arch"`
+	DebianArch string    `json:"debian_arch"`
+	Provider   string    `json:"provider"`
+	Profile    string    `json:"profile,omitempty"`
+	Built      time.Time `json:"built"`
+}
+
+// imageMetaPath returns the metadata file of a disk image
+func imageMetaPath(image string) string {
+	return strings.TrimSuffix(image, filepath.Ext(image)) + ".json"
+}
+
+// writeImageMeta records the current architecture in the image metadata,
+// keeping the provider of an earlier rootfs create
+func writeImageMeta(image string) error {
+	cfg := ctx.Config
+
+	meta := &imageMeta{}
+	readJSONFile(imageMetaPath(image), meta)
+	meta.Arch = cfg.Build.Arch
+	meta.DebianArch, _ = debianArch(cfg.Build.Arch)
+	meta.Provider = valueOr(meta.Provider, cfg.Rootfs.Provider)
+	meta.Profile = cfg.Profile
+	meta.Built = time.Now()
+	return writeJSONFile(imageMetaPath(image), meta)
+}
+
+// checkImageArch refuses a disk image built for another architecture than
+// the kernel about to boot it
+func checkImageArch(image string) error {
+	cfg := ctx.Config
+
+	meta := &imageMeta{}
+	if err := readJSONFile(imageMetaPath(image), meta); err != nil {
+		printWarn("No metadata for %s; its architecture is not checked (rebuild it with 'elmos rootfs apply')", image)
+		return nil
+	}
+	if meta.Arch != cfg.Build.Arch {
+		return fmt.Errorf("disk image %s is for %s (%s), but build.arch is %s (run 'elmos rootfs create' for %s, or 'elmos config set arch %s' to boot it)",
+			image, meta.Arch, meta.DebianArch, cfg.Build.Arch, cfg.Build.Arch, meta.Arch)
+	}
+	return nil
+}
+
+// runRootfsInitRegen rewrites /init from the current guest: configuration
+// in the rootfs directory and, without rebuilding it, in the disk image
+func runRootfsInitRegen() error {
+	cfg := ctx.Config
+
+	_, dirErr := os.Stat(cfg.RootfsDir())
+	_, imageErr := os.Stat(cfg.DiskImage())
+	if dirErr != nil && imageErr != nil {
+		return fmt.Errorf("no rootfs found (run 'elmos rootfs create')")
+	}
+	if imageErr == nil {
+		if err := checkImageIdle(cfg.DiskImage()); err != nil {
+			return err
+		}
+	}
+
+	if dirErr == nil {
+		if err := createInitScript(cfg.RootfsDir(), needsSecondStage(cfg.RootfsDir())); err != nil {
+			return err
+		}
+		printSuccess("Updated %s", filepath.Join(cfg.RootfsDir(), "init"))
+	}
+
+	if imageErr == nil {
+		// The image may have been finalized on its own (finalize --qemu)
+		secondStage, err := imageNeedsSecondStage(cfg.DiskImage())
+		if err != nil {
+			return err
+		}
+		script, err := initScript(initOptions{SecondStage: secondStage})
+		if err != nil {
+			return err
+		}
+		printStep("Updating /init in %s...", cfg.DiskImage())
+		if err := writeImageFile(cfg.DiskImage(), "/init", []byte(script), 0755); err != nil {
+			return err
+		}
+		printSuccess("Updated /init in %s", cfg.DiskImage())
+	}
+	return nil
+}
+
+// needsSecondStage reports whether the rootfs is an unfinished debootstrap
+// --foreign installation
+func needsSecondStage(rootfsDir string) bool {
+	_, err := os.Stat(filepath.Join(rootfsDir, "debootstrap", "debootstrap"))
+	return err == nil
+}
+
+// busyboxProvider builds a minimal system around a single static busybox
+// binary; /init installs the applet links on boot
+type busyboxProvider struct {
+	cfg *core.Config
+}
+
+func (p *busyboxProvider) Name() string        { return "busybox" }
+func (p *busyboxProvider) Description() string { return "BusyBox" }
+
+// busyboxDirs is the skeleton of a BusyBox rootfs
+var busyboxDirs = []string{
+	"bin", "sbin", "usr/bin", "usr/sbin", "etc", "dev", "proc", "sys",
+	"tmp", "run", "root", "mnt", "var/log", "lib/modules",
+}
+
+func (p *busyboxProvider) Populate(dir string) error {
+	busybox := p.cfg.Rootfs.BusyBox
+	if busybox == "" {
+		return fmt.Errorf("no busybox binary configured (set rootfs.busybox or use --busybox)")
+	}
+	if err := checkGuestBinary(busybox, p.cfg.Build.Arch); err != nil {
+		return err
+	}
+
+	for _, d := range busyboxDirs {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return err
+		}
+	}
+	os.Chmod(filepath.Join(dir, "tmp"), 0777|os.ModeSticky)
+
+	if err := copyFile(busybox, filepath.Join(dir, "bin", "busybox")); err != nil {
+		return fmt.Errorf("failed to copy busybox: %w", err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "bin", "busybox"), 0755); err != nil {
+		return err
+	}
+	// /init needs a shell before it can install the other applets
+	if err := os.Symlink("busybox", filepath.Join(dir, "bin", "sh")); err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		"etc/passwd":   "root:x:0:0:root:/root:/bin/sh\n",
+		"etc/group":    "root:x:0:\n",
+		"etc/hostname": "elmos\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+
+	// The kernel opens /dev/console before /init can mount devtmpfs
+	for _, node := range [][]string{{"console", "600", "5", "1"}, {"null", "666", "1", "3"}} {
+		mknod := fakerootCommand("mknod", "-m", node[1], filepath.Join(dir, "dev", node[0]), "c", node[2], node[3])
+		if out, err := mknod.CombinedOutput(); err != nil {
+			printWarn("Failed to create /dev/%s: %s", node[0], strings.TrimSpace(string(out)))
+		}
+	}
+
+	return createInitScript(dir, false)
+}
+
+// tarballProvider unpacks a prebuilt rootfs archive such as an Alpine
+// minirootfs or Buildroot's rootfs.tar
+type tarballProvider struct {
+	cfg *core.Config
+}
+
+func (p *tarballProvider) Name() string { return "tarball" }
+
+func (p *tarballProvider) Description() string {
+	return fmt.Sprintf("imported (%s)", filepath.Base(p.cfg.Rootfs.Tarball))
+}
+
+func (p *tarballProvider) Populate(dir string) error {
+	tarball := p.cfg.Rootfs.Tarball
+	if tarball == "" {
+		return fmt.Errorf("no rootfs tarball configured (set rootfs.tarball or use --tarball)")
+	}
+	if _, err := os.Stat(tarball); err != nil {
+		return fmt.Errorf("rootfs tarball not found: %s", tarball)
+	}
+
+	// tar detects gzip, xz, bzip2 and zstd compression when extracting;
+	// fakeroot keeps the archive's ownership and device nodes for mke2fs
+	printStep("Extracting %s...", tarball)
+	cmd := fakerootCommand("tar", "-xpf", tarball, "-C", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to extract %s: %w", tarball, err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dir, "bin", "sh")); err != nil {
+		return fmt.Errorf("%s has no /bin/sh; is it a root filesystem archive?", tarball)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "init")); err == nil {
+		printInfo("Replacing the archive's /init with the elmos init script")
+	}
+
+	return createInitScript(dir, false)
+}
+
+// fakerootStateFile returns where fakeroot records the ownership and device
+// nodes of an unprivileged rootfs import
+func fakerootStateFile() string {
+	return filepath.Join(ctx.Config.StateDir(), "rootfs-"+ctx.Config.RootfsKey()+".fakeroot")
+}
+
+// fakerootCommand runs a command under fakeroot with the rootfs state file,
+// so ownership and device nodes created by one command are seen by the next.
+// As root, or without fakeroot installed, the command runs directly.
+func fakerootCommand(name string, args ...string) *exec.Cmd {
+	if os.Getuid() == 0 {
+		return exec.Command(name, args...)
+	}
+	if _, err := exec.LookPath("fakeroot"); err != nil {
+		return exec.Command(name, args...)
+	}
+
+	state := fakerootStateFile()
+	if _, err := os.Stat(state); err != nil {
+		os.MkdirAll(filepath.Dir(state), 0755)
+		os.WriteFile(state, nil, 0644)
+	}
+	return exec.Command("fakeroot", append([]string{"-i", state, "-s", state, "--", name}, args...)...)
+}
+
+// guestMachines maps build architectures to the ELF machines that run on them
+var guestMachines = map[string][]elf.Machine{
+	"arm64":  {elf.EM_AARCH64},
+	"riscv":  {elf.EM_RISCV},
+	"arm":    {elf.EM_ARM},
+	"x86_64": {elf.EM_X86_64},
+	"x86":    {elf.EM_386},
+}
+
+// checkGuestBinary verifies that path is a statically linked executable for
+// the target architecture, since the guest has no libraries to load
+func checkGuestBinary(path, arch string) error {
+	f, err := openGuestBinary(path, arch)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return fmt.Errorf("%s is dynamically linked; a static build is needed", path)
+		}
+	}
+	return nil
+}
+
+// openGuestBinary opens an ELF executable and checks that it runs on arch
+func openGuestBinary(path, arch string) (*elf.File, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not an ELF executable: %w", path, err)
+	}
+	if machines, ok := guestMachines[arch]; ok && !slices.Contains(machines, f.Machine) {
+		f.Close()
+		return nil, fmt.Errorf("%s is built for %s, not %s", path, f.Machine, arch)
+	}
+	return f, nil
+}
@@ -0,0 +1,323 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/NguyenTrongPhuc552003/elmos/internal/core"
+	"github.com/NguyenTrongPhuc552003/elmos/internal/image"
+)
+
+// imageSnapshotCmd - workspace checkpoints
+var imageSnapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Save and restore checkpoints of the workspace image",
+	Long: `Checkpoint the whole workspace image before risky experiments such as
+big rebases or reconfigs.
+
+Snapshots are copy-on-write clones of the image file where the host
+filesystem supports it (APFS clones on macOS, reflinks on btrfs and XFS) and
+sparse copies otherwise. The image is briefly unmounted while a snapshot is
+taken or restored, and mounted again afterwards.
+
+Examples:
+  elmos image snapshot create before-rebase
+  elmos image snapshot list
+  elmos image snapshot restore before-rebase
+  elmos image snapshot delete before-rebase`,
+}
+
+var imageSnapshotCreateCmd = &cobra.Command{
+	Use:   "create [name]",
+	Short: "Create a snapshot (default name: timestamp)",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := time.Now().Format("20060102-150405")
+		if len(args) > 0 {
+			name = args[0]
+		}
+		return runSnapshotCreate(name)
+	},
+}
+
+var imageSnapshotListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List snapshots",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runSnapshotList()
+	},
+}
+
+var imageSnapshotRestoreCmd = &cobra.Command{
+	Use:   "restore [name]",
+	Short: "Replace the image with a snapshot",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		force, _ := cmd.Flags().GetBool("force")
+		return runSnapshotRestore(args[0], force)
+	},
+}
+
+var imageSnapshotDeleteCmd = &cobra.Command{
+	Use:     "delete [name]",
+	Aliases: []string{"rm"},
+	Short:   "Delete a snapshot",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runSnapshotDelete(args[0])
+	},
+}
+
+func init() {
+	imageCmd.AddCommand(imageSnapshotCmd)
+	imageSnapshotCmd.AddCommand(imageSnapshotCreateCmd)
+	imageSnapshotCmd.AddCommand(imageSnapshotListCmd)
+	imageSnapshotCmd.AddCommand(imageSnapshotRestoreCmd)
+	imageSnapshotCmd.AddCommand(imageSnapshotDeleteCmd)
+
+	imageSnapshotRestoreCmd.Flags().BoolP("force", "f", false, "Do not ask for confirmation")
+}
+
+// snapshotMeta is stored next to each snapshot image
+type snapshotMeta struct {
+	Name         string    `json:"name"`
+	Created      time.Time `json:"created"`
+	Method       string    `json:"method"`
+	Image        string    `json:"image"`
+	Tree         string    `json:"tree"`
+	KernelCommit string    `json:"kernelCommit,omitempty"`
+	KernelDirty  bool      `json:"kernelDirty,omitempty"`
+	ConfigHash   string    `json:"configHash,omitempty"`
+}
+
+// snapshotsDir returns the directory holding image snapshots
+func snapshotsDir() string {
+	return filepath.Join(ctx.Config.StateDir(), "snapshots")
+}
+
+// snapshotImagePath returns the image file of a named snapshot
+func snapshotImagePath(name string) string {
+	return filepath.Join(snapshotsDir(), name, filepath.Base(ctx.Config.Image.Path))
+}
+
+// validateSnapshotName rejects names that cannot be used as a directory
+// under the snapshots dir
+func validateSnapshotName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid snapshot name: %q (must not be empty, . or .., or contain / or \\)", name)
+	}
+	return nil
+}
+
+func runSnapshotCreate(name string) error {
+	cfg := ctx.Config
+
+	if err := validateSnapshotName(name); err != nil {
+		return err
+	}
+	dir := filepath.Join(snapshotsDir(), name)
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("snapshot already exists: %s", name)
+	}
+	if _, err := os.Stat(cfg.Image.Path); err != nil {
+		return fmt.Errorf("image not found: %s", cfg.Image.Path)
+	}
+
+	meta := &snapshotMeta{
+		Name:    name,
+		Created: time.Now(),
+		Image:   cfg.Image.Path,
+		Tree:    valueOr(cfg.Tree.Active, core.MainTreeName),
+	}
+	// The kernel tree lives inside the image, so read its state while mounted
+	if ctx.IsMounted() && ctx.KernelExists() {
+		meta.KernelCommit, _ = gitOutput("rev-parse", "HEAD")
+		changes, _ := gitOutput("status", "--porcelain", "--untracked-files=no")
+		meta.KernelDirty = changes != ""
+		meta.ConfigHash = kernelConfigHash()
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	printStep("Creating snapshot %s...", name)
+	err := withImageUnmounted(func() error {
+		method, err := image.CloneFile(cfg.Image.Path, snapshotImagePath(name))
+		meta.Method = method
+		return err
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to snapshot image: %w", err)
+	}
+
+	if err := writeJSONFile(filepath.Join(dir, "snapshot.json"), meta); err != nil {
+		return err
+	}
+
+	printSuccess("Snapshot %s created (%s)", name, meta.Method)
+	if meta.Method == image.CloneCopy {
+		printInfo("The host filesystem does not support clones; the snapshot is a full sparse copy")
+	}
+	return nil
+}
+
+func runSnapshotList() error {
+	snapshots, err := listSnapshots()
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		printInfo("No snapshots in %s", snapshotsDir())
+		return nil
+	}
+
+	fmt.Println()
+	fmt.Printf("  %-20s %-17s %-11s %-14s %-13s %s\n", "NAME", "CREATED", "METHOD", "KERNEL", "CONFIG", "SIZE")
+	fmt.Println("  " + strings.Repeat("-", 86))
+	for _, s := range snapshots {
+		commit := "-"
+		if s.KernelCommit != "" {
+			commit = s.KernelCommit[:min(12, len(s.KernelCommit))]
+			if s.KernelDirty {
+				commit += "+"
+			}
+		}
+		size := "-"
+		if _, allocated, err := image.FileUsage(snapshotImagePath(s.Name)); err == nil {
+			size = image.FormatBytes(allocated)
+		}
+		fmt.Printf("  %-20s %-17s %-11s %-14s %-13s %s\n", s.Name, s.Created.Format("2006-01-02 15:04"),
+			s.Method, commit, valueOr(s.ConfigHash, "-"), size)
+	}
+	fmt.Println()
+	return nil
+}
+
+func runSnapshotRestore(name string, force bool) error {
+	cfg := ctx.Config
+
+	if err := validateSnapshotName(name); err != nil {
+		return err
+	}
+	meta := &snapshotMeta{}
+	if err := readJSONFile(filepath.Join(snapshotsDir(), name, "snapshot.json"), meta); err != nil {
+		return fmt.Errorf("snapshot not found: %s", name)
+	}
+	src := snapshotImagePath(name)
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("snapshot image missing: %s", src)
+	}
+
+	printWarn("This will replace %s with snapshot %s from %s", cfg.Image.Path, name,
+		meta.Created.Format("2006-01-02 15:04"))
+	if !force && !confirm("Restore snapshot?") {
+		return fmt.Errorf("restore cancelled (use --force to skip this prompt)")
+	}
+
+	printStep("Restoring snapshot %s...", name)
+	err := withImageUnmounted(func() error {
+		// Clone next to the image and rename, so a failure leaves the image intact
+		tmp := cfg.Image.Path + ".restore"
+		if _, err := image.CloneFile(src, tmp); err != nil {
+			return err
+		}
+		return os.Rename(tmp, cfg.Image.Path)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore snapshot: %w", err)
+	}
+
+	printSuccess("Image restored to snapshot %s", name)
+	if meta.KernelCommit != "" {
+		printInfo("Kernel tree %s at %s, config %s", meta.Tree,
+			meta.KernelCommit[:min(12, len(meta.KernelCommit))], valueOr(meta.ConfigHash, "none"))
+	}
+	return nil
+}
+
+func runSnapshotDelete(name string) error {
+	if err := validateSnapshotName(name); err != nil {
+		return err
+	}
+	dir := filepath.Join(snapshotsDir(), name)
+	if _, err := os.Stat(filepath.Join(dir, "snapshot.json")); err != nil {
+		return fmt.Errorf("snapshot not found: %s", name)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	printSuccess("Snapshot %s deleted", name)
+	return nil
+}
+
+// listSnapshots returns snapshot metadata, oldest first
+func listSnapshots() ([]*snapshotMeta, error) {
+	entries, err := os.ReadDir(snapshotsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*snapshotMeta
+	for _, entry := range entries {
+		meta := &snapshotMeta{}
+		if err := readJSONFile(filepath.Join(snapshotsDir(), entry.Name(), "snapshot.json"), meta); err != nil {
+			continue
+		}
+		snapshots = append(snapshots, meta)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.Before(snapshots[j].Created) })
+	return snapshots, nil
+}
+
+// withImageUnmounted runs fn with the image unmounted, so the image file is
+// consistent, and mounts it again afterwards if it was mounted before. It
+// refuses while other processes use the workspace, as some backends unmount
+// by force.
+func withImageUnmounted(fn func() error) error {
+	backend := ctx.Image()
+	if backend.Mounted() == nil {
+		return fn()
+	}
+
+	mountPoint := ctx.Config.Image.MountPoint
+	if image.Busy(mountPoint) {
+		return fmt.Errorf("%s is in use (close shells, editors and builds in the workspace, or stop the VM, and retry)", mountPoint)
+	}
+
+	if err := backend.Unmount(); err != nil {
+		return fmt.Errorf("failed to unmount image: %w", err)
+	}
+	err := fn()
+	if mountErr := backend.Mount(); mountErr != nil {
+		if err == nil {
+			err = fmt.Errorf("failed to remount image: %w", mountErr)
+		} else {
+			printWarn("Failed to remount image: %v", mountErr)
+		}
+	}
+	return err
+}
+
+// kernelConfigHash returns a short SHA-256 of the kernel .config, or "" if there is none
+func kernelConfigHash() string {
+	content, err := os.ReadFile(filepath.Join(ctx.KernelDir, ".config"))
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])[:12]
+}
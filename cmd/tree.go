@@ -0,0 +1,265 @@
+// Package cmd implements the Cobra CLI commands for elmos.
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/NguyenTrongPhuc552003/elmos/internal/core"
+)
+
+// treeCmd - multiple kernel trees via git worktree
+var treeCmd = &cobra.Command{
+	Use:   "tree",
+	Short: "Manage side-by-side kernel trees",
+	Long: `Keep several kernel versions checked out at once using git worktrees
+on the kernel volume. The active tree is used by the build, module, patch
+and qemu commands. The main clone is always available as "main".
+
+Examples:
+  elmos tree add stable v6.18      # Worktree for v6.18 named "stable"
+  elmos tree use stable            # Build against it
+  elmos tree use main              # Back to the main clone
+  elmos --profile stable-dev build # Profiles can pin a tree`,
+}
+
+var treeAddCmd = &cobra.Command{
+	Use:   "add [name] [ref]",
+	Short: "Add a kernel tree checked out at a branch, tag or commit",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		return runTreeAdd(args[0], args[1])
+	},
+}
+
+var treeListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List kernel trees",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		return runTreeList()
+	},
+}
+
+var treeUseCmd = &cobra.Command{
+	Use:   "use [name]",
+	Short: "Set the active kernel tree",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runTreeUse(args[0])
+	},
+}
+
+var treeRemoveCmd = &cobra.Command{
+	Use:     "remove [name]",
+	Aliases: []string{"rm"},
+	Short:   "Remove a kernel tree",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ctx.EnsureMounted(); err != nil {
+			return err
+		}
+		force, _ := cmd.Flags().GetBool("force")
+		return runTreeRemove(args[0], force)
+	},
+}
+
+func init() {
+	treeCmd.AddCommand(treeAddCmd)
+	treeCmd.AddCommand(treeListCmd)
+	treeCmd.AddCommand(treeUseCmd)
+	treeCmd.AddCommand(treeRemoveCmd)
+
+	treeRemoveCmd.Flags().BoolP("force", "f", false, "Remove even if the tree has local changes")
+}
+
+// kernelTree describes a worktree of the kernel repository
+type kernelTree struct {
+	Name   string
+	Path   string
+	Head   string
+	Branch string
+}
+
+func runTreeAdd(name, ref string) error {
+	cfg := ctx.Config
+
+	if err := validateTreeName(name); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Paths.KernelDir, ".git")); err != nil {
+		return fmt.Errorf("kernel repository not found at %s (run 'elmos repo clone')", cfg.Paths.KernelDir)
+	}
+
+	path := cfg.TreeDir(name)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("tree already exists: %s", name)
+	}
+
+	if err := os.MkdirAll(cfg.Tree.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create trees directory: %w", err)
+	}
+
+	printStep("Adding tree %s at %s...", name, ref)
+	if err := runGitIn(cfg.Paths.KernelDir, "worktree", "add", "--detach", path, ref); err != nil {
+		return fmt.Errorf("git worktree add failed: %w", err)
+	}
+
+	printSuccess("Tree %s created at %s", name, path)
+	printInfo("Activate it with: elmos tree use %s", name)
+	return nil
+}
+
+func runTreeList() error {
+	trees, err := listTrees()
+	if err != nil {
+		return err
+	}
+
+	active := ctx.Config.Tree.Active
+	if active == "" {
+		active = core.MainTreeName
+	}
+
+	fmt.Println()
+	fmt.Printf("  %-2s%-16s %-24s %s\n", "", "NAME", "REF", "PATH")
+	fmt.Println("  " + strings.Repeat("-", 70))
+	for _, t := range trees {
+		marker := " "
+		if t.Name == active {
+			marker = successStyle.Render("*")
+		}
+		ref := t.Branch
+		if ref == "" {
+			ref = t.Head
+		}
+		fmt.Printf("  %s %-16s %-24s %s\n", marker, t.Name, ref, t.Path)
+	}
+	fmt.Println()
+	return nil
+}
+
+func runTreeUse(name string) error {
+	cfg := ctx.Config
+
+	if name != core.MainTreeName {
+		if err := validateTreeName(name); err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(cfg.TreeDir(name), ".git")); err != nil {
+			return fmt.Errorf("tree not found: %s (run 'elmos tree list')", name)
+		}
+		cfg.Tree.Active = name
+	} else {
+		cfg.Tree.Active = ""
+	}
+
+	base := cfg.Unprofiled()
+	base.Tree.Active = cfg.Tree.Active
+	configPath := filepath.Join(cfg.Paths.ProjectRoot, "elmos.yaml")
+	if err := core.SaveConfig(base, configPath); err != nil {
+		return err
+	}
+
+	printSuccess("Active tree: %s (%s)", name, cfg.TreeDir(cfg.Tree.Active))
+	return nil
+}
+
+func runTreeRemove(name string, force bool) error {
+	cfg := ctx.Config
+
+	if name == core.MainTreeName {
+		return fmt.Errorf("the main tree cannot be removed (use 'elmos repo reinit')")
+	}
+	if err := validateTreeName(name); err != nil {
+		return err
+	}
+
+	path := cfg.TreeDir(name)
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("tree not found: %s", name)
+	}
+
+	args := []string{"worktree", "remove"}
+	if force {
+		args = append(args, "--force")
+	}
+	args = append(args, path)
+
+	printStep("Removing tree %s...", name)
+	if err := runGitIn(cfg.Paths.KernelDir, args...); err != nil {
+		return fmt.Errorf("git worktree remove failed (use --force to discard local changes): %w", err)
+	}
+
+	if base := cfg.Unprofiled(); base.Tree.Active == name || cfg.Tree.Active == name {
+		cfg.Tree.Active = ""
+		base.Tree.Active = ""
+		configPath := filepath.Join(cfg.Paths.ProjectRoot, "elmos.yaml")
+		if err := core.SaveConfig(base, configPath); err != nil {
+			return err
+		}
+		printInfo("Active tree reset to %s", core.MainTreeName)
+	}
+
+	printSuccess("Tree %s removed", name)
+	return nil
+}
+
+// listTrees returns the main clone and every worktree under the trees directory
+func listTrees() ([]kernelTree, error) {
+	cfg := ctx.Config
+
+	out, err := gitOutputIn(cfg.Paths.KernelDir, "worktree", "list", "--porcelain")
+	if err != nil {
+		return nil, fmt.Errorf("git worktree list failed: %w", err)
+	}
+
+	var trees []kernelTree
+	for _, block := range strings.Split(out, "\n\n") {
+		var t kernelTree
+		for _, line := range strings.Split(block, "\n") {
+			key, value, _ := strings.Cut(line, " ")
+			switch key {
+			case "worktree":
+				t.Path = value
+			case "HEAD":
+				t.Head = value[:min(12, len(value))]
+			case "branch":
+				t.Branch = strings.TrimPrefix(value, "refs/heads/")
+			}
+		}
+		if t.Path == "" {
+			continue
+		}
+
+		switch {
+		case filepath.Clean(t.Path) == filepath.Clean(cfg.Paths.KernelDir):
+			t.Name = core.MainTreeName
+		case filepath.Dir(filepath.Clean(t.Path)) == filepath.Clean(cfg.Tree.Dir):
+			t.Name = filepath.Base(t.Path)
+		default:
+			// Worktrees created outside elmos are not managed here
+			continue
+		}
+		trees = append(trees, t)
+	}
+	return trees, nil
+}
+
+// validateTreeName rejects names that cannot be used as a directory under the trees dir
+func validateTreeName(name string) error {
+	if name == "" || name == core.MainTreeName || name == "." || name == ".." ||
+		strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid tree name: %q", name)
+	}
+	return nil
+}
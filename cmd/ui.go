@@ -80,10 +80,32 @@ func executeAction(choice string) (string, error) {
 	return buf.String(), err
 }
 
+// uiActionCommands maps menu actions to the CLI commands whose workspace
+// lock they take
+var uiActionCommands = map[string]string{
+	"Init Workspace":            "init",
+	"Kernel Config (defconfig)": "kernel config",
+	"Kernel Menuconfig (UI)":    "kernel config",
+	"Build Kernel":              "build",
+	"Build Modules":             "module build",
+	"Build Apps":                "app build",
+	"Run QEMU":                  "qemu run",
+	"Run QEMU (Debug Mode)":     "qemu debug",
+}
+
 // runAction dispatches to the appropriate command handler
 func runAction(choice string) error {
 	printStep("Executing: %s", choice)
 
+	// The TUI stays open between actions, so each one locks the workspace
+	// only while it runs
+	if command, ok := uiActionCommands[choice]; ok {
+		if err := acquireLock(commandLocks[command], "elmos ui: "+command, false); err != nil {
+			return err
+		}
+		defer releaseLock()
+	}
+
 	switch choice {
 	case "Doctor (Check Environment)":
 		return runDoctor()
@@ -105,9 +127,9 @@ func runAction(choice string) error {
 	case "Build Apps":
 		return runAppsBuild("")
 	case "Run QEMU":
-		return runQEMU(false, false)
+		return runQEMU(false, false, "")
 	case "Run QEMU (Debug Mode)":
-		return runQEMU(true, false)
+		return runQEMU(true, false, "")
 	default:
 		return fmt.Errorf("unknown selection: %s", choice)
 	}
@@ -2,10 +2,13 @@
 package core
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strings"
 
 	"github.com/spf13/viper"
 )
@@ -13,14 +16,25 @@ import (
 // Default values
 const (
 	DefaultImageSize    = "20G"
+	DefaultImageMinFree = "5G"
 	DefaultVolumeName   = "kernel-dev"
 	DefaultArch         = "arm64"
 	DefaultCrossPrefix  = "llvm-"
 	DefaultMemory       = "2G"
 	DefaultGDBPort      = 1234
 	DefaultDebianMirror = "http://deb.debian.org/debian"
+	DefaultRootfs       = "debootstrap"
+	DefaultDebianSuite  = "stable"
+	DefaultCompression  = "gzip"
+	DefaultGuestAddress = "10.0.2.15/24"
+	DefaultGuestGateway = "10.0.2.2"
+	DefaultKernelRepo   = "https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git"
+	DefaultKernelBranch = "master"
 )
 
+// MainTreeName names the main kernel clone among the worktrees
+const MainTreeName = "main"
+
 // Config holds the application configuration
 type Config struct {
 	// Image settings
@@ -35,8 +49,32 @@ type Config struct {
 	// Paths
 	Paths PathsConfig `mapstructure:"paths"`
 
+	// Kernel repository settings
+	Repo RepoConfig `mapstructure:"repo"`
+
+	// Kernel worktree settings
+	Tree TreeConfig `mapstructure:"tree"`
+
+	// Patch series settings
+	Patches PatchesConfig `mapstructure:"patches"`
+
+	// Root filesystem settings
+	Rootfs RootfsConfig `mapstructure:"rootfs"`
+
+	// Initramfs settings
+	Initramfs InitramfsConfig `mapstructure:"initramfs"`
+
+	// Guest /init settings
+	Guest GuestConfig `mapstructure:"guest"`
+
 	// Profiles for different configurations
 	Profiles map[string]ProfileConfig `mapstructure:"profiles"`
+
+	// Profile is the profile applied with ApplyProfile, if any
+	Profile string `mapstructure:"-"`
+
+	// unprofiled is the configuration before ApplyProfile
+	unprofiled *Config
 }
 
 // ImageConfig holds disk image configuration
@@ -45,6 +83,13 @@ type ImageConfig struct {
 	VolumeName string `mapstructure:"volume_name"`
 	Size       string `mapstructure:"size"`
 	MountPoint string `mapstructure:"mount_point"`
+	// MinFree is the free space below which build and rootfs create warn
+	MinFree string `mapstructure:"min_free"`
+	// AutoMount mounts the image when a command needs the volume
+	AutoMount bool `mapstructure:"auto_mount"`
+	// IdleUnmount unmounts an auto-mounted image after this long unused
+	// (e.g. "30m"); empty disables it
+	IdleUnmount string `mapstructure:"idle_unmount"`
 }
 
 // BuildConfig holds kernel build configuration
@@ -70,17 +115,125 @@ type PathsConfig struct {
 	AppsDir      string `mapstructure:"apps_dir"`
 	LibrariesDir string `mapstructure:"libraries_dir"`
 	PatchesDir   string `mapstructure:"patches_dir"`
+	// RootfsDir and DiskImage are base paths; use Config.RootfsDir and
+	// Config.DiskImage, which add the architecture
 	RootfsDir    string `mapstructure:"rootfs_dir"`
 	DiskImage    string `mapstructure:"disk_image"`
 	DebianMirror string `mapstructure:"debian_mirror"`
 }
 
+// RepoConfig holds kernel git repository configuration
+type RepoConfig struct {
+	URL    string `mapstructure:"url"`
+	Branch string `mapstructure:"branch"`
+	// Remotes are extra named remotes (e.g. linux-next, stable) added after clone
+	Remotes map[string]string `mapstructure:"remotes"`
+}
+
+// TreeConfig holds settings for additional kernel trees (git worktrees)
+type TreeConfig struct {
+	// Active is the tree used for build, module and qemu commands;
+	// empty means the main clone at Paths.KernelDir
+	Active string `mapstructure:"active"`
+	// Dir is where worktrees are created (default: <mount point>/trees)
+	Dir string `mapstructure:"dir"`
+}
+
+// PatchesConfig holds project patch series configuration
+type PatchesConfig struct {
+	// AutoApply applies the version-matched series after clone, update and reset
+	AutoApply bool `mapstructure:"auto_apply"`
+}
+
+// RootfsConfig holds root filesystem configuration
+type RootfsConfig struct {
+	// Provider populates the rootfs: debootstrap, busybox or tarball
+	Provider string `mapstructure:"provider"`
+	// BusyBox is a statically linked busybox binary for the target architecture
+	BusyBox string `mapstructure:"busybox"`
+	// Tarball is a rootfs archive to import (Alpine minirootfs, Buildroot rootfs.tar)
+	Tarball string `mapstructure:"tarball"`
+	// Overlay is a directory copied on top of the rootfs
+	Overlay string `mapstructure:"overlay"`
+	// Packages are extra Debian packages installed by debootstrap
+	Packages []string `mapstructure:"packages"`
+	// RootPassword is the root password, plain or as a crypt(3) hash ("$6$...")
+	RootPassword string `mapstructure:"root_password"`
+	// AuthorizedKeys is a public key file installed as root's authorized_keys
+	AuthorizedKeys string `mapstructure:"authorized_keys"`
+	// Hostname is written to /etc/hostname and /etc/hosts
+	Hostname string `mapstructure:"hostname"`
+	// Fstab lines replace /etc/fstab, which /init mounts on boot
+	Fstab []string `mapstructure:"fstab"`
+	// Suite is the Debian release for debootstrap (e.g. stable, bookworm)
+	Suite string `mapstructure:"suite"`
+	// Variant is a debootstrap variant such as minbase or buildd; empty
+	// installs the required and important packages
+	Variant string `mapstructure:"variant"`
+	// Components are the archive components (default: main)
+	Components []string `mapstructure:"components"`
+	// Keyring verifies the archive signatures; empty disables the check
+	Keyring string `mapstructure:"keyring"`
+	// CacheDir holds debootstrap package tarballs for offline creation
+	CacheDir string `mapstructure:"cache_dir"`
+	// PerProfile gives each profile its own rootfs and disk image, in
+	// addition to each architecture
+	PerProfile bool `mapstructure:"per_profile"`
+}
+
+// InitramfsConfig holds initramfs build configuration
+type InitramfsConfig struct {
+	// Output is the archive path (default: next to the disk image)
+	Output string `mapstructure:"output"`
+	// Tree is a directory copied into the initramfs as is
+	Tree string `mapstructure:"tree"`
+	// Compression is gzip, zstd or none
+	Compression string `mapstructure:"compression"`
+}
+
+// GuestConfig holds the settings of the generated guest /init script
+type GuestConfig struct {
+	// Hostname is set on boot when not empty
+	Hostname string `mapstructure:"hostname"`
+	// Network is static, dhcp or none
+	Network string `mapstructure:"network"`
+	// Address (CIDR) and Gateway configure static networking
+	Address string `mapstructure:"address"`
+	Gateway string `mapstructure:"gateway"`
+	// DNS servers for /etc/resolv.conf; empty keeps the DHCP servers, or
+	// 8.8.8.8 with static networking
+	DNS []string `mapstructure:"dns"`
+	// Mounts are extra 9p or virtiofs shares mounted on boot
+	Mounts []GuestMount `mapstructure:"mounts"`
+	// Hooks are shell commands run after the system is up
+	Hooks []string `mapstructure:"hooks"`
+	// Poweroff powers the guest off after the hooks instead of starting a shell
+	Poweroff bool `mapstructure:"poweroff"`
+}
+
+// GuestMount is a host directory shared with the guest
+type GuestMount struct {
+	// Tag is the mount tag the device exports
+	Tag string `mapstructure:"tag"`
+	// Path is the mount point in the guest
+	Path string `mapstructure:"path"`
+	// Type is 9p (default) or virtiofs
+	Type string `mapstructure:"type"`
+	// Source is the host directory QEMU exports over 9p
+	Source string `mapstructure:"source"`
+	// Socket is the vhost-user socket of a running virtiofsd
+	Socket string `mapstructure:"socket"`
+	// Options are extra mount options
+	Options string `mapstructure:"options"`
+}
+
 // ProfileConfig holds a named configuration profile
 type ProfileConfig struct {
 	Arch         string `mapstructure:"arch"`
 	Jobs         int    `mapstructure:"jobs"`
 	Memory       string `mapstructure:"memory"`
 	CrossCompile string `mapstructure:"cross_compile"`
+	Tree         string `mapstructure:"tree"`
 }
 
 // configInstance is the global configuration
@@ -142,6 +295,8 @@ func setDefaults(v *viper.Viper) {
 	// Image defaults
 	v.SetDefault("image.volume_name", DefaultVolumeName)
 	v.SetDefault("image.size", DefaultImageSize)
+	v.SetDefault("image.min_free", DefaultImageMinFree)
+	v.SetDefault("image.auto_mount", false)
 
 	// Build defaults
 	v.SetDefault("build.arch", DefaultArch)
@@ -156,6 +311,26 @@ func setDefaults(v *viper.Viper) {
 
 	// Paths defaults
 	v.SetDefault("paths.debian_mirror", DefaultDebianMirror)
+
+	// Repo defaults
+	v.SetDefault("repo.url", DefaultKernelRepo)
+	v.SetDefault("repo.branch", DefaultKernelBranch)
+
+	// Patches defaults
+	v.SetDefault("patches.auto_apply", false)
+
+	// Rootfs defaults
+	v.SetDefault("rootfs.provider", DefaultRootfs)
+	v.SetDefault("rootfs.suite", DefaultDebianSuite)
+
+	// Initramfs defaults
+	v.SetDefault("initramfs.compression", DefaultCompression)
+
+	// Guest defaults
+	v.SetDefault("guest.network", "static")
+	v.SetDefault("guest.address", DefaultGuestAddress)
+	v.SetDefault("guest.gateway", DefaultGuestGateway)
+	v.SetDefault("guest.poweroff", false)
 }
 
 // applyComputedDefaults fills in paths based on project root
@@ -169,14 +344,22 @@ func applyComputedDefaults(cfg *Config) {
 
 	root := cfg.Paths.ProjectRoot
 
-	// Image path
-	if cfg.Image.Path == "" {
-		cfg.Image.Path = filepath.Join(root, "img.sparseimage")
-	}
-
-	// Mount point
-	if cfg.Image.MountPoint == "" {
-		cfg.Image.MountPoint = filepath.Join("/Volumes", cfg.Image.VolumeName)
+	// Image path and mount point: an APFS sparse image under /Volumes on macOS,
+	// an ext4 image mounted in the workspace state directory on Linux
+	if runtime.GOOS == "linux" {
+		if cfg.Image.Path == "" {
+			cfg.Image.Path = filepath.Join(root, "img.ext4")
+		}
+		if cfg.Image.MountPoint == "" {
+			cfg.Image.MountPoint = filepath.Join(cfg.StateDir(), "mnt", cfg.Image.VolumeName)
+		}
+	} else {
+		if cfg.Image.Path == "" {
+			cfg.Image.Path = filepath.Join(root, "img.sparseimage")
+		}
+		if cfg.Image.MountPoint == "" {
+			cfg.Image.MountPoint = filepath.Join("/Volumes", cfg.Image.VolumeName)
+		}
 	}
 
 	// Kernel directory (inside mount)
@@ -184,6 +367,11 @@ func applyComputedDefaults(cfg *Config) {
 		cfg.Paths.KernelDir = filepath.Join(cfg.Image.MountPoint, "linux")
 	}
 
+	// Worktrees directory (inside mount)
+	if cfg.Tree.Dir == "" {
+		cfg.Tree.Dir = filepath.Join(cfg.Image.MountPoint, "trees")
+	}
+
 	// Modules directory (project root)
 	if cfg.Paths.ModulesDir == "" {
 		cfg.Paths.ModulesDir = filepath.Join(root, "modules")
@@ -213,19 +401,24 @@ func applyComputedDefaults(cfg *Config) {
 	if cfg.Paths.DiskImage == "" {
 		cfg.Paths.DiskImage = filepath.Join(cfg.Image.MountPoint, "disk.img")
 	}
+
+	// Debootstrap package cache (project root, shareable with the team)
+	if cfg.Rootfs.CacheDir == "" {
+		cfg.Rootfs.CacheDir = filepath.Join(root, "rootfs-cache")
+	}
 }
 
-// SaveConfig saves the current configuration to a YAML file
+// SaveConfig saves the current configuration to a YAML file. Commands that
+// change the configuration save cfg.Unprofiled(), so a --profile does not
+// end up in the file.
 func SaveConfig(cfg *Config, path string) error {
 	v := viper.New()
 	v.SetConfigType("yaml")
 
-	// Set all values
-	v.Set("image", cfg.Image)
-	v.Set("build", cfg.Build)
-	v.Set("qemu", cfg.QEMU)
-	v.Set("paths", cfg.Paths)
-	v.Set("profiles", cfg.Profiles)
+	// Set all values, keyed by their mapstructure names so the file reads back
+	for key, value := range toConfigMap(reflect.ValueOf(*cfg)).(map[string]interface{}) {
+		v.Set(key, value)
+	}
 
 	// Ensure directory exists
 	dir := filepath.Dir(path)
@@ -241,12 +434,55 @@ func SaveConfig(cfg *Config, path string) error {
 	return nil
 }
 
+// toConfigMap converts a config value into nested maps keyed by mapstructure tags
+func toConfigMap(val reflect.Value) interface{} {
+	switch val.Kind() {
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		t := val.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			key := field.Tag.Get("mapstructure")
+			if key == "-" {
+				continue
+			}
+			if key == "" {
+				key = strings.ToLower(field.Name)
+			}
+			m[key] = toConfigMap(val.Field(i))
+		}
+		return m
+	case reflect.Map:
+		m := make(map[string]interface{}, val.Len())
+		iter := val.MapRange()
+		for iter.Next() {
+			m[fmt.Sprint(iter.Key().Interface())] = toConfigMap(iter.Value())
+		}
+		return m
+	case reflect.Slice:
+		s := make([]interface{}, val.Len())
+		for i := range s {
+			s[i] = toConfigMap(val.Index(i))
+		}
+		return s
+	default:
+		return val.Interface()
+	}
+}
+
 // ApplyProfile applies a named profile to the current configuration
 func (cfg *Config) ApplyProfile(name string) error {
 	profile, ok := cfg.Profiles[name]
 	if !ok {
 		return ConfigError(fmt.Sprintf("profile not found: %s", name), nil)
 	}
+	if cfg.unprofiled == nil {
+		unprofiled := *cfg
+		cfg.unprofiled = &unprofiled
+	}
 
 	if profile.Arch != "" {
 		cfg.Build.Arch = profile.Arch
@@ -260,6 +496,77 @@ func (cfg *Config) ApplyProfile(name string) error {
 	if profile.CrossCompile != "" {
 		cfg.Build.CrossCompile = profile.CrossCompile
 	}
+	if profile.Tree != "" {
+		cfg.Tree.Active = profile.Tree
+	}
+	cfg.Profile = name
 
 	return nil
 }
+
+// Unprofiled returns the configuration as loaded, without the overrides of
+// ApplyProfile; it is cfg itself when no profile is applied
+func (cfg *Config) Unprofiled() *Config {
+	if cfg.unprofiled != nil {
+		return cfg.unprofiled
+	}
+	return cfg
+}
+
+// RootfsKey names the rootfs directory and disk image of the current
+// architecture, and of the active profile with rootfs.per_profile
+func (cfg *Config) RootfsKey() string {
+	if cfg.Rootfs.PerProfile && cfg.Profile != "" {
+		return cfg.Build.Arch + "-" + cfg.Profile
+	}
+	return cfg.Build.Arch
+}
+
+// RootfsDir returns the rootfs directory of the current architecture,
+// e.g. <mount point>/rootfs-arm64
+func (cfg *Config) RootfsDir() string {
+	return cfg.Paths.RootfsDir + "-" + cfg.RootfsKey()
+}
+
+// DiskImage returns the disk image of the current architecture, e.g.
+// <mount point>/disk-arm64.img
+func (cfg *Config) DiskImage() string {
+	ext := filepath.Ext(cfg.Paths.DiskImage)
+	return strings.TrimSuffix(cfg.Paths.DiskImage, ext) + "-" + cfg.RootfsKey() + ext
+}
+
+// StateDir returns the workspace directory where elmos keeps its own state
+// (backups, locks, metadata), under the project root
+func (cfg *Config) StateDir() string {
+	return filepath.Join(cfg.Paths.ProjectRoot, ".elmos")
+}
+
+// maxSocketPath is the longest unix socket path every host accepts
+// (sun_path is 104 bytes on macOS, including the terminating NUL)
+const maxSocketPath = 103
+
+// QMPSocket returns the QMP control socket of the workspace's VM. Deep
+// project roots would exceed the unix socket path limit, so those use a
+// socket in the temporary directory named after the project root.
+func (cfg *Config) QMPSocket() string {
+	path := filepath.Join(cfg.StateDir(), "qmp.sock")
+	if len(path) <= maxSocketPath {
+		return path
+	}
+	sum := sha256.Sum256([]byte(cfg.Paths.ProjectRoot))
+	return filepath.Join(os.TempDir(), fmt.Sprintf("elmos-qmp-%x.sock", sum[:4]))
+}
+
+// AutoMountFile returns the file that records an on-demand mount of the image
+func (cfg *Config) AutoMountFile() string {
+	return filepath.Join(cfg.StateDir(), "automount.json")
+}
+
+// TreeDir returns the kernel source directory of a named tree; "main" or an
+// empty name refers to the main clone
+func (cfg *Config) TreeDir(name string) string {
+	if name == "" || name == MainTreeName {
+		return cfg.Paths.KernelDir
+	}
+	return filepath.Join(cfg.Tree.Dir, name)
+}
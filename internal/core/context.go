@@ -2,51 +2,97 @@
 package core
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/NguyenTrongPhuc552003/elmos/internal/image"
 )
 
 // Context holds the current build context and state
 type Context struct {
-	Config    *Config
-	Mounted   bool
+	Config  *Config
+	Mounted bool
+	// KernelDir is the active kernel tree: the main clone or a worktree
 	KernelDir string
 	Verbose   bool
+	// AutoMounted is set when EnsureMounted mounted the volume itself
+	AutoMounted bool
+	// OnAutoMount is called just before EnsureMounted mounts the volume
+	OnAutoMount func()
+}
+
+// AutoMountState records that elmos mounted the volume on demand. The file's
+// modification time is the last time a command used the volume.
+type AutoMountState struct {
+	MountedAt  time.Time `json:"mountedAt"`
+	WatcherPID int       `json:"watcherPid,omitempty"`
 }
 
 // NewContext creates a new build context with the given configuration
 func NewContext(cfg *Config) *Context {
 	return &Context{
 		Config:    cfg,
-		KernelDir: cfg.Paths.KernelDir,
+		KernelDir: cfg.TreeDir(cfg.Tree.Active),
 	}
 }
 
+// Image returns the disk image backend for the host OS
+func (ctx *Context) Image() image.Backend {
+	cfg := ctx.Config
+	return image.New(image.Options{
+		Path:       cfg.Image.Path,
+		VolumeName: cfg.Image.VolumeName,
+		Size:       cfg.Image.Size,
+		MountPoint: cfg.Image.MountPoint,
+	})
+}
+
 // IsMounted checks if the kernel volume is currently mounted
 func (ctx *Context) IsMounted() bool {
-	// Check if mount point exists and is a mount
-	info, err := os.Stat(ctx.Config.Image.MountPoint)
-	if err != nil || !info.IsDir() {
-		return false
+	return ctx.Image().Mounted() != nil
+}
+
+// EnsureMounted ensures the kernel volume is mounted, mounting it through the
+// image backend when image.auto_mount is set
+func (ctx *Context) EnsureMounted() error {
+	cfg := ctx.Config
+	stateFile := cfg.AutoMountFile()
+
+	if ctx.IsMounted() {
+		// Mark the on-demand mount as in use so it is not unmounted as idle
+		now := time.Now()
+		os.Chtimes(stateFile, now, now)
+		return nil
 	}
 
-	// Use mount command to verify
-	out, err := exec.Command("mount").Output()
-	if err != nil {
-		return false
+	if !cfg.Image.AutoMount {
+		return ImageError("kernel volume not mounted (run 'elmos image mount' or set image.auto_mount)", ErrNotMounted)
+	}
+	if _, err := os.Stat(cfg.Image.Path); err != nil {
+		return ImageError(fmt.Sprintf("image not found: %s (run 'elmos image create')", cfg.Image.Path), err)
 	}
 
-	return strings.Contains(string(out), ctx.Config.Image.MountPoint)
-}
+	if ctx.OnAutoMount != nil {
+		ctx.OnAutoMount()
+	}
+	if err := ctx.Image().Mount(); err != nil {
+		return ImageError("failed to auto-mount kernel volume", err)
+	}
+	ctx.AutoMounted = true
 
-// EnsureMounted ensures the kernel volume is mounted
-func (ctx *Context) EnsureMounted() error {
-	if !ctx.IsMounted() {
-		return ImageError("kernel volume not mounted", ErrNotMounted)
+	state, err := json.Marshal(AutoMountState{MountedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0755); err != nil {
+		return err
 	}
-	return nil
+	return os.WriteFile(stateFile, state, 0644)
 }
 
 // KernelExists checks if the kernel source directory exists
@@ -63,6 +109,90 @@ func (ctx *Context) HasConfig() bool {
 	return err == nil
 }
 
+// KernelVersion returns the "major.minor" version of the kernel tree (e.g. "6.18"),
+// read from the VERSION and PATCHLEVEL fields of the top-level Makefile
+func (ctx *Context) KernelVersion() (string, error) {
+	fields, err := ctx.makefileVersion()
+	if err != nil {
+		return "", err
+	}
+	return fields["VERSION"] + "." + fields["PATCHLEVEL"], nil
+}
+
+// KernelRelease returns the full version of the kernel tree (e.g. "6.18.0-rc1"),
+// including SUBLEVEL and EXTRAVERSION
+func (ctx *Context) KernelRelease() (string, error) {
+	fields, err := ctx.makefileVersion()
+	if err != nil {
+		return "", err
+	}
+	sublevel := fields["SUBLEVEL"]
+	if sublevel == "" {
+		sublevel = "0"
+	}
+	return fields["VERSION"] + "." + fields["PATCHLEVEL"] + "." + sublevel + fields["EXTRAVERSION"], nil
+}
+
+// makefileVersion reads the version fields from the top-level kernel Makefile
+func (ctx *Context) makefileVersion() (map[string]string, error) {
+	content, err := os.ReadFile(filepath.Join(ctx.KernelDir, "Makefile"))
+	if err != nil {
+		return nil, RepoError("failed to read kernel Makefile", err)
+	}
+
+	keys := map[string]bool{"VERSION": true, "PATCHLEVEL": true, "SUBLEVEL": true, "EXTRAVERSION": true}
+	fields := make(map[string]string)
+	for _, line := range strings.Split(string(content), "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		if keys[key] {
+			if _, seen := fields[key]; !seen {
+				fields[key] = strings.TrimSpace(value)
+			}
+		}
+		if len(fields) == len(keys) {
+			break
+		}
+	}
+
+	if fields["VERSION"] == "" || fields["PATCHLEVEL"] == "" {
+		return nil, RepoError("kernel version not found in Makefile", nil)
+	}
+
+	return fields, nil
+}
+
+// configArchSymbols maps the arch-selecting Kconfig symbol to the ARCH value,
+// most specific first (CONFIG_ARM is only set for 32-bit ARM)
+var configArchSymbols = []struct{ symbol, arch string }{
+	{"CONFIG_ARM64=y", "arm64"},
+	{"CONFIG_RISCV=y", "riscv"},
+	{"CONFIG_ARM=y", "arm"},
+	{"CONFIG_X86=y", "x86"},
+}
+
+// ConfigArch returns the architecture the kernel .config was generated for,
+// or "" if there is no .config or the arch is not recognized
+func (ctx *Context) ConfigArch() string {
+	content, err := os.ReadFile(filepath.Join(ctx.KernelDir, ".config"))
+	if err != nil {
+		return ""
+	}
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(string(content), "\n") {
+		lines[line] = true
+	}
+	for _, s := range configArchSymbols {
+		if lines[s.symbol] {
+			return s.arch
+		}
+	}
+	return ""
+}
+
 // GetKernelImage returns the path to the built kernel image for the current arch
 func (ctx *Context) GetKernelImage() string {
 	arch := ctx.Config.Build.Arch
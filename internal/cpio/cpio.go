@@ -0,0 +1,302 @@
+// Package cpio writes cpio archives in the "newc" (SVR4, no CRC) format that
+// the Linux kernel unpacks as an initramfs.
+package cpio
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File type bits of Header.Mode, as in stat(2)
+const (
+	TypeMask    = 0170000
+	TypeSocket  = 0140000
+	TypeSymlink = 0120000
+	TypeReg     = 0100000
+	TypeBlock   = 0060000
+	TypeDir     = 0040000
+	TypeChar    = 0020000
+	TypeFifo    = 0010000
+)
+
+const (
+	newcMagic   = "070701"
+	trailerName = "TRAILER!!!"
+	// maxSize is the largest file the 8-digit hex size field can hold
+	maxSize = 0xFFFFFFFF
+)
+
+// Header describes one archive entry
+type Header struct {
+	// Name is the path inside the archive, without a leading slash
+	Name string
+	// Mode holds the file type and permission bits
+	Mode    uint32
+	UID     uint32
+	GID     uint32
+	ModTime time.Time
+	// Size is the length of the data that follows; for symlinks it is the
+	// length of the target
+	Size int64
+	// Major and Minor are the device numbers of character and block devices
+	Major uint32
+	Minor uint32
+}
+
+// Writer writes a newc archive. Parent directories missing from the archive
+// are added automatically, because the kernel does not create them.
+type Writer struct {
+	w       io.Writer
+	offset  int64
+	ino     uint32
+	pending int64
+	dirs    map[string]bool
+	closed  bool
+}
+
+// NewWriter returns a Writer that writes an archive to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, ino: 1, dirs: map[string]bool{"": true, ".": true}}
+}
+
+// WriteHeader starts a new entry; Size bytes of data must then be written
+// with Write
+func (w *Writer) WriteHeader(hdr *Header) error {
+	if w.closed {
+		return fmt.Errorf("cpio: write after close")
+	}
+	if w.pending != 0 {
+		return fmt.Errorf("cpio: %d bytes missing from previous entry", w.pending)
+	}
+	if err := w.pad(); err != nil {
+		return err
+	}
+
+	name := cleanName(hdr.Name)
+	if name == "" {
+		return fmt.Errorf("cpio: empty entry name")
+	}
+	if err := w.addParents(path.Dir(name), hdr.ModTime); err != nil {
+		return err
+	}
+	if hdr.Mode&TypeMask == TypeDir {
+		w.dirs[name] = true
+	}
+
+	size := hdr.Size
+	if hdr.Mode&TypeMask != TypeReg && hdr.Mode&TypeMask != TypeSymlink {
+		size = 0
+	}
+	if size < 0 || size > maxSize {
+		return fmt.Errorf("cpio: %s: size %d out of range", name, size)
+	}
+	if err := w.writeHeader(name, hdr, size); err != nil {
+		return err
+	}
+	w.pending = size
+	return nil
+}
+
+// Write writes data of the current entry
+func (w *Writer) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.pending {
+		return 0, fmt.Errorf("cpio: write of %d bytes exceeds entry size", len(p))
+	}
+	n, err := w.w.Write(p)
+	w.offset += int64(n)
+	w.pending -= int64(n)
+	return n, err
+}
+
+// Close writes the trailer and pads the archive to a 512-byte boundary. It
+// does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	if w.pending != 0 {
+		return fmt.Errorf("cpio: %d bytes missing from last entry", w.pending)
+	}
+	if err := w.pad(); err != nil {
+		return err
+	}
+	if err := w.writeHeader(trailerName, &Header{}, 0); err != nil {
+		return err
+	}
+	w.closed = true
+	return w.padTo(512)
+}
+
+// WriteDir adds a directory
+func (w *Writer) WriteDir(name string, perm uint32) error {
+	return w.WriteHeader(&Header{Name: name, Mode: TypeDir | perm&07777, ModTime: time.Now()})
+}
+
+// WriteFile adds a regular file with the given content
+func (w *Writer) WriteFile(name string, perm uint32, content []byte) error {
+	hdr := &Header{Name: name, Mode: TypeReg | perm&07777, ModTime: time.Now(), Size: int64(len(content))}
+	if err := w.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(content)
+	return err
+}
+
+// WriteSymlink adds a symbolic link to target
+func (w *Writer) WriteSymlink(name, target string) error {
+	hdr := &Header{Name: name, Mode: TypeSymlink | 0777, ModTime: time.Now(), Size: int64(len(target))}
+	if err := w.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, target)
+	return err
+}
+
+// WriteDevice adds a character (TypeChar) or block (TypeBlock) device node
+func (w *Writer) WriteDevice(name string, typ, perm, major, minor uint32) error {
+	return w.WriteHeader(&Header{Name: name, Mode: typ | perm&07777, ModTime: time.Now(), Major: major, Minor: minor})
+}
+
+// CopyFile adds the host file src as name, keeping its permissions
+func (w *Writer) CopyFile(name, src string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hdr := &Header{Name: name, Mode: TypeReg | uint32(info.Mode().Perm()), ModTime: info.ModTime(), Size: info.Size()}
+	if err := w.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, f, info.Size())
+	return err
+}
+
+// AddTree adds the contents of the host directory root below prefix.
+// Regular files, directories and symlinks are copied with their permissions;
+// ownership is set to root, as the files belong to the guest. Other file
+// types are skipped.
+func (w *Writer) AddTree(root, prefix string) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(prefix, filepath.ToSlash(rel))
+		if cleanName(name) == "" {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		perm := uint32(info.Mode().Perm())
+		if info.Mode()&fs.ModeSticky != 0 {
+			perm |= 01000
+		}
+
+		switch {
+		case d.IsDir():
+			return w.WriteHeader(&Header{Name: name, Mode: TypeDir | perm, ModTime: info.ModTime()})
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return w.WriteSymlink(name, target)
+		case d.Type().IsRegular():
+			return w.CopyFile(name, p)
+		}
+		return nil
+	})
+}
+
+// addParents writes directory entries for dir and its missing ancestors
+func (w *Writer) addParents(dir string, modTime time.Time) error {
+	if w.dirs[dir] {
+		return nil
+	}
+	if err := w.addParents(path.Dir(dir), modTime); err != nil {
+		return err
+	}
+	w.dirs[dir] = true
+	return w.writeHeader(dir, &Header{Mode: TypeDir | 0755, ModTime: modTime}, 0)
+}
+
+// writeHeader writes a newc header and the padded name
+func (w *Writer) writeHeader(name string, hdr *Header, size int64) error {
+	modTime := hdr.ModTime
+	if modTime.IsZero() {
+		modTime = time.Unix(0, 0)
+	}
+	nlink := 1
+	if hdr.Mode&TypeMask == TypeDir {
+		nlink = 2
+	}
+
+	fields := []uint32{
+		w.ino,
+		hdr.Mode,
+		hdr.UID,
+		hdr.GID,
+		uint32(nlink),
+		uint32(modTime.Unix()),
+		uint32(size),
+		0, 0, // devmajor, devminor of the host filesystem
+		hdr.Major, hdr.Minor,
+		uint32(len(name) + 1),
+		0, // check, unused by newc
+	}
+	w.ino++
+
+	var b strings.Builder
+	b.WriteString(newcMagic)
+	for _, f := range fields {
+		fmt.Fprintf(&b, "%08X", f)
+	}
+	b.WriteString(name)
+	b.WriteByte(0)
+
+	n, err := io.WriteString(w.w, b.String())
+	w.offset += int64(n)
+	if err != nil {
+		return err
+	}
+	return w.pad()
+}
+
+// pad aligns the archive to the 4-byte boundary that newc uses
+func (w *Writer) pad() error {
+	return w.padTo(4)
+}
+
+func (w *Writer) padTo(align int64) error {
+	n := (align - w.offset%align) % align
+	if n == 0 {
+		return nil
+	}
+	written, err := w.w.Write(make([]byte, n))
+	w.offset += int64(written)
+	return err
+}
+
+// cleanName strips leading slashes and dots from an entry name
+func cleanName(name string) string {
+	name = path.Clean("/" + filepath.ToSlash(name))
+	return strings.TrimPrefix(name, "/")
+}
@@ -0,0 +1,196 @@
+package cpio
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// entry is one member of a parsed newc archive
+type entry struct {
+	name         string
+	mode         uint32
+	uid, gid     uint32
+	mtime        uint32
+	major, minor uint32
+	data         string
+}
+
+// readNewc parses a newc archive up to the trailer, checking the format
+// details the kernel relies on
+func readNewc(t *testing.T, archive []byte) []entry {
+	t.Helper()
+	var entries []entry
+	off := 0
+	for {
+		if off%4 != 0 {
+			t.Fatalf("header at offset %d is not 4-byte aligned", off)
+		}
+		if off+110 > len(archive) {
+			t.Fatalf("archive ends at %d without a trailer", off)
+		}
+		hdr := string(archive[off : off+110])
+		if !strings.HasPrefix(hdr, newcMagic) {
+			t.Fatalf("bad magic at offset %d: %q", off, hdr[:6])
+		}
+		field := func(i int) uint32 {
+			v, err := strconv.ParseUint(hdr[6+8*i:14+8*i], 16, 32)
+			if err != nil {
+				t.Fatalf("bad header field %d at offset %d: %v", i, off, err)
+			}
+			return uint32(v)
+		}
+		size, nameSize := int(field(6)), int(field(11))
+		nameStart := off + 110
+		if archive[nameStart+nameSize-1] != 0 {
+			t.Fatalf("name at offset %d is not NUL-terminated", nameStart)
+		}
+		e := entry{
+			name:  string(archive[nameStart : nameStart+nameSize-1]),
+			mode:  field(1),
+			uid:   field(2),
+			gid:   field(3),
+			mtime: field(5),
+			major: field(9),
+			minor: field(10),
+		}
+		dataStart := (nameStart + nameSize + 3) &^ 3
+		e.data = string(archive[dataStart : dataStart+size])
+		off = (dataStart + size + 3) &^ 3
+
+		if e.name == trailerName {
+			if len(archive)%512 != 0 {
+				t.Errorf("archive length %d is not padded to 512 bytes", len(archive))
+			}
+			return entries
+		}
+		entries = append(entries, e)
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	mtime := time.Unix(1700000000, 0)
+
+	if err := w.WriteFile("/etc/hostname", 0644, []byte("guest\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(&Header{Name: "bin/init", Mode: TypeReg | 0755, UID: 1, GID: 2, ModTime: mtime, Size: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteSymlink("bin/sh", "busybox"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteDevice("dev/console", TypeChar, 0600, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readNewc(t, buf.Bytes())
+	want := []struct {
+		name string
+		mode uint32
+		data string
+	}{
+		{"etc", TypeDir | 0755, ""},
+		{"etc/hostname", TypeReg | 0644, "guest\n"},
+		{"bin", TypeDir | 0755, ""},
+		{"bin/init", TypeReg | 0755, "abc"},
+		{"bin/sh", TypeSymlink | 0777, "busybox"},
+		{"dev", TypeDir | 0755, ""},
+		{"dev/console", TypeChar | 0600, ""},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.name != w.name || e.mode != w.mode || e.data != w.data {
+			t.Errorf("entry %d = %q %o %q, want %q %o %q", i, e.name, e.mode, e.data, w.name, w.mode, w.data)
+		}
+	}
+	if init := entries[3]; init.uid != 1 || init.gid != 2 || init.mtime != uint32(mtime.Unix()) {
+		t.Errorf("bin/init owner %d:%d mtime %d", init.uid, init.gid, init.mtime)
+	}
+	if console := entries[6]; console.major != 5 || console.minor != 1 {
+		t.Errorf("dev/console is %d,%d, want 5,1", console.major, console.minor)
+	}
+}
+
+func TestWriterSizeChecks(t *testing.T) {
+	w := NewWriter(&bytes.Buffer{})
+	if err := w.WriteHeader(&Header{Name: "f", Mode: TypeReg | 0644, Size: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("too long")); err == nil {
+		t.Error("Write beyond the entry size succeeded")
+	}
+	if _, err := w.Write([]byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteDir("d", 0755); err == nil {
+		t.Error("WriteHeader with data missing from the previous entry succeeded")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Close with data missing from the last entry succeeded")
+	}
+}
+
+// TestArchiveTool lists an archive with the system cpio (or bsdtar), to
+// catch format errors a hand-written reader would share with the writer
+func TestArchiveTool(t *testing.T) {
+	var list []string
+	if path, err := exec.LookPath("cpio"); err == nil {
+		list = []string{path, "-t", "--quiet"}
+	} else if path, err := exec.LookPath("bsdtar"); err == nil {
+		list = []string{path, "-tf", "-"}
+	} else {
+		t.Skip("neither cpio nor bsdtar found")
+	}
+
+	tree := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tree, "usr", "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tree, "usr", "bin", "app"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("usr/bin", filepath.Join(tree, "bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.AddTree(tree, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteFile("init", 0755, []byte("#!/bin/sh\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(list[0], list[1:]...)
+	cmd.Stdin = &buf
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s failed: %v\n%s", filepath.Base(list[0]), err, out)
+	}
+	got := strings.Fields(string(out))
+	want := []string{"bin", "usr", "usr/bin", "usr/bin/app", "init"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("archive lists %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,153 @@
+// Package crypt implements the SHA-512 crypt(3) password hash ("$6$") used
+// in /etc/shadow, so guest passwords can be set without running the guest.
+package crypt
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"strconv"
+	"strings"
+)
+
+// Round counts of the specification: the default is left out of the hash
+// string, and explicit counts are clamped to the limits
+const (
+	defaultRounds = 5000
+	minRounds     = 1000
+	maxRounds     = 999999999
+)
+
+// alphabet is crypt's base-64 alphabet
+const alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// SHA512 hashes password with a random salt and returns "$6$<salt>$<hash>"
+func SHA512(password string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	salt := make([]byte, len(buf))
+	for i, b := range buf {
+		salt[i] = alphabet[int(b)%len(alphabet)]
+	}
+	return SHA512WithSalt(password, string(salt)), nil
+}
+
+// SHA512WithSalt hashes password with the given salt (at most 16 characters
+// are used), following the SHA-crypt specification by Ulrich Drepper
+func SHA512WithSalt(password, salt string) string {
+	return sha512Crypt(password, salt, defaultRounds, false)
+}
+
+// SHA512WithRounds is SHA512WithSalt with an explicit round count, clamped
+// to 1000..999999999 and recorded as "$6$rounds=<n>$<salt>$<hash>"
+func SHA512WithRounds(password, salt string, rounds int) string {
+	return sha512Crypt(password, salt, min(max(rounds, minRounds), maxRounds), true)
+}
+
+// sha512Crypt computes the hash; custom says whether the round count goes
+// into the hash string
+func sha512Crypt(password, salt string, rounds int, custom bool) string {
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	p, s := []byte(password), []byte(salt)
+
+	// Digest B
+	h := sha512.New()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	b := h.Sum(nil)
+
+	// Digest A
+	h.Reset()
+	h.Write(p)
+	h.Write(s)
+	h.Write(repeat(b, len(p)))
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	// Digest DP: the password repeated len(p) times
+	h.Reset()
+	for range p {
+		h.Write(p)
+	}
+	pBytes := repeat(h.Sum(nil), len(p))
+
+	// Digest DS: the salt repeated 16 + A[0] times
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(s)
+	}
+	sBytes := repeat(h.Sum(nil), len(s))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(pBytes)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sBytes)
+		}
+		if i%7 != 0 {
+			h.Write(pBytes)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pBytes)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString("$6$")
+	if custom {
+		out.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	out.WriteString(salt)
+	out.WriteByte('$')
+	for _, g := range encodeOrder {
+		encode(&out, c[g[0]], c[g[1]], c[g[2]], 4)
+	}
+	encode(&out, 0, 0, c[63], 2)
+	return out.String()
+}
+
+// encodeOrder is the interleaved order in which the final digest bytes are
+// encoded, three at a time
+var encodeOrder = [21][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+// repeat returns the first n bytes of digest repeated as often as needed
+func repeat(digest []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, digest[:min(len(digest), n-len(out))]...)
+	}
+	return out
+}
+
+// encode writes n base-64 characters of the 24-bit group b2 b1 b0
+func encode(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out.WriteByte(alphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,81 @@
+package crypt
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test vectors from Ulrich Drepper's SHA-crypt specification
+var sha512Vectors = []struct {
+	name     string
+	salt     string
+	rounds   int // 0 for the default, left out of the hash
+	password string
+	want     string
+}{
+	{
+		"default rounds", "saltstring", 0, "Hello world!",
+		"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+	},
+	{
+		"explicit rounds, long salt", "saltstringsaltstring", 10000, "Hello world!",
+		"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+	},
+	{
+		"default rounds given explicitly", "toolongsaltstring", 5000, "This is just a test",
+		"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0",
+	},
+	{
+		"long password", "anotherlongsaltstring", 1400, "a very much longer text to encrypt.  This one even stretches over morethan one line.",
+		"$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1",
+	},
+	{
+		"short salt", "short", 77777, "we have a short salt string but not a short password",
+		"$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0",
+	},
+	{
+		"salt of 16 characters", "asaltof16chars..", 123456, "a short string",
+		"$6$rounds=123456$asaltof16chars..$BtCwjqMJGx5hrJhZywWvt0RLE8uZ4oPwcelCjmw2kSYu.Ec6ycULevoBK25fs2xXgMNrCzIMVcgEJAstJeonj1",
+	},
+	{
+		"rounds below the minimum", "roundstoolow", 10, "the minimum number is still observed",
+		"$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX.",
+	},
+}
+
+func TestSHA512Vectors(t *testing.T) {
+	for _, v := range sha512Vectors {
+		var got string
+		if v.rounds == 0 {
+			got = SHA512WithSalt(v.password, v.salt)
+		} else {
+			got = SHA512WithRounds(v.password, v.salt, v.rounds)
+		}
+		if got != v.want {
+			t.Errorf("%s:\n got %s\nwant %s", v.name, got, v.want)
+		}
+	}
+}
+
+func TestSHA512RandomSalt(t *testing.T) {
+	first, err := SHA512("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := SHA512("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Error("two hashes of the same password share a salt")
+	}
+
+	// The hash must verify against its own salt
+	salt := strings.Split(first, "$")[2]
+	if len(salt) != 16 || strings.Trim(salt, alphabet) != "" {
+		t.Fatalf("salt %q is not 16 crypt characters", salt)
+	}
+	if SHA512WithSalt("secret", salt) != first {
+		t.Errorf("rehashing with salt %q does not reproduce %s", salt, first)
+	}
+}
@@ -0,0 +1,55 @@
+package image
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Busy reports whether any other process has a file, working directory or
+// root open below mountPoint, i.e. whether unmounting would disturb it
+func Busy(mountPoint string) bool {
+	if resolved, err := filepath.EvalSymlinks(mountPoint); err == nil {
+		mountPoint = resolved
+	}
+
+	if runtime.GOOS != "linux" {
+		// lsof on a mount point lists every open file on that filesystem
+		out, err := exec.Command("lsof", "-t", "--", mountPoint).Output()
+		return err == nil && strings.TrimSpace(string(out)) != ""
+	}
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return false
+	}
+	self := strconv.Itoa(os.Getpid())
+	for _, proc := range procs {
+		pid := proc.Name()
+		if pid == self || pid[0] < '0' || pid[0] > '9' {
+			continue
+		}
+		base := filepath.Join("/proc", pid)
+
+		links := []string{filepath.Join(base, "cwd"), filepath.Join(base, "root")}
+		if fds, err := os.ReadDir(filepath.Join(base, "fd")); err == nil {
+			for _, fd := range fds {
+				links = append(links, filepath.Join(base, "fd", fd.Name()))
+			}
+		}
+		for _, link := range links {
+			if target, err := os.Readlink(link); err == nil && within(target, mountPoint) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// within reports whether path is dir or below it
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
@@ -0,0 +1,92 @@
+package image
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// Clone methods reported by CloneFile
+const (
+	CloneAPFS    = "apfs-clone"
+	CloneReflink = "reflink"
+	CloneCopy    = "copy"
+)
+
+// CloneFile copies src to dst, sharing blocks copy-on-write where the host
+// filesystem supports it (APFS clonefile on macOS, reflinks on btrfs and XFS)
+// and falling back to a sparse copy. It returns the method used.
+func CloneFile(src, dst string) (string, error) {
+	os.Remove(dst)
+
+	switch runtime.GOOS {
+	case "darwin":
+		if exec.Command("cp", "-c", src, dst).Run() == nil {
+			return CloneAPFS, nil
+		}
+	case "linux":
+		if exec.Command("cp", "--reflink=always", src, dst).Run() == nil {
+			return CloneReflink, nil
+		}
+	}
+	os.Remove(dst)
+
+	if err := sparseCopy(src, dst); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	return CloneCopy, nil
+}
+
+// sparseCopy copies a file, seeking over all-zero blocks so the copy of a
+// sparse image stays sparse
+func sparseCopy(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1<<20)
+	zero := make([]byte, len(buf))
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zero[:n]) {
+				if _, err := out.Seek(int64(n), io.SeekCurrent); err != nil {
+					out.Close()
+					return err
+				}
+			} else if _, err := out.Write(buf[:n]); err != nil {
+				out.Close()
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	// Trailing holes are not written, so set the length explicitly
+	if err := out.Truncate(info.Size()); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,81 @@
+package image
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// hdiutilBackend manages a case-sensitive APFS sparse image on macOS
+type hdiutilBackend struct {
+	opts Options
+}
+
+func (b *hdiutilBackend) Name() string {
+	return "hdiutil"
+}
+
+func (b *hdiutilBackend) Create() error {
+	err := run("hdiutil", "create",
+		"-size", b.opts.Size,
+		"-fs", "Case-sensitive APFS",
+		"-type", "SPARSE",
+		"-volname", b.opts.VolumeName,
+		b.opts.Path,
+	)
+	if err != nil {
+		return fmt.Errorf("hdiutil create failed: %w", err)
+	}
+	return nil
+}
+
+func (b *hdiutilBackend) Mount() error {
+	if err := run("hdiutil", "attach", b.opts.Path, "-quiet"); err != nil {
+		return fmt.Errorf("hdiutil attach failed: %w", err)
+	}
+	return nil
+}
+
+func (b *hdiutilBackend) Unmount() error {
+	if err := run("hdiutil", "detach", b.opts.MountPoint, "-force"); err != nil {
+		return fmt.Errorf("hdiutil detach failed: %w", err)
+	}
+	return nil
+}
+
+func (b *hdiutilBackend) Resize(size string) error {
+	if err := run("hdiutil", "resize", "-size", size, b.opts.Path); err != nil {
+		return fmt.Errorf("hdiutil resize failed: %w", err)
+	}
+	return nil
+}
+
+func (b *hdiutilBackend) Compact() error {
+	if err := run("hdiutil", "compact", b.opts.Path); err != nil {
+		return fmt.Errorf("hdiutil compact failed: %w", err)
+	}
+	return nil
+}
+
+// Mounted parses mount(8) output, whose lines read
+// "/dev/disk4s1 on /Volumes/kernel-dev (apfs, local, nodev, nosuid, journaled)"
+func (b *hdiutilBackend) Mounted() *Mount {
+	out, err := exec.Command("mount").Output()
+	if err != nil {
+		return nil
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		source, rest, ok := strings.Cut(line, " on ")
+		if !ok {
+			continue
+		}
+		mountPoint, opts, ok := strings.Cut(rest, " (")
+		if !ok || mountPoint != b.opts.MountPoint {
+			continue
+		}
+		fsType, _, _ := strings.Cut(opts, ",")
+		return &Mount{MountPoint: mountPoint, Source: source, FSType: fsType}
+	}
+	return nil
+}
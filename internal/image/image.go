@@ -0,0 +1,111 @@
+// Package image creates and mounts the disk image that holds the kernel
+// workspace: a case-sensitive APFS sparse image on macOS and an ext4 image
+// on Linux.
+package image
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Options describes the disk image and where it is mounted
+type Options struct {
+	Path       string
+	VolumeName string
+	Size       string
+	MountPoint string
+}
+
+// Mount describes an active mount of the image
+type Mount struct {
+	MountPoint string
+	Source     string
+	FSType     string
+}
+
+// Backend manages the disk image on one host OS
+type Backend interface {
+	// Name identifies the backend, e.g. "hdiutil" or "linux"
+	Name() string
+	// Create creates the image file and its filesystem
+	Create() error
+	// Mount mounts the image at the configured mount point
+	Mount() error
+	// Unmount unmounts the image
+	Unmount() error
+	// Resize grows or shrinks the image and its filesystem; the image must
+	// not be mounted
+	Resize(size string) error
+	// Compact returns unused blocks of the sparse image to the host; the
+	// image must not be mounted
+	Compact() error
+	// Mounted returns the active mount, or nil if the image is not mounted
+	Mounted() *Mount
+}
+
+// New returns the backend for the host OS
+func New(opts Options) Backend {
+	if runtime.GOOS == "linux" {
+		return &linuxBackend{opts: opts}
+	}
+	return &hdiutilBackend{opts: opts}
+}
+
+// ParseSize converts a size such as "20G", "512M" or "1.5T" to bytes, using
+// binary multiples like hdiutil and truncate
+func ParseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size: %q", size)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// findTool looks up a system tool, including the sbin directories that are
+// often missing from an unprivileged user's PATH
+func findTool(name string) string {
+	if path, err := exec.LookPath(name); err == nil {
+		return path
+	}
+	for _, dir := range []string{"/usr/sbin", "/sbin", "/usr/local/sbin"} {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// run executes a command attached to the terminal, so tools like sudo can prompt
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,328 @@
+package image
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// linuxBackend manages a sparse ext4 image on Linux. Root mounts it through a
+// loop device; other users get fuse2fs or udisksctl when available and sudo
+// as the last resort.
+type linuxBackend struct {
+	opts Options
+}
+
+func (b *linuxBackend) Name() string {
+	return "linux"
+}
+
+func (b *linuxBackend) Create() error {
+	size, err := ParseSize(b.opts.Size)
+	if err != nil {
+		return err
+	}
+
+	mkfs := findTool("mkfs.ext4")
+	if mkfs == "" {
+		return fmt.Errorf("mkfs.ext4 not found (install e2fsprogs)")
+	}
+
+	f, err := os.OpenFile(b.opts.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	// Truncate extends the file without allocating blocks, keeping it sparse
+	err = f.Truncate(size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(b.opts.Path)
+		return err
+	}
+
+	// root_owner lets the creating user write to the volume without sudo
+	err = run(mkfs, "-q", "-F",
+		"-L", b.opts.VolumeName,
+		"-E", fmt.Sprintf("root_owner=%d:%d", os.Getuid(), os.Getgid()),
+		b.opts.Path,
+	)
+	if err != nil {
+		os.Remove(b.opts.Path)
+		return fmt.Errorf("mkfs.ext4 failed: %w", err)
+	}
+	return nil
+}
+
+func (b *linuxBackend) Mount() error {
+	mp := b.opts.MountPoint
+
+	if os.Geteuid() == 0 {
+		if err := os.MkdirAll(mp, 0755); err != nil {
+			return err
+		}
+		if err := run("mount", "-o", "loop", b.opts.Path, mp); err != nil {
+			return fmt.Errorf("mount failed: %w", err)
+		}
+		return nil
+	}
+
+	if fuse2fs := findTool("fuse2fs"); fuse2fs != "" {
+		if err := os.MkdirAll(mp, 0755); err == nil {
+			if err := run(fuse2fs, b.opts.Path, mp); err != nil {
+				return fmt.Errorf("fuse2fs failed: %w", err)
+			}
+			return nil
+		}
+	}
+
+	if udisksctl := findTool("udisksctl"); udisksctl != "" {
+		return b.mountUdisks(udisksctl)
+	}
+
+	if _, err := exec.LookPath("sudo"); err != nil {
+		return fmt.Errorf("cannot mount %s without root: install fuse2fs or udisks2, or run as root", b.opts.Path)
+	}
+	if err := run("sudo", "mkdir", "-p", mp); err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+	if err := run("sudo", "mount", "-o", "loop", b.opts.Path, mp); err != nil {
+		return fmt.Errorf("sudo mount failed: %w", err)
+	}
+	return nil
+}
+
+var (
+	udisksLoopRe  = regexp.MustCompile(`as (/dev/loop\d+)`)
+	udisksMountRe = regexp.MustCompile(` at (.+?)\.?$`)
+)
+
+// mountUdisks attaches the image as a loop device and mounts it through
+// udisks. udisks picks the mount point (e.g. /run/media/$USER/<label>), so
+// the configured mount point becomes a symlink to it.
+func (b *linuxBackend) mountUdisks(udisksctl string) error {
+	out, err := exec.Command(udisksctl, "loop-setup", "--no-user-interaction", "-f", b.opts.Path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("udisksctl loop-setup failed: %s", strings.TrimSpace(string(out)))
+	}
+	m := udisksLoopRe.FindStringSubmatch(string(out))
+	if m == nil {
+		return fmt.Errorf("unexpected udisksctl output: %s", strings.TrimSpace(string(out)))
+	}
+	device := m[1]
+
+	// Desktop sessions may auto-mount the new loop device
+	actual := ""
+	for _, mnt := range readMountInfo() {
+		if mnt.Source == device {
+			actual = mnt.MountPoint
+		}
+	}
+	if actual == "" {
+		out, err := exec.Command(udisksctl, "mount", "--no-user-interaction", "-b", device).CombinedOutput()
+		if err != nil {
+			exec.Command(udisksctl, "loop-delete", "--no-user-interaction", "-b", device).Run()
+			return fmt.Errorf("udisksctl mount failed: %s", strings.TrimSpace(string(out)))
+		}
+		m := udisksMountRe.FindStringSubmatch(strings.TrimSpace(string(out)))
+		if m == nil {
+			return fmt.Errorf("unexpected udisksctl output: %s", strings.TrimSpace(string(out)))
+		}
+		actual = m[1]
+	}
+
+	if filepath.Clean(actual) == filepath.Clean(b.opts.MountPoint) {
+		return nil
+	}
+	// Replace an empty directory or stale link at the configured mount point
+	os.Remove(b.opts.MountPoint)
+	if err := os.MkdirAll(filepath.Dir(b.opts.MountPoint), 0755); err != nil {
+		return err
+	}
+	if err := os.Symlink(actual, b.opts.MountPoint); err != nil {
+		return fmt.Errorf("mounted at %s but failed to link %s: %w", actual, b.opts.MountPoint, err)
+	}
+	return nil
+}
+
+func (b *linuxBackend) Unmount() error {
+	m := b.Mounted()
+	if m == nil {
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(m.FSType, "fuse"):
+		for _, tool := range []string{"fusermount3", "fusermount"} {
+			if path := findTool(tool); path != "" {
+				if err := run(path, "-u", m.MountPoint); err != nil {
+					return fmt.Errorf("%s failed: %w", tool, err)
+				}
+				return nil
+			}
+		}
+		return run("umount", m.MountPoint)
+
+	case os.Geteuid() == 0:
+		if err := run("umount", m.MountPoint); err != nil {
+			return fmt.Errorf("umount failed: %w", err)
+		}
+		return nil
+
+	case strings.HasPrefix(m.Source, "/dev/loop") && findTool("udisksctl") != "":
+		udisksctl := findTool("udisksctl")
+		if err := run(udisksctl, "unmount", "--no-user-interaction", "-b", m.Source); err != nil {
+			return fmt.Errorf("udisksctl unmount failed: %w", err)
+		}
+		if err := run(udisksctl, "loop-delete", "--no-user-interaction", "-b", m.Source); err != nil {
+			return fmt.Errorf("udisksctl loop-delete failed: %w", err)
+		}
+		if info, err := os.Lstat(b.opts.MountPoint); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			os.Remove(b.opts.MountPoint)
+		}
+		return nil
+
+	default:
+		if err := run("sudo", "umount", m.MountPoint); err != nil {
+			return fmt.Errorf("sudo umount failed: %w", err)
+		}
+		return nil
+	}
+}
+
+func (b *linuxBackend) Resize(size string) error {
+	newSize, err := ParseSize(size)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(b.opts.Path)
+	if err != nil {
+		return err
+	}
+
+	resize2fs := findTool("resize2fs")
+	if resize2fs == "" {
+		return fmt.Errorf("resize2fs not found (install e2fsprogs)")
+	}
+	// resize2fs refuses to work on a filesystem that was not checked first
+	if err := b.fsck(); err != nil {
+		return err
+	}
+
+	if newSize >= info.Size() {
+		if err := os.Truncate(b.opts.Path, newSize); err != nil {
+			return err
+		}
+		if err := run(resize2fs, b.opts.Path); err != nil {
+			return fmt.Errorf("resize2fs failed: %w", err)
+		}
+		return nil
+	}
+
+	// Shrink the filesystem before the file so no data is cut off
+	if err := run(resize2fs, b.opts.Path, fmt.Sprintf("%dK", newSize/1024)); err != nil {
+		return fmt.Errorf("resize2fs failed (is the volume too full to shrink?): %w", err)
+	}
+	return os.Truncate(b.opts.Path, newSize)
+}
+
+// Compact discards free filesystem blocks; for an image file e2fsck punches
+// holes, so the blocks are released back to the host
+func (b *linuxBackend) Compact() error {
+	return b.fsck("-E", "discard")
+}
+
+// fsck force-checks the unmounted filesystem, fixing problems without asking
+func (b *linuxBackend) fsck(extra ...string) error {
+	e2fsck := findTool("e2fsck")
+	if e2fsck == "" {
+		return fmt.Errorf("e2fsck not found (install e2fsprogs)")
+	}
+
+	args := append([]string{"-f", "-y"}, extra...)
+	err := run(e2fsck, append(args, b.opts.Path)...)
+	// Exit code 1 means errors were found and corrected
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("e2fsck failed: %w", err)
+	}
+	return nil
+}
+
+// Mounted looks up the mount point in /proc/self/mountinfo. The mount point
+// may be a symlink to where udisks mounted the image.
+func (b *linuxBackend) Mounted() *Mount {
+	mp := filepath.Clean(b.opts.MountPoint)
+	if resolved, err := filepath.EvalSymlinks(mp); err == nil {
+		mp = resolved
+	}
+
+	// The last entry wins when mounts are stacked on the same point
+	var found *Mount
+	for _, mnt := range readMountInfo() {
+		if mnt.MountPoint == mp {
+			found = &mnt
+		}
+	}
+	return found
+}
+
+// readMountInfo parses /proc/self/mountinfo, whose lines read
+// "36 35 98:0 / /mnt/kernel-dev rw,noatime master:1 - ext4 /dev/loop0 rw"
+func readMountInfo() []Mount {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var mounts []Mount
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Optional fields end with "-", followed by fstype and source
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+		mounts = append(mounts, Mount{
+			MountPoint: unescapeMountPath(fields[4]),
+			FSType:     fields[sep+1],
+			Source:     unescapeMountPath(fields[sep+2]),
+		})
+	}
+	return mounts
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for space) used in mountinfo
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
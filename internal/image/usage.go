@@ -0,0 +1,90 @@
+package image
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// DirUsage is the allocated size of a directory tree
+type DirUsage struct {
+	Path string
+	Size int64
+}
+
+// FileUsage returns the apparent size of a file and the bytes actually
+// allocated for it, which is smaller for sparse images
+func FileUsage(path string) (apparent, allocated int64, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.Size(), allocatedSize(info), nil
+}
+
+// FreeSpace returns the free and total bytes of the filesystem holding path
+func FreeSpace(path string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	bsize := uint64(st.Bsize)
+	return st.Bavail * bsize, st.Blocks * bsize, nil
+}
+
+// LargestDirs returns the n largest entries directly under root, by allocated
+// size. Unreadable files are skipped.
+func LargestDirs(root string, n int) ([]DirUsage, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var usage []DirUsage
+	for _, entry := range entries {
+		path := filepath.Join(root, entry.Name())
+		var size int64
+		filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				size += allocatedSize(info)
+			}
+			return nil
+		})
+		usage = append(usage, DirUsage{Path: path, Size: size})
+	}
+
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Size > usage[j].Size })
+	if len(usage) > n {
+		usage = usage[:n]
+	}
+	return usage, nil
+}
+
+// allocatedSize returns the bytes allocated on disk for a file
+func allocatedSize(info fs.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		// st_blocks is always in 512-byte units
+		return int64(st.Blocks) * 512
+	}
+	return info.Size()
+}
+
+// FormatBytes renders a byte count with a binary unit, e.g. "4.2G"
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
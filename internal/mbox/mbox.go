@@ -0,0 +1,228 @@
+// Package mbox parses patches in the mbox format produced by git format-patch.
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FileStat holds the diffstat of a single file touched by a patch
+type FileStat struct {
+	Path       string `json:"path"`
+	Insertions int    `json:"insertions"`
+	Deletions  int    `json:"deletions"`
+}
+
+// Patch holds the metadata of a single mbox patch
+type Patch struct {
+	Name        string     `json:"name"`
+	From        string     `json:"from"`
+	Date        string     `json:"date"`
+	Subject     string     `json:"subject"`
+	SignedOffBy []string   `json:"signedOffBy"`
+	Files       []FileStat `json:"files"`
+}
+
+// Insertions returns the total number of inserted lines
+func (p *Patch) Insertions() int {
+	n := 0
+	for _, f := range p.Files {
+		n += f.Insertions
+	}
+	return n
+}
+
+// Deletions returns the total number of deleted lines
+func (p *Patch) Deletions() int {
+	n := 0
+	for _, f := range p.Files {
+		n += f.Deletions
+	}
+	return n
+}
+
+// Paths returns the paths of all files touched by the patch
+func (p *Patch) Paths() []string {
+	paths := make([]string, 0, len(p.Files))
+	for _, f := range p.Files {
+		paths = append(paths, f.Path)
+	}
+	return paths
+}
+
+// ParseFile parses the patch at path; Name is set to the file's base name
+func ParseFile(path string) (*Patch, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	p.Name = filepath.Base(path)
+	return p, nil
+}
+
+// Parse parses a single mbox patch
+func Parse(r io.Reader) (*Patch, error) {
+	br := bufio.NewReader(r)
+
+	// Skip the "From <sha> <date>" separator line, which is not a header
+	if head, err := br.Peek(5); err == nil && string(head) == "From " {
+		if _, err := br.ReadString('\n'); err != nil {
+			return nil, err
+		}
+	}
+
+	msg, err := mail.ReadMessage(br)
+	if err != nil {
+		return nil, fmt.Errorf("invalid patch headers: %w", err)
+	}
+
+	p := &Patch{
+		Date:    msg.Header.Get("Date"),
+		Subject: decodeHeader(msg.Header.Get("Subject")),
+	}
+	if p.Subject == "" {
+		return nil, fmt.Errorf("no Subject header")
+	}
+	p.Subject = stripSubjectPrefix(p.Subject)
+
+	if addrs, err := msg.Header.AddressList("From"); err == nil && len(addrs) > 0 {
+		p.From = formatAddress(addrs[0])
+	} else {
+		p.From = decodeHeader(msg.Header.Get("From"))
+	}
+
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	parseBody(p, body)
+
+	return p, nil
+}
+
+// parseBody extracts the Signed-off-by chain and per-file diffstat
+func parseBody(p *Patch, body []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	inMessage := true
+	var file *FileStat
+	oldLeft, newLeft := 0, 0
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if inMessage {
+			if line == "---" || strings.HasPrefix(line, "diff --git ") {
+				inMessage = false
+			} else if value, ok := strings.CutPrefix(line, "Signed-off-by:"); ok {
+				p.SignedOffBy = append(p.SignedOffBy, strings.TrimSpace(value))
+				continue
+			} else {
+				continue
+			}
+		}
+
+		// Inside a hunk: count lines until both sides are exhausted
+		if oldLeft > 0 || newLeft > 0 {
+			switch {
+			case strings.HasPrefix(line, "+"):
+				file.Insertions++
+				newLeft--
+			case strings.HasPrefix(line, "-"):
+				file.Deletions++
+				oldLeft--
+			case strings.HasPrefix(line, "\\"):
+				// "\ No newline at end of file"
+			default:
+				oldLeft--
+				newLeft--
+			}
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			p.Files = append(p.Files, FileStat{Path: diffPath(line)})
+			file = &p.Files[len(p.Files)-1]
+		case strings.HasPrefix(line, "@@ ") && file != nil:
+			oldLeft, newLeft = hunkLengths(line)
+		case line == "-- ":
+			// Start of the format-patch signature; nothing useful follows
+			return
+		}
+	}
+}
+
+// diffPath returns the destination path of a "diff --git a/X b/Y" line
+func diffPath(line string) string {
+	rest := strings.TrimPrefix(line, "diff --git ")
+	if i := strings.Index(rest, " b/"); i >= 0 {
+		return rest[i+3:]
+	}
+	return strings.TrimPrefix(rest, "a/")
+}
+
+// hunkLengths parses the old and new line counts of a "@@ -a,b +c,d @@" header
+func hunkLengths(line string) (int, int) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return 0, 0
+	}
+	return rangeLength(fields[1]), rangeLength(fields[2])
+}
+
+// rangeLength returns the line count of a hunk range such as "-12,7" (a bare
+// start line means a count of one)
+func rangeLength(r string) int {
+	_, count, ok := strings.Cut(r[1:], ",")
+	if !ok {
+		return 1
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// stripSubjectPrefix removes a leading "[PATCH ...]" tag from a subject
+func stripSubjectPrefix(subject string) string {
+	if strings.HasPrefix(subject, "[") {
+		if end := strings.Index(subject, "]"); end >= 0 {
+			return strings.TrimSpace(subject[end+1:])
+		}
+	}
+	return subject
+}
+
+// decodeHeader decodes RFC 2047 encoded words, as used for non-ASCII subjects
+func decodeHeader(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// formatAddress renders an address as "Name <email>"
+func formatAddress(addr *mail.Address) string {
+	if addr.Name == "" {
+		return addr.Address
+	}
+	return fmt.Sprintf("%s <%s>", addr.Name, addr.Address)
+}
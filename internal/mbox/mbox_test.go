@@ -0,0 +1,119 @@
+package mbox
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testPatch is git format-patch output with the cases that trip up naive
+// parsers: encoded headers, body lines starting with "From " (plain and
+// mboxrd-quoted) and hunk lines that look like diff headers
+const testPatch = `From 1234567890abcdef1234567890abcdef12345678 Mon Sep 17 00:00:00 2001
+From: =?UTF-8?q?J=C3=B6rg?= Example <jorg@example.com>
+Date: Tue, 14 Oct 2025 10:00:00 +0200
+Subject: [PATCH v2 1/2] =?UTF-8?q?fs:=20fix=20caf=C3=A9?=
+
+>From the original report: the cache is not flushed.
+From here on the fix is straightforward.
+
+Signed-off-by: Jörg Example <jorg@example.com>
+Signed-off-by: Maintainer <m@example.com>
+---
+ fs/a.c        | 3 ++-
+ include/b.h   | 2 +-
+ 2 files changed, 4 insertions(+), 2 deletions(-)
+
+diff --git a/fs/a.c b/fs/a.c
+index 1111111..2222222 100644
+--- a/fs/a.c
++++ b/fs/a.c
+@@ -1,3 +1,4 @@
+ context
+--- removed line starting with dashes
++-- added line starting with dashes
++++ added line that looks like a header
+ context
+diff --git a/include/b.h b/include/b.h
+index 3333333..4444444 100644
+--- a/include/b.h
++++ b/include/b.h
+@@ -5 +5 @@
+-old
++new
+` + "-- \n2.43.0\n"
+
+func TestParse(t *testing.T) {
+	p, err := Parse(strings.NewReader(testPatch))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.From != "Jörg Example <jorg@example.com>" {
+		t.Errorf("From = %q", p.From)
+	}
+	if p.Subject != "fs: fix café" {
+		t.Errorf("Subject = %q", p.Subject)
+	}
+	if p.Date != "Tue, 14 Oct 2025 10:00:00 +0200" {
+		t.Errorf("Date = %q", p.Date)
+	}
+	wantSOB := []string{"Jörg Example <jorg@example.com>", "Maintainer <m@example.com>"}
+	if !reflect.DeepEqual(p.SignedOffBy, wantSOB) {
+		t.Errorf("SignedOffBy = %q, want %q", p.SignedOffBy, wantSOB)
+	}
+
+	wantFiles := []FileStat{
+		{Path: "fs/a.c", Insertions: 2, Deletions: 1},
+		{Path: "include/b.h", Insertions: 1, Deletions: 1},
+	}
+	if !reflect.DeepEqual(p.Files, wantFiles) {
+		t.Errorf("Files = %+v, want %+v", p.Files, wantFiles)
+	}
+	if p.Insertions() != 3 || p.Deletions() != 2 {
+		t.Errorf("diffstat +%d -%d, want +3 -2", p.Insertions(), p.Deletions())
+	}
+}
+
+func TestParseWithoutSeparator(t *testing.T) {
+	// Patches edited by hand or saved from a mail client may lack the
+	// "From <sha>" line
+	_, rest, _ := strings.Cut(testPatch, "\n")
+	p, err := Parse(strings.NewReader(rest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Subject != "fs: fix café" || len(p.Files) != 2 {
+		t.Errorf("parsed %q with %d files", p.Subject, len(p.Files))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"no headers": "just a diff\n",
+		"no subject": "From: a@example.com\n\nbody\n",
+	} {
+		if _, err := Parse(strings.NewReader(content)); err == nil {
+			t.Errorf("%s: Parse succeeded", name)
+		}
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "0001-fs-fix-cafe.patch")
+	if err := os.WriteFile(path, []byte(testPatch), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ParseFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "0001-fs-fix-cafe.patch" {
+		t.Errorf("Name = %q", p.Name)
+	}
+	if !reflect.DeepEqual(p.Paths(), []string{"fs/a.c", "include/b.h"}) {
+		t.Errorf("Paths = %q", p.Paths())
+	}
+}
@@ -0,0 +1,290 @@
+// Package qmp is a client for the QEMU Machine Protocol, the JSON control
+// interface QEMU serves with -qmp.
+package qmp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned for commands on a closed connection or one that
+// QEMU closed before replying
+var ErrClosed = errors.New("qmp: connection closed")
+
+// eventBuffer is how many events are kept for Events before new ones are
+// dropped
+const eventBuffer = 64
+
+// Greeting is the banner QEMU sends when a client connects
+type Greeting struct {
+	QMP struct {
+		Version struct {
+			QEMU struct {
+				Major int `json:"major"`
+				Minor int `json:"minor"`
+				Micro int `json:"micro"`
+			} `json:"qemu"`
+			Package string `json:"package"`
+		} `json:"version"`
+		Capabilities []string `json:"capabilities"`
+	} `json:"QMP"`
+}
+
+// Version returns the QEMU version, e.g. "8.2.1"
+func (g *Greeting) Version() string {
+	v := g.QMP.Version.QEMU
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Micro)
+}
+
+// Event is an asynchronous notification from QEMU, e.g. STOP or SHUTDOWN
+type Event struct {
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+}
+
+// Time returns when QEMU emitted the event
+func (e *Event) Time() time.Time {
+	return time.Unix(e.Timestamp.Seconds, e.Timestamp.Microseconds*1000)
+}
+
+// Error is an error reply to a command
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Desc)
+}
+
+// message is anything QEMU sends after the greeting: a reply or an event
+type message struct {
+	Event
+	ID     string          `json:"id"`
+	Return json.RawMessage `json:"return"`
+	Error  *Error          `json:"error"`
+}
+
+// request is a command sent to QEMU
+type request struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+	ID        string `json:"id"`
+}
+
+// Client is a QMP connection in command mode. Commands may be issued from
+// several goroutines; replies are matched to them by id.
+type Client struct {
+	conn     net.Conn
+	greeting Greeting
+	events   chan Event
+
+	// writeMu serializes requests on the connection
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[string]chan message
+	err     error
+	done    chan struct{}
+}
+
+// Dial connects to a QMP unix socket and negotiates capabilities. The
+// timeout bounds the connection and the handshake.
+func Dial(path string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, err := NewClient(conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// NewClient runs the QMP handshake on an open connection (e.g. one end of
+// net.Pipe) and returns a client in command mode. The connection is closed
+// if the handshake fails.
+func NewClient(conn net.Conn) (*Client, error) {
+	c := &Client{
+		conn:    conn,
+		events:  make(chan Event, eventBuffer),
+		pending: map[string]chan message{},
+		done:    make(chan struct{}),
+	}
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("qmp: no greeting: %w", err)
+	}
+	if err := json.Unmarshal(line, &c.greeting); err != nil || c.greeting.QMP.Capabilities == nil {
+		conn.Close()
+		return nil, fmt.Errorf("qmp: invalid greeting: %s", line)
+	}
+
+	go c.readLoop(reader)
+
+	if err := c.Execute("qmp_capabilities", nil, nil); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("qmp: capabilities negotiation failed: %w", err)
+	}
+	return c, nil
+}
+
+// Greeting returns the banner QEMU sent on connection
+func (c *Client) Greeting() *Greeting {
+	return &c.greeting
+}
+
+// Events returns the asynchronous events received since the handshake.
+// Events that arrive while the buffer is full are dropped; the channel is
+// closed with the connection.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// SetDeadline bounds all further I/O on the connection; once it passes,
+// pending and later commands fail and the connection is closed
+func (c *Client) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// Execute runs a command and decodes its return value into result, unless
+// result is nil. A command QEMU rejects returns an *Error.
+func (c *Client) Execute(command string, args, result any) error {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.nextID++
+	id := strconv.Itoa(c.nextID)
+	reply := make(chan message, 1)
+	c.pending[id] = reply
+	c.mu.Unlock()
+
+	data, err := json.Marshal(request{Execute: command, Arguments: args, ID: id})
+	if err != nil {
+		c.forget(id)
+		return err
+	}
+	c.writeMu.Lock()
+	_, err = c.conn.Write(append(data, '\n'))
+	c.writeMu.Unlock()
+	if err != nil {
+		c.forget(id)
+		return fmt.Errorf("qmp: %s: %w", command, err)
+	}
+
+	select {
+	case msg := <-reply:
+		return decodeReply(msg, result)
+	case <-c.done:
+		// The reply may have been delivered just before the connection closed
+		select {
+		case msg := <-reply:
+			return decodeReply(msg, result)
+		default:
+			return c.closedErr()
+		}
+	}
+}
+
+// decodeReply returns the error of a reply, or decodes its return value
+func decodeReply(msg message, result any) error {
+	if msg.Error != nil {
+		return msg.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(msg.Return, result)
+}
+
+// HumanMonitorCommand runs a human monitor (HMP) command line, e.g.
+// "info registers", and returns its output
+func (c *Client) HumanMonitorCommand(line string) (string, error) {
+	var out string
+	err := c.Execute("human-monitor-command", map[string]string{"command-line": line}, &out)
+	return out, err
+}
+
+// Close closes the connection; pending commands fail with ErrClosed
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+// readLoop dispatches replies to their commands and queues events until
+// the connection fails
+func (c *Client) readLoop(reader *bufio.Reader) {
+	var err error
+	for {
+		var line []byte
+		if line, err = reader.ReadBytes('\n'); err != nil {
+			break
+		}
+		var msg message
+		if err = json.Unmarshal(line, &msg); err != nil {
+			err = fmt.Errorf("qmp: invalid message: %s", line)
+			break
+		}
+
+		if msg.Event.Event != "" {
+			select {
+			case c.events <- msg.Event:
+			default:
+			}
+			continue
+		}
+		c.mu.Lock()
+		reply, ok := c.pending[msg.ID]
+		delete(c.pending, msg.ID)
+		c.mu.Unlock()
+		if ok {
+			reply <- msg
+		}
+	}
+
+	c.mu.Lock()
+	c.err = ErrClosed
+	if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		c.err = fmt.Errorf("%w: %v", ErrClosed, err)
+	}
+	c.pending = map[string]chan message{}
+	c.mu.Unlock()
+	c.conn.Close()
+	close(c.events)
+	close(c.done)
+}
+
+// forget drops a command whose request could not be sent
+func (c *Client) forget(id string) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// closedErr returns why the connection closed
+func (c *Client) closedErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
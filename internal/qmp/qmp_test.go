@@ -0,0 +1,233 @@
+package qmp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+const testGreeting = `{"QMP": {"version": {"qemu": {"micro": 1, "minor": 2, "major": 8}, "package": ""}, "capabilities": ["oob"]}}`
+
+// fakeQMP is the QEMU end of a net.Pipe
+type fakeQMP struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// recv reads the next command the client sent
+func (s *fakeQMP) recv() request {
+	s.t.Helper()
+	line, err := s.reader.ReadBytes('\n')
+	if err != nil {
+		s.t.Errorf("fake QMP: read: %v", err)
+		return request{}
+	}
+	var req request
+	if err := json.Unmarshal(line, &req); err != nil {
+		s.t.Errorf("fake QMP: invalid request %s: %v", line, err)
+	}
+	return req
+}
+
+// send writes one message, terminated like QEMU's
+func (s *fakeQMP) send(format string, args ...any) {
+	s.t.Helper()
+	if _, err := fmt.Fprintf(s.conn, format+"\r\n", args...); err != nil {
+		s.t.Errorf("fake QMP: write: %v", err)
+	}
+}
+
+// reply answers a request with a return value
+func (s *fakeQMP) reply(req request, ret string) {
+	s.send(`{"return": %s, "id": %q}`, ret, req.ID)
+}
+
+// event emits an asynchronous event
+func (s *fakeQMP) event(name string) {
+	s.send(`{"timestamp": {"seconds": 1700000000, "microseconds": 5}, "event": %q, "data": {"reason": "test"}}`, name)
+}
+
+// newFakeQMP connects a client to a fake QEMU that has completed the
+// handshake; serve then runs as QEMU until it returns
+func newFakeQMP(t *testing.T, serve func(s *fakeQMP)) *Client {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	s := &fakeQMP{t: t, conn: serverConn, reader: bufio.NewReader(serverConn)}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer serverConn.Close()
+		s.send(testGreeting)
+		req := s.recv()
+		if req.Execute != "qmp_capabilities" {
+			t.Errorf("first command = %q, want qmp_capabilities", req.Execute)
+		}
+		s.reply(req, "{}")
+		if serve != nil {
+			serve(s)
+		}
+	}()
+
+	client, err := NewClient(clientConn)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client
+}
+
+func TestHandshake(t *testing.T) {
+	client := newFakeQMP(t, nil)
+
+	if got := client.Greeting().Version(); got != "8.2.1" {
+		t.Errorf("Version() = %q, want 8.2.1", got)
+	}
+	if caps := client.Greeting().QMP.Capabilities; len(caps) != 1 || caps[0] != "oob" {
+		t.Errorf("capabilities = %v, want [oob]", caps)
+	}
+}
+
+func TestInvalidGreeting(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		fmt.Fprint(serverConn, "{\"hello\": 1}\n")
+		serverConn.Close()
+	}()
+
+	if _, err := NewClient(clientConn); err == nil {
+		t.Fatal("NewClient accepted a greeting without QMP capabilities")
+	}
+}
+
+func TestRepliesMatchedByID(t *testing.T) {
+	release := make(chan struct{})
+	client := newFakeQMP(t, func(s *fakeQMP) {
+		first, second := s.recv(), s.recv()
+		if first.ID == second.ID {
+			t.Errorf("two commands share id %q", first.ID)
+		}
+		// Answer out of order
+		for _, req := range []request{second, first} {
+			s.reply(req, fmt.Sprintf(`{"status": %q}`, req.Execute))
+		}
+		<-release
+	})
+	defer close(release)
+
+	type result struct {
+		command, status string
+		err             error
+	}
+	results := make(chan result, 2)
+	for _, command := range []string{"query-status", "query-name"} {
+		go func(command string) {
+			var ret struct {
+				Status string `json:"status"`
+			}
+			err := client.Execute(command, nil, &ret)
+			results <- result{command, ret.Status, err}
+		}(command)
+	}
+
+	for range 2 {
+		r := <-results
+		if r.err != nil {
+			t.Errorf("%s: %v", r.command, r.err)
+		} else if r.status != r.command {
+			t.Errorf("%s got the reply to %s", r.command, r.status)
+		}
+	}
+}
+
+func TestErrorReply(t *testing.T) {
+	client := newFakeQMP(t, func(s *fakeQMP) {
+		req := s.recv()
+		s.send(`{"id": %q, "error": {"class": "CommandNotFound", "desc": "The command %s has not been found"}}`, req.ID, req.Execute)
+		req = s.recv()
+		s.reply(req, `"ok\r\n"`)
+	})
+
+	err := client.Execute("no-such-command", nil, nil)
+	var qmpErr *Error
+	if !errors.As(err, &qmpErr) {
+		t.Fatalf("Execute error = %v, want *Error", err)
+	}
+	if qmpErr.Class != "CommandNotFound" {
+		t.Errorf("Class = %q, want CommandNotFound", qmpErr.Class)
+	}
+
+	// The connection stays usable after an error reply
+	out, err := client.HumanMonitorCommand("info status")
+	if err != nil || out != "ok\r\n" {
+		t.Errorf("HumanMonitorCommand = %q, %v", out, err)
+	}
+}
+
+func TestEventsBetweenReplies(t *testing.T) {
+	client := newFakeQMP(t, func(s *fakeQMP) {
+		req := s.recv()
+		s.event("STOP")
+		s.reply(req, "{}")
+		s.event("RESUME")
+		req = s.recv()
+		s.reply(req, `{"running": true, "status": "running"}`)
+	})
+
+	if err := client.Execute("stop", nil, nil); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	var status struct {
+		Running bool `json:"running"`
+	}
+	if err := client.Execute("query-status", nil, &status); err != nil || !status.Running {
+		t.Fatalf("query-status = %+v, %v", status, err)
+	}
+
+	for _, want := range []string{"STOP", "RESUME"} {
+		select {
+		case event := <-client.Events():
+			if event.Event != want {
+				t.Errorf("event = %q, want %q", event.Event, want)
+			}
+			if event.Time().Unix() != 1700000000 {
+				t.Errorf("event time = %v", event.Time())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %s event", want)
+		}
+	}
+}
+
+func TestClosedByPeer(t *testing.T) {
+	client := newFakeQMP(t, func(s *fakeQMP) {
+		// quit: QEMU may exit before it replies
+		s.recv()
+		s.event("SHUTDOWN")
+	})
+
+	err := client.Execute("quit", nil, nil)
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("quit error = %v, want ErrClosed", err)
+	}
+
+	var events []string
+	for event := range client.Events() {
+		events = append(events, event.Event)
+	}
+	if len(events) != 1 || events[0] != "SHUTDOWN" {
+		t.Errorf("events = %v, want [SHUTDOWN]", events)
+	}
+
+	if err := client.Execute("query-status", nil, nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("command after close: %v, want ErrClosed", err)
+	}
+}